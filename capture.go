@@ -0,0 +1,245 @@
+//go:build !tinygo
+
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+// ไฟล์ capture เก็บทุกบรรทัดที่วิ่งผ่านพอร์ต Serial เป็น JSON บรรทัดละรายการ
+//
+//    {"t":"2024-05-01T10:00:00.123Z","port":"/dev/ttyACM0","dir":"rx","line":"$12,data,{...}*1A2B"}
+//
+// dir: rx = Pico -> server, tx = server -> Pico, open/lost = ต่อพอร์ตได้/หลุด
+// port: พอร์ตของ Pico ตัวนั้น (ไฟล์เก่าที่ไม่มี port ถือเป็นพอร์ตเดียวกันหมด)
+type captureEntry struct {
+    Time time.Time `json:"t"`
+    Port string    `json:"port,omitempty"`
+    Dir  string    `json:"dir"`
+    Line string    `json:"line"`
+}
+
+const (
+    captureRx   = "rx"
+    captureTx   = "tx"
+    captureOpen = "open"
+    captureLost = "lost"
+)
+
+// captureFile เขียน entry ต่อท้ายไฟล์ ใช้ร่วมกันได้หลายพอร์ต/หลายรอบการเชื่อมต่อ
+type captureFile struct {
+    mu  sync.Mutex
+    f   *os.File
+    enc *json.Encoder
+}
+
+func openCaptureFile(path string) (*captureFile, error) {
+    f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+    if err != nil {
+        return nil, err
+    }
+    return &captureFile{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (c *captureFile) record(port, dir, line string) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if err := c.enc.Encode(captureEntry{Time: time.Now(), Port: port, Dir: dir, Line: line}); err != nil {
+        fmt.Println("Capture write error:", err)
+    }
+}
+
+func (c *captureFile) close() error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.f.Close()
+}
+
+// recordingPort ห่อพอร์ตไว้ แล้วบันทึกทุกบรรทัดที่อ่าน/เขียนลง captureFile
+type recordingPort struct {
+    io.ReadWriteCloser
+    name    string
+    capture *captureFile
+
+    rxMu sync.Mutex
+    rx   []byte // ส่วนของบรรทัดที่อ่านมาแล้วแต่ยังไม่เจอ '\n'
+    txMu sync.Mutex
+    tx   []byte
+}
+
+func newRecordingPort(name string, port io.ReadWriteCloser, capture *captureFile) *recordingPort {
+    return &recordingPort{ReadWriteCloser: port, name: name, capture: capture}
+}
+
+func (p *recordingPort) Read(b []byte) (int, error) {
+    n, err := p.ReadWriteCloser.Read(b)
+    if n > 0 {
+        p.rxMu.Lock()
+        p.rx = p.recordLines(captureRx, append(p.rx, b[:n]...))
+        p.rxMu.Unlock()
+    }
+    return n, err
+}
+
+func (p *recordingPort) Write(b []byte) (int, error) {
+    n, err := p.ReadWriteCloser.Write(b)
+    if n > 0 {
+        p.txMu.Lock()
+        p.tx = p.recordLines(captureTx, append(p.tx, b[:n]...))
+        p.txMu.Unlock()
+    }
+    return n, err
+}
+
+// บันทึกทุกบรรทัดที่ครบแล้ว คืนส่วนที่ยังไม่ครบบรรทัด
+func (p *recordingPort) recordLines(dir string, buf []byte) []byte {
+    for {
+        i := bytes.IndexByte(buf, '\n')
+        if i < 0 {
+            return buf
+        }
+        p.capture.record(p.name, dir, strings.TrimRight(string(buf[:i]), "\r"))
+        buf = buf[i+1:]
+    }
+}
+
+var errReplayDone = errors.New("replay finished")
+
+// replayPort ป้อนบรรทัด rx จากไฟล์ capture กลับเข้ามาเหมือนอ่านจาก Pico
+// ตามจังหวะเวลาเดิมหารด้วย speed (speed <= 0 = เร็วที่สุด)
+// สิ่งที่ server เขียนออกไประหว่าง replay จะถูกทิ้ง
+type replayPort struct {
+    entries []captureEntry
+    speed   float64
+
+    pending []byte
+    last    time.Time
+
+    mu     sync.Mutex
+    closed bool
+}
+
+func loadCapture(path string) ([]captureEntry, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    var entries []captureEntry
+    sc := bufio.NewScanner(f)
+    sc.Buffer(make([]byte, 64*1024), 1024*1024)
+    for n := 1; sc.Scan(); n++ {
+        var e captureEntry
+        if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+            return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+        }
+        entries = append(entries, e)
+    }
+    return entries, sc.Err()
+}
+
+func (p *replayPort) Read(b []byte) (int, error) {
+    for len(p.pending) == 0 {
+        if p.isClosed() {
+            return 0, io.ErrClosedPipe
+        }
+        if len(p.entries) == 0 {
+            return 0, errReplayDone
+        }
+        e := p.entries[0]
+        p.entries = p.entries[1:]
+
+        if !p.last.IsZero() && p.speed > 0 {
+            time.Sleep(time.Duration(float64(e.Time.Sub(p.last)) / p.speed))
+        }
+        p.last = e.Time
+
+        switch e.Dir {
+        case captureRx:
+            p.pending = []byte(e.Line + "\n")
+        case captureOpen, captureLost:
+            fmt.Printf("Replay [%s] %s %s\n", e.Time.Format(time.RFC3339), e.Dir, e.Line)
+        }
+    }
+    n := copy(b, p.pending)
+    p.pending = p.pending[n:]
+    return n, nil
+}
+
+// lineTime = เวลาที่บันทึกบรรทัดล่าสุดไว้ (readLoop อ่านทีละบรรทัดจึงตรงกับบรรทัดที่กำลัง dispatch)
+func (p *replayPort) lineTime() time.Time {
+    return p.last
+}
+
+func (p *replayPort) Write(b []byte) (int, error) {
+    return len(b), nil
+}
+
+func (p *replayPort) isClosed() bool {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return p.closed
+}
+
+func (p *replayPort) Close() error {
+    p.mu.Lock()
+    p.closed = true
+    p.mu.Unlock()
+    return nil
+}
+
+// replayCapture เล่นไฟล์ capture ผ่าน serialSession (frame/CRC/ingestLine เหมือนของจริง)
+// แต่ละพอร์ตในไฟล์จะเป็น device หนึ่งตัวใน gateway และเล่นพร้อมกัน
+// ข้อมูลจะถูกบันทึกลง DB และส่ง MQTT ตามปกติ
+func replayCapture(gw *gateway, path string, speed float64) error {
+    entries, err := loadCapture(path)
+    if err != nil {
+        return err
+    }
+    fmt.Printf("Replaying %d entries from %s (speed x%g)\n", len(entries), path, speed)
+
+    var ports []string
+    byPort := make(map[string][]captureEntry)
+    for _, e := range entries {
+        if _, ok := byPort[e.Port]; !ok {
+            ports = append(ports, e.Port)
+        }
+        byPort[e.Port] = append(byPort[e.Port], e)
+    }
+
+    errs := make(chan error, len(ports))
+    for _, port := range ports {
+        name := port
+        if name == "" {
+            name = "replay"
+        }
+        link := newSerialLink(name)
+        sess := newSerialSession(&replayPort{entries: byPort[port], speed: speed}, link)
+        link.setOnline(name, sess)
+        gw.add(link)
+        go func() {
+            err := sess.readLoop()
+            link.setOffline(err)
+            if errors.Is(err, errReplayDone) {
+                err = nil
+            }
+            errs <- err
+        }()
+    }
+    for range ports {
+        if e := <-errs; e != nil && err == nil {
+            err = e
+        }
+    }
+    return err
+}
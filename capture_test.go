@@ -0,0 +1,91 @@
+//go:build !tinygo
+
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "errors"
+    "io"
+    "path/filepath"
+    "strings"
+    "testing"
+    "testing/iotest"
+    "time"
+
+    "smart_farm/protocol"
+)
+
+// fakeSerial อ่านจาก r ทีละไบต์ (บรรทัดมาไม่ครบในครั้งเดียวเหมือนพอร์ตจริง) และเก็บสิ่งที่เขียน
+type fakeSerial struct {
+    r io.Reader
+    w bytes.Buffer
+}
+
+func (p *fakeSerial) Read(b []byte) (int, error)  { return p.r.Read(b) }
+func (p *fakeSerial) Write(b []byte) (int, error) { return p.w.Write(b) }
+func (p *fakeSerial) Close() error                { return nil }
+
+func TestCaptureRecordReplay(t *testing.T) {
+    rx := []string{
+        protocol.Frame{ID: 0, Type: protocol.TypeData, Payload: `{"type":"air","air_id":1,"temp":25.1,"air_humidity":60.2}`}.Encode(),
+        protocol.Frame{ID: 7, Type: protocol.TypeAck, Payload: "light13=40"}.Encode(),
+        "ACK: Pump ON", // บรรทัดแบบเดิมที่ไม่ใช่ frame ก็ต้องเก็บไว้เหมือนกัน
+        protocol.Frame{ID: 0, Type: protocol.TypeData, Payload: `{"type":"soil","soil_id":1,"soil_humidity":41.5}`}.Encode(),
+    }
+    path := filepath.Join(t.TempDir(), "capture.jsonl")
+    capture, err := openCaptureFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    start := time.Now()
+    capture.record("/dev/ttyACM0", captureOpen, "/dev/ttyACM0")
+    port := newRecordingPort("/dev/ttyACM0", &fakeSerial{r: iotest.OneByteReader(strings.NewReader(strings.Join(rx, "\r\n") + "\r\n"))}, capture)
+    io.WriteString(port, protocol.Frame{ID: 7, Type: protocol.TypeCommand, Payload: "light13:40"}.Encode()+"\n")
+    if _, err := io.ReadAll(port); err != nil {
+        t.Fatal(err)
+    }
+    end := time.Now()
+    if err := capture.close(); err != nil {
+        t.Fatal(err)
+    }
+
+    entries, err := loadCapture(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var recorded []captureEntry
+    for i, e := range entries {
+        if e.Port != "/dev/ttyACM0" {
+            t.Errorf("entry %d port = %q", i, e.Port)
+        }
+        if e.Time.Before(start) || e.Time.After(end) || (i > 0 && e.Time.Before(entries[i-1].Time)) {
+            t.Errorf("entry %d time %v is not in recording order", i, e.Time)
+        }
+        if e.Dir == captureRx {
+            recorded = append(recorded, e)
+        }
+    }
+    if len(entries) != len(rx)+2 || len(recorded) != len(rx) {
+        t.Fatalf("recorded %d entries (%d rx), want %d rx plus open and tx", len(entries), len(recorded), len(rx))
+    }
+
+    // speed 0 = เล่นเร็วที่สุด ได้เฉพาะบรรทัด rx ตามลำดับ พร้อมเวลาที่บันทึกไว้
+    replay := &replayPort{entries: entries}
+    r := bufio.NewReader(replay)
+    for i, want := range rx {
+        line, err := r.ReadString('\n')
+        if err != nil {
+            t.Fatalf("line %d: %v", i, err)
+        }
+        if got := strings.TrimSuffix(line, "\n"); got != want {
+            t.Errorf("line %d = %q, want %q", i, got, want)
+        }
+        if at := replay.lineTime(); !at.Equal(recorded[i].Time) {
+            t.Errorf("line %d time = %v, want %v", i, at, recorded[i].Time)
+        }
+    }
+    if _, err := r.ReadString('\n'); !errors.Is(err, errReplayDone) {
+        t.Errorf("after the last line err = %v, want errReplayDone", err)
+    }
+}
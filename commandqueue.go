@@ -0,0 +1,274 @@
+//go:build !tinygo
+
+package main
+
+import (
+    "errors"
+    "fmt"
+    "sync"
+    "time"
+)
+
+const (
+    // ส่งซ้ำได้กี่ครั้งถ้าไม่ได้ ACK (timeout/หลุด) ERR จาก Pico จะไม่ส่งซ้ำ
+    commandMaxAttempts = 5
+    commandRetryDelay  = 500 * time.Millisecond
+    commandRetryMax    = 5 * time.Second
+
+    // เก็บคำสั่งที่จบแล้วไว้ให้ดูผ่าน API กี่รายการ
+    commandHistorySize = 50
+
+    // HTTP handler รอผลนานสุดเท่านี้ ถ้ายังไม่จบจะตอบ 202 แล้วส่งต่อในคิว
+    commandWaitTimeout = 10 * time.Second
+)
+
+// สถานะของคำสั่งในคิว
+const (
+    commandQueued   = "queued"
+    commandSending  = "sending"
+    commandAcked    = "acked"
+    commandRejected = "rejected" // Pico ตอบ ERR
+    commandFailed   = "failed"   // ส่งครบทุกครั้งแล้วไม่ได้ ACK
+    commandReplaced = "replaced" // มีคำสั่งใหม่ของ actuator เดียวกันมาแทนก่อนส่งสำเร็จ
+)
+
+type queuedCommand struct {
+    ID       uint64    `json:"id"`
+    Actuator string    `json:"actuator"`
+    Value    int       `json:"value"`
+    Command  string    `json:"command"`
+    Status   string    `json:"status"`
+    Attempts int       `json:"attempts"`
+    Ack      string    `json:"ack,omitempty"`
+    Error    string    `json:"error,omitempty"`
+    Created  time.Time `json:"created"`
+    Updated  time.Time `json:"updated"`
+
+    err  error
+    done chan struct{} // ถูกปิดเมื่อคำสั่งจบ (acked/rejected/failed/replaced)
+}
+
+func (c *queuedCommand) finished() bool {
+    switch c.Status {
+    case commandAcked, commandRejected, commandFailed, commandReplaced:
+        return true
+    }
+    return false
+}
+
+// commandQueue ส่งคำสั่งให้ Pico หนึ่งตัวทีละคำสั่งตามลำดับ
+//   - ไม่ได้ ACK => ส่งซ้ำ (backoff) สูงสุด commandMaxAttempts ครั้ง
+//   - คำสั่งใหม่ของ actuator เดียวกัน => คำสั่งเก่าที่ยังไม่สำเร็จถูกทิ้ง (replaced)
+//     เช่นเลื่อน slider light14 เร็วๆ จะส่งแค่ค่าล่าสุด
+type commandQueue struct {
+    link *serialLink
+
+    // ส่งคำสั่งหนึ่งครั้งแล้วรอ ACK (ปกติคือ link.sendCommand test เปลี่ยนเป็นของปลอมได้)
+    transmit   func(cmd string) (string, error)
+    retryDelay time.Duration
+
+    mu      sync.Mutex
+    nextID  uint64
+    queue   []*queuedCommand
+    current *queuedCommand
+    history []*queuedCommand
+    wake    chan struct{}
+    running bool
+    stopped bool
+}
+
+func newCommandQueue(link *serialLink) *commandQueue {
+    return &commandQueue{link: link, transmit: link.sendCommand, retryDelay: commandRetryDelay, wake: make(chan struct{}, 1)}
+}
+
+// enqueue ใส่คำสั่งตั้งค่า actuator เข้าคิว แล้วคืนทันที (รอผลได้ที่ wait)
+func (q *commandQueue) enqueue(actuator string, value int, cmd string) *queuedCommand {
+    now := time.Now()
+    q.mu.Lock()
+    q.nextID++
+    c := &queuedCommand{
+        ID: q.nextID, Actuator: actuator, Value: value, Command: cmd,
+        Status: commandQueued, Created: now, Updated: now, done: make(chan struct{}),
+    }
+    kept := q.queue[:0]
+    for _, old := range q.queue {
+        if old.Actuator == actuator {
+            q.finishLocked(old, commandReplaced, "", fmt.Errorf("replaced by command %d", c.ID))
+            continue
+        }
+        kept = append(kept, old)
+    }
+    q.queue = append(kept, c)
+    if !q.running && !q.stopped {
+        q.running = true
+        go q.worker()
+    }
+    q.mu.Unlock()
+
+    select {
+    case q.wake <- struct{}{}:
+    default:
+    }
+    return c
+}
+
+// wait รอจนคำสั่งจบหรือครบเวลา คืนสำเนาของคำสั่ง
+func (q *commandQueue) wait(c *queuedCommand, timeout time.Duration) queuedCommand {
+    select {
+    case <-c.done:
+    case <-time.After(timeout):
+    }
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    return *c
+}
+
+// pending = actuator นี้มีคำสั่งที่ยังรอส่ง/กำลังส่งอยู่
+func (q *commandQueue) pending(actuator string) bool {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    if q.current != nil && q.current.Actuator == actuator {
+        return true
+    }
+    for _, c := range q.queue {
+        if c.Actuator == actuator {
+            return true
+        }
+    }
+    return false
+}
+
+// snapshot คืนคำสั่งที่ยังไม่จบ (รวมตัวที่กำลังส่ง) และคำสั่งที่จบแล้วล่าสุด (ใหม่สุดก่อน)
+func (q *commandQueue) snapshot() (queued, recent []queuedCommand) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    queued = []queuedCommand{}
+    if q.current != nil {
+        queued = append(queued, *q.current)
+    }
+    for _, c := range q.queue {
+        queued = append(queued, *c)
+    }
+    recent = make([]queuedCommand, 0, len(q.history))
+    for i := len(q.history) - 1; i >= 0; i-- {
+        recent = append(recent, *q.history[i])
+    }
+    return queued, recent
+}
+
+func (q *commandQueue) stop() {
+    q.mu.Lock()
+    q.stopped = true
+    q.mu.Unlock()
+    select {
+    case q.wake <- struct{}{}:
+    default:
+    }
+}
+
+func (q *commandQueue) worker() {
+    for {
+        q.mu.Lock()
+        if q.stopped {
+            q.running = false
+            for _, c := range q.queue {
+                q.finishLocked(c, commandFailed, "", errors.New("server stopped"))
+            }
+            q.queue = nil
+            q.mu.Unlock()
+            return
+        }
+        if len(q.queue) == 0 {
+            q.mu.Unlock()
+            <-q.wake
+            continue
+        }
+        c := q.queue[0]
+        q.queue = q.queue[1:]
+        q.current = c
+        q.mu.Unlock()
+
+        q.send(c)
+
+        q.mu.Lock()
+        q.current = nil
+        q.mu.Unlock()
+    }
+}
+
+// send ส่งคำสั่งเดียวจนได้ผล ระหว่างรอส่งซ้ำถ้ามีคำสั่งใหม่ของ actuator เดียวกันเข้าคิว จะเลิกส่งตัวนี้
+func (q *commandQueue) send(c *queuedCommand) {
+    delay := q.retryDelay
+    for {
+        q.mu.Lock()
+        c.Status = commandSending
+        c.Attempts++
+        c.Updated = time.Now()
+        q.mu.Unlock()
+
+        ackLine, err := q.transmit(c.Command)
+
+        q.mu.Lock()
+        switch {
+        case err == nil:
+            q.finishLocked(c, commandAcked, ackLine, nil)
+        case errors.Is(err, errDeviceRejected):
+            q.finishLocked(c, commandRejected, ackLine, err)
+        case c.Attempts >= commandMaxAttempts || q.stopped:
+            q.finishLocked(c, commandFailed, "", err)
+        default:
+            c.Status = commandQueued
+            c.Error = err.Error()
+            c.err = err
+            c.Updated = time.Now()
+        }
+        done := c.finished()
+        q.mu.Unlock()
+        if done {
+            if c.Status == commandAcked {
+                q.link.registry.setState(c.Actuator, c.Value)
+            } else if c.Status == commandRejected {
+                // Pico ไม่รับค่านี้ (เช่นปั๊มยังพักไม่ครบ) => ไม่ต้องการแล้ว ไม่งั้น resync จะส่งซ้ำ
+                q.link.registry.dropDesired(c.Actuator, c.Value)
+            }
+            return
+        }
+
+        fmt.Printf("Command %q attempt %d failed: %v (retry in %v)\n", c.Command, c.Attempts, err, delay)
+        time.Sleep(delay)
+        delay *= 2
+        if delay > commandRetryMax {
+            delay = commandRetryMax
+        }
+
+        q.mu.Lock()
+        for _, newer := range q.queue {
+            if newer.Actuator == c.Actuator {
+                q.finishLocked(c, commandReplaced, "", fmt.Errorf("replaced by command %d", newer.ID))
+                break
+            }
+        }
+        done = c.finished()
+        q.mu.Unlock()
+        if done {
+            return
+        }
+    }
+}
+
+func (q *commandQueue) finishLocked(c *queuedCommand, status, ack string, err error) {
+    c.Status = status
+    c.Ack = ack
+    c.err = err
+    c.Error = ""
+    if err != nil {
+        c.Error = err.Error()
+    }
+    c.Updated = time.Now()
+    close(c.done)
+
+    q.history = append(q.history, c)
+    if len(q.history) > commandHistorySize {
+        q.history = q.history[len(q.history)-commandHistorySize:]
+    }
+}
@@ -0,0 +1,178 @@
+//go:build !tinygo
+
+package main
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "sync"
+    "testing"
+    "time"
+)
+
+// fakeDevice แทน link.sendCommand: จดคำสั่งที่ถูกส่ง แล้วตอบตาม reply
+// hold != nil => ทุกคำสั่งรอจนกว่าจะ release (แจ้งทาง sending ว่าเริ่มส่งแล้ว ต้องมีที่ว่างพอ)
+type fakeDevice struct {
+    reply   func(cmd string, n int) (string, error)
+    hold    chan struct{}
+    sending chan string
+
+    mu   sync.Mutex
+    sent []string
+}
+
+func (d *fakeDevice) sendCommand(cmd string) (string, error) {
+    d.mu.Lock()
+    d.sent = append(d.sent, cmd)
+    n := len(d.sent)
+    d.mu.Unlock()
+    if d.hold != nil {
+        d.sending <- cmd
+        <-d.hold
+    }
+    if d.reply == nil {
+        return "ACK: " + cmd, nil
+    }
+    return d.reply(cmd, n)
+}
+
+func (d *fakeDevice) release() {
+    close(d.hold)
+}
+
+func (d *fakeDevice) sentCommands() []string {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    return append([]string(nil), d.sent...)
+}
+
+func newTestQueue(t *testing.T, d *fakeDevice) *commandQueue {
+    t.Helper()
+    q := newCommandQueue(newSerialLink("queue-test"))
+    q.transmit = d.sendCommand
+    q.retryDelay = time.Millisecond
+    t.Cleanup(q.stop)
+    return q
+}
+
+func TestCommandQueueCoalescesPerActuator(t *testing.T) {
+    d := &fakeDevice{hold: make(chan struct{}), sending: make(chan string, 10)}
+    q := newTestQueue(t, d)
+
+    first := q.enqueue("light13", 10, "light13:10")
+    <-d.sending // light13:10 กำลังส่ง คำสั่งต่อไปต้องรอในคิว
+    middle := q.enqueue("light13", 20, "light13:20")
+    pump := q.enqueue("pump", 1, "pump:on")
+    last := q.enqueue("light13", 30, "light13:30")
+
+    if c := q.wait(middle, time.Second); c.Status != commandReplaced {
+        t.Errorf("light13:20 status %s, want replaced", c.Status)
+    }
+    if !q.pending("light13") || !q.pending("pump") {
+        t.Error("light13 and pump must be pending while the device is busy")
+    }
+    d.release()
+
+    for _, c := range []*queuedCommand{first, pump, last} {
+        if got := q.wait(c, time.Second); got.Status != commandAcked {
+            t.Errorf("%s status %s, want acked", got.Command, got.Status)
+        }
+    }
+    want := []string{"light13:10", "pump:on", "light13:30"}
+    if got := d.sentCommands(); fmt.Sprint(got) != fmt.Sprint(want) {
+        t.Errorf("sent %v, want %v", got, want)
+    }
+    if got := q.link.registry.stateOf("light13"); got != 30 {
+        t.Errorf("registry light13 = %d, want 30", got)
+    }
+}
+
+func TestCommandQueueRetries(t *testing.T) {
+    tests := []struct {
+        name     string
+        reply    func(cmd string, n int) (string, error)
+        status   string
+        attempts int
+        err      error
+    }{
+        {"ack after two timeouts", func(cmd string, n int) (string, error) {
+            if n < 3 {
+                return "", errCommandTimeout
+            }
+            return "ACK: " + cmd, nil
+        }, commandAcked, 3, nil},
+        {"gives up after max attempts", func(string, int) (string, error) {
+            return "", errCommandTimeout
+        }, commandFailed, commandMaxAttempts, errCommandTimeout},
+        {"offline is retried too", func(string, int) (string, error) {
+            return "", errDeviceOffline
+        }, commandFailed, commandMaxAttempts, errDeviceOffline},
+        {"err is not retried", func(string, int) (string, error) {
+            return "ERR: Bad value", fmt.Errorf("%w: Bad value", errDeviceRejected)
+        }, commandRejected, 1, errDeviceRejected},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            d := &fakeDevice{reply: tt.reply}
+            q := newTestQueue(t, d)
+            c := q.wait(q.enqueue("pump", 1, "pump:on"), 5*time.Second)
+            if c.Status != tt.status || c.Attempts != tt.attempts {
+                t.Errorf("status %s after %d attempts, want %s after %d", c.Status, c.Attempts, tt.status, tt.attempts)
+            }
+            if len(d.sentCommands()) != tt.attempts {
+                t.Errorf("sent %d times, want %d", len(d.sentCommands()), tt.attempts)
+            }
+            if !errors.Is(c.err, tt.err) {
+                t.Errorf("err = %v, want %v", c.err, tt.err)
+            }
+        })
+    }
+}
+
+func TestCommandQueueWaitTimesOut(t *testing.T) {
+    d := &fakeDevice{hold: make(chan struct{}), sending: make(chan string, 1)}
+    q := newTestQueue(t, d)
+
+    c := q.enqueue("light14", 50, "light14:50")
+    <-d.sending
+    start := time.Now()
+    got := q.wait(c, 50*time.Millisecond)
+    if got.Status != commandSending {
+        t.Errorf("status %s while the device has not answered, want sending", got.Status)
+    }
+    if waited := time.Since(start); waited < 50*time.Millisecond || waited > time.Second {
+        t.Errorf("wait returned after %v, want about 50ms", waited)
+    }
+
+    // หมดเวลารอแล้วคำสั่งยังส่งต่อในคิว
+    d.release()
+    if got := q.wait(c, time.Second); got.Status != commandAcked {
+        t.Errorf("status %s after the device answered, want acked", got.Status)
+    }
+}
+
+func TestWriteQueuedResult(t *testing.T) {
+    tests := []struct {
+        name   string
+        c      queuedCommand
+        status int
+    }{
+        {"acked", queuedCommand{Status: commandAcked, Ack: "ACK: pump ON"}, http.StatusOK},
+        {"still sending", queuedCommand{Status: commandSending}, http.StatusAccepted},
+        {"replaced", queuedCommand{Status: commandReplaced, err: errors.New("replaced by command 2")}, http.StatusAccepted},
+        {"rejected", queuedCommand{Status: commandRejected, err: fmt.Errorf("%w: Bad value", errDeviceRejected)}, http.StatusBadGateway},
+        {"failed offline", queuedCommand{Status: commandFailed, err: errDeviceOffline}, http.StatusServiceUnavailable},
+        {"failed no ack", queuedCommand{Status: commandFailed, err: errCommandTimeout}, http.StatusGatewayTimeout},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            w := httptest.NewRecorder()
+            writeQueuedResult(w, tt.c)
+            if w.Code != tt.status {
+                t.Errorf("HTTP %d, want %d (body %q)", w.Code, tt.status, w.Body.String())
+            }
+        })
+    }
+}
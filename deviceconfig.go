@@ -0,0 +1,76 @@
+//go:build !tinygo
+
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "sort"
+    "strings"
+)
+
+// ค่าที่ปรับได้ของ firmware (threshold, loop_ms, keepalive_s, pump_*, fallback_*)
+// Pico เป็นเจ้าของค่าและเก็บลง flash เอง server แค่ส่งคำสั่ง config:get / config:set ต่อให้
+
+// readDeviceConfig ขอค่าทั้งหมดจาก Pico (ACK ของ config:get เป็น JSON)
+func readDeviceConfig(link *serialLink) (map[string]interface{}, string, error) {
+    ack, err := link.sendCommand("config:get")
+    if err != nil {
+        return nil, ack, err
+    }
+    var cfg map[string]interface{}
+    if err := json.Unmarshal([]byte(strings.TrimPrefix(ack, "ACK: ")), &cfg); err != nil {
+        return nil, ack, fmt.Errorf("parse config: %w", err)
+    }
+    return cfg, ack, nil
+}
+
+// GET /devices/{id}/config (/config เดิม = device ตัวแรก)
+func fetchDeviceConfig(w http.ResponseWriter, r *http.Request) {
+    link := requestDevice(w, r)
+    if link == nil {
+        return
+    }
+    cfg, ack, err := readDeviceConfig(link)
+    if err != nil {
+        writeCommandResult(w, ack, err)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(cfg)
+}
+
+// PUT /devices/{id}/config {"temp_threshold":0.3,"fallback_light_on":"07:00",...}
+// ตั้งทีละค่าตามลำดับชื่อ ถ้าค่าไหนไม่ผ่านจะหยุดตรงนั้น (ค่าก่อนหน้าถูกตั้งไปแล้ว) ตอบด้วยค่าทั้งหมดหลังตั้ง
+func updateDeviceConfig(w http.ResponseWriter, r *http.Request) {
+    link := requestDevice(w, r)
+    if link == nil {
+        return
+    }
+    var req map[string]interface{}
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req) == 0 {
+        http.Error(w, "Invalid JSON", http.StatusBadRequest)
+        return
+    }
+
+    keys := make([]string, 0, len(req))
+    for k := range req {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    for _, k := range keys {
+        value := fmt.Sprint(req[k])
+        // คำสั่งคือหนึ่งบรรทัด "config:set:<key>=<value>"
+        if strings.ContainsAny(k+value, "=\r\n") {
+            http.Error(w, "Invalid value for "+k, http.StatusBadRequest)
+            return
+        }
+        ack, err := link.sendCommand("config:set:" + k + "=" + value)
+        if err != nil {
+            writeCommandResult(w, ack, fmt.Errorf("%s: %w", k, err))
+            return
+        }
+    }
+    fetchDeviceConfig(w, r)
+}
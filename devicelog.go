@@ -0,0 +1,78 @@
+//go:build !tinygo
+
+package main
+
+import (
+    "strings"
+    "sync"
+    "time"
+
+    "smart_farm/protocol"
+)
+
+// เก็บ log ล่าสุดของแต่ละ device ไว้กี่บรรทัด
+const deviceLogSize = 200
+
+// ระดับต่ำสุดที่เก็บ (ตั้งด้วย -device-log-level) ต่ำกว่านี้ทิ้งเลย
+var deviceLogLevel = protocol.LevelInfo
+
+type logEntry struct {
+    Time    time.Time `json:"t"`
+    Level   string    `json:"level"`
+    Message string    `json:"msg"`
+}
+
+// deviceLog คือ ring buffer ของ frame log จาก Pico หนึ่งตัว
+// (แทนการพิมพ์ [DEBUG] ... ปนกับ telemetry ลง console)
+type deviceLog struct {
+    mu      sync.Mutex
+    entries []logEntry
+    next    int // ตำแหน่งที่จะเขียนทับเมื่อเต็ม
+}
+
+func newDeviceLog() *deviceLog {
+    return &deviceLog{entries: make([]logEntry, 0, deviceLogSize)}
+}
+
+func (l *deviceLog) add(level, msg string) {
+    if protocol.LevelRank(level) < protocol.LevelRank(deviceLogLevel) {
+        return
+    }
+    e := logEntry{Time: time.Now(), Level: level, Message: msg}
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if len(l.entries) < deviceLogSize {
+        l.entries = append(l.entries, e)
+        return
+    }
+    l.entries[l.next] = e
+    l.next = (l.next + 1) % deviceLogSize
+}
+
+// addLegacyLine เก็บบรรทัดข้อความของ firmware รุ่นเก่า ("[DEBUG] ..." = debug นอกนั้น info)
+func (l *deviceLog) addLegacyLine(line string) {
+    if msg := strings.TrimPrefix(line, "[DEBUG] "); msg != line {
+        l.add(protocol.LevelDebug, msg)
+        return
+    }
+    l.add(protocol.LevelInfo, line)
+}
+
+// snapshot คืน log ที่ระดับ >= minLevel ไม่เกิน limit บรรทัดล่าสุด (เก่าสุดก่อน)
+func (l *deviceLog) snapshot(minLevel string, limit int) []logEntry {
+    min := protocol.LevelRank(minLevel)
+    l.mu.Lock()
+    ordered := append(append([]logEntry{}, l.entries[l.next:]...), l.entries[:l.next]...)
+    l.mu.Unlock()
+
+    out := []logEntry{}
+    for _, e := range ordered {
+        if protocol.LevelRank(e.Level) >= min {
+            out = append(out, e)
+        }
+    }
+    if limit > 0 && len(out) > limit {
+        out = out[len(out)-limit:]
+    }
+    return out
+}
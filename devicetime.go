@@ -0,0 +1,104 @@
+//go:build !tinygo
+
+package main
+
+import (
+    "fmt"
+    "sync"
+    "time"
+
+    "smart_farm/protocol"
+)
+
+// deviceClock ติดตาม seq/uptime_ms ในหัว frame ของ Pico ตัวหนึ่ง (อยู่ข้าม session เหมือน registry)
+//   - เวลาจริงของ frame = เวลาที่ Pico boot + uptime_ms
+//     เวลา boot ประมาณจาก (เวลารับ - uptime_ms) ที่น้อยที่สุด: บรรทัดที่ค้างใน buffer มาถึงช้าได้แต่มาก่อนไม่ได้
+//     ค่าที่มากกว่าจะดึงให้ช้าลงทีละน้อย (clockSlew) ตามนาฬิกาของ Pico ที่เดินช้ากว่าจริงเล็กน้อย
+//   - seq กระโดด => frame หาย, seq หรือ uptime ถอยหลัง => Pico reset (เริ่มประมาณเวลา boot ใหม่)
+//
+// firmware ก่อน protocol 4 ไม่มี seq => ใช้เวลาที่ server ได้รับ
+type deviceClock struct {
+    mu       sync.Mutex
+    bootAt   time.Time
+    seq      uint32 // seq ล่าสุด (0 = ยังไม่เคยได้ frame ที่มี seq)
+    uptimeMs uint64
+    dropped  int // frame ที่หายทั้งหมด
+    resets   int // Pico reset ที่เห็นระหว่าง server ทำงาน
+}
+
+// ค่าประมาณเวลา boot ขยับตาม frame ที่มาช้ากว่าที่คาดได้ทีละ 1/clockSlew ของส่วนต่าง
+// (frame ที่ค้าง 10 s ทำให้เลื่อนแค่ 10 ms ส่วน drift ของ crystal ตามทันภายในไม่กี่พัน frame)
+const clockSlew = 1000
+
+func newDeviceClock() *deviceClock {
+    return &deviceClock{}
+}
+
+// observe บันทึก stamp ของ frame ที่ได้รับตอน recv คืนเวลาจริงของ frame
+// จำนวน frame ที่หายไปก่อนหน้านี้ และ reset = Pico เพิ่ง reset
+func (c *deviceClock) observe(seq uint32, uptimeMs uint64, recv time.Time) (at time.Time, lost uint32, reset bool) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    seen := c.seq != 0
+    switch {
+    case seen && (seq < c.seq || uptimeMs < c.uptimeMs):
+        reset = true
+        c.resets++
+    case seen && seq > c.seq+1:
+        lost = seq - c.seq - 1
+        c.dropped += int(lost)
+    }
+
+    boot := recv.Add(-time.Duration(uptimeMs) * time.Millisecond)
+    switch {
+    case !seen || reset || boot.Before(c.bootAt):
+        c.bootAt = boot
+    default:
+        c.bootAt = c.bootAt.Add(boot.Sub(c.bootAt) / clockSlew)
+    }
+    c.seq, c.uptimeMs = seq, uptimeMs
+    return c.bootAt.Add(time.Duration(uptimeMs) * time.Millisecond), lost, reset
+}
+
+// stamped บอกว่าเคยได้ frame ที่มี seq แล้ว (ใช้ตรวจ reset แทน uptime ใน frame status ได้)
+func (c *deviceClock) stamped() bool {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.seq != 0
+}
+
+type clockStats struct {
+    BootedAt *time.Time
+    Dropped  int
+    Resets   int
+}
+
+func (c *deviceClock) stats() clockStats {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    st := clockStats{Dropped: c.dropped, Resets: c.resets}
+    if c.seq != 0 {
+        at := c.bootAt
+        st.BootedAt = &at
+    }
+    return st
+}
+
+// frameTime คือเวลาจริงของ frame (frame ไม่มี seq = recv) พร้อมแจ้ง frame หาย/reset ลง log ของ device
+func frameTime(link *serialLink, f protocol.Frame, recv time.Time) time.Time {
+    if f.Seq == 0 {
+        return recv
+    }
+    at, lost, reset := link.clock.observe(f.Seq, f.UptimeMs, recv)
+    switch {
+    case reset:
+        msg := fmt.Sprintf("reset detected (seq %d, uptime %d ms)", f.Seq, f.UptimeMs)
+        fmt.Printf("Device %s %s\n", link.id(), msg)
+        link.logs.add(protocol.LevelWarn, msg)
+    case lost > 0:
+        msg := fmt.Sprintf("lost %d frames before seq %d", lost, f.Seq)
+        fmt.Printf("Device %s %s\n", link.id(), msg)
+        link.logs.add(protocol.LevelWarn, msg)
+    }
+    return at
+}
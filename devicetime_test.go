@@ -0,0 +1,78 @@
+//go:build !tinygo
+
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func TestDeviceClockObserve(t *testing.T) {
+    base := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+    ms := func(n int64) time.Time { return base.Add(time.Duration(n) * time.Millisecond) }
+
+    type frame struct {
+        seq      uint32
+        uptimeMs uint64
+        recvMs   int64 // เวลาที่ server ได้รับ (ms หลัง base)
+
+        atMs  int64 // เวลาจริงของ frame ที่ต้องได้
+        lost  uint32
+        reset bool
+    }
+    tests := []struct {
+        name    string
+        frames  []frame
+        bootMs  int64
+        dropped int
+        resets  int
+    }{
+        {"earliest arrival sets boot time", []frame{
+            {seq: 1, uptimeMs: 1000, recvMs: 1500, atMs: 1500},
+            {seq: 2, uptimeMs: 2000, recvMs: 2300, atMs: 2300}, // มาเร็วกว่า => boot เร็วขึ้นทันที
+            {seq: 3, uptimeMs: 3000, recvMs: 3300, atMs: 3300},
+        }, 300, 0, 0},
+        {"late frame slews by 1/1000", []frame{
+            {seq: 1, uptimeMs: 1000, recvMs: 1000, atMs: 1000},
+            {seq: 2, uptimeMs: 2000, recvMs: 12000, atMs: 2010}, // ค้าง 10 s => เลื่อน 10 ms
+            {seq: 3, uptimeMs: 3000, recvMs: 3010, atMs: 3010},
+        }, 10, 0, 0},
+        {"seq gap counts lost frames", []frame{
+            {seq: 5, uptimeMs: 1000, recvMs: 1000, atMs: 1000},
+            {seq: 9, uptimeMs: 2000, recvMs: 2000, atMs: 2000, lost: 3},
+            {seq: 10, uptimeMs: 3000, recvMs: 3000, atMs: 3000},
+            {seq: 12, uptimeMs: 4000, recvMs: 4000, atMs: 4000, lost: 1},
+        }, 0, 4, 0},
+        {"seq going back is a reset", []frame{
+            {seq: 50, uptimeMs: 60000, recvMs: 60000, atMs: 60000},
+            {seq: 1, uptimeMs: 100, recvMs: 75000, atMs: 75000, reset: true}, // boot ใหม่ ไม่ slew
+            {seq: 2, uptimeMs: 1100, recvMs: 76000, atMs: 76000},
+        }, 74900, 0, 1},
+        {"uptime going back is a reset", []frame{
+            {seq: 3, uptimeMs: 5000, recvMs: 5000, atMs: 5000},
+            {seq: 4, uptimeMs: 200, recvMs: 9000, atMs: 9000, reset: true},
+        }, 8800, 0, 1},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            c := newDeviceClock()
+            if c.stamped() || c.stats().BootedAt != nil {
+                t.Fatal("new clock already has a boot time")
+            }
+            for i, f := range tt.frames {
+                at, lost, reset := c.observe(f.seq, f.uptimeMs, ms(f.recvMs))
+                if !at.Equal(ms(f.atMs)) || lost != f.lost || reset != f.reset {
+                    t.Errorf("frame %d (seq %d): at %v lost %d reset %v, want at %v lost %d reset %v",
+                        i, f.seq, at.Sub(base), lost, reset, time.Duration(f.atMs)*time.Millisecond, f.lost, f.reset)
+                }
+            }
+            st := c.stats()
+            if st.BootedAt == nil || !st.BootedAt.Equal(ms(tt.bootMs)) {
+                t.Errorf("booted at %v, want %v after base", st.BootedAt, time.Duration(tt.bootMs)*time.Millisecond)
+            }
+            if st.Dropped != tt.dropped || st.Resets != tt.resets {
+                t.Errorf("dropped %d resets %d, want %d and %d", st.Dropped, st.Resets, tt.dropped, tt.resets)
+            }
+        })
+    }
+}
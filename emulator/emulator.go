@@ -0,0 +1,328 @@
+// Package emulator คือ Pico จำลองที่รัน firmware ตัวจริง (package firmware) บนฮาร์ดแวร์จำลอง
+// ใช้รัน server + dashboard + GUI บนเครื่องที่ไม่มี Pico และใช้เป็น device ที่คาดเดาผลได้ในการทดสอบ
+//
+// ส่วนที่จำลองเอง:
+//   - สภาพแวดล้อม: อุณหภูมิ/ความชื้นอากาศแกว่งเล็กน้อย ดินชื้นขึ้นเมื่อเปิดปั๊ม แห้งลงเมื่อปิด
+//   - relay สองช่องแยกกัน: pump (รดน้ำ) และ fan (อากาศเย็นและแห้งลง)
+//   - DHT22 และ ADC ของ soil อ่านค่าจากสภาพแวดล้อมนี้ (หลายตัวได้ แต่ละแปลงแห้งเร็วไม่เท่ากัน)
+//     ADC มีสัญญาณรบกวนและ spike เป็นครั้งคราวเหมือนสายยาวในแปลงจริง
+//   - นาฬิกาเดินไปทีละ task ของ firmware (uptime ไม่ขึ้นกับนาฬิกาจริง) สภาพแวดล้อมเปลี่ยนทุก envTick
+//   - flash อยู่ใน RAM ของ Device: Reboot แล้วค่ายังอยู่ (ดู firmware/persist.go)
+package emulator
+
+import (
+    "bufio"
+    "io"
+    "math"
+    "math/rand"
+    "net"
+    "runtime/debug"
+    "sync"
+    "time"
+
+    "smart_farm/firmware"
+    "smart_farm/protocol"
+)
+
+const (
+    firmwareVersion = "1.2.0-emulator"
+
+    LoopPeriod = firmware.LoopPeriod
+
+    // สภาพแวดล้อมจำลองเปลี่ยนทีละขั้นทุกช่วงนี้ของนาฬิกาจำลอง
+    envTick = 500 * time.Millisecond
+)
+
+type Config struct {
+    // Seed เดียวกัน => ค่า sensor ชุดเดียวกันทุกครั้ง
+    Seed int64
+
+    // id ที่ส่งใน frame hello (ว่าง = "emulator")
+    DeviceID string
+
+    // ค่าเริ่มต้นของสภาพแวดล้อม (0 = ใช้ค่า default)
+    Temp float64
+    Hum  float64
+    Soil float64
+
+    // จำนวน DHT22 / soil probe บนบอร์ด (0 = 1 ตัว) id เริ่มที่ 1
+    AirSensors int
+    SoilProbes int
+}
+
+type Device struct {
+    fw    *firmware.Firmware
+    board firmware.Board
+    port  *firmware.FakePort
+    clock *firmware.FakeClock
+    env   *environment
+}
+
+// environment คือสภาพแวดล้อมจำลอง DHT22/ADC ของบอร์ดอ่านค่าจากที่นี่ (airSensor/soilProbe)
+type environment struct {
+    rng       *rand.Rand
+    pending   time.Duration // เวลาที่ผ่านไปแต่ยังไม่ครบ envTick
+    pump, fan *firmware.FakeRelay
+    temp, hum float64
+    soil      []float64 // ความชื้นของแต่ละแปลง
+
+    // ชนิดปัญหาของ DHT22 แต่ละตัว ("" = ปกติ) ตั้งด้วย SetAirFault จาก goroutine อื่นได้
+    mu       sync.Mutex
+    airFault []string
+}
+
+// airSensor คือ DHT22 ตัวที่ i (ตัวถัดไปวัดได้ต่างกันเล็กน้อย)
+type airSensor struct {
+    env *environment
+    i   int
+}
+
+// soilProbe คือ ADC ของแปลงที่ i
+type soilProbe struct {
+    env *environment
+    i   int
+}
+
+// New สร้าง device ที่เขียน output ลง out และพิมพ์ข้อความตอน boot เหมือน firmware
+func New(cfg Config, out io.Writer) *Device {
+    env := &environment{
+        rng:  rand.New(rand.NewSource(cfg.Seed)),
+        pump: &firmware.FakeRelay{},
+        fan:  &firmware.FakeRelay{},
+        temp: cfg.Temp,
+        hum:  cfg.Hum,
+    }
+    if env.temp == 0 {
+        env.temp = 26.0
+    }
+    if env.hum == 0 {
+        env.hum = 55.0
+    }
+    soil := cfg.Soil
+    if soil == 0 {
+        soil = 45.0
+    }
+    nAir, nSoil := max(cfg.AirSensors, 1), max(cfg.SoilProbes, 1)
+    env.airFault = make([]string, nAir)
+    air := make([]firmware.AirSensor, nAir)
+    for i := range air {
+        air[i] = firmware.AirSensor{ID: i + 1, Sensor: airSensor{env, i}}
+    }
+    probes := make([]firmware.SoilProbe, nSoil)
+    for i := range probes {
+        env.soil = append(env.soil, soil+float64(i)*5)
+        probes[i] = firmware.SoilProbe{ID: i + 1, ADC: soilProbe{env, i}}
+    }
+    deviceID := cfg.DeviceID
+    if deviceID == "" {
+        deviceID = "emulator"
+    }
+
+    d := &Device{
+        port:  &firmware.FakePort{Out: out},
+        clock: &firmware.FakeClock{},
+        env:   env,
+    }
+    d.board = firmware.Board{
+        Serial: d.port,
+        Relays: []firmware.RelayChannel{
+            {Name: "pump", Label: "Water Pump", Relay: env.pump, Water: true},
+            {Name: "fan", Label: "Fan", Relay: env.fan},
+        },
+        Light13:  &firmware.FakePWM{},
+        Light14:  &firmware.FakePWM{},
+        Light15:  &firmware.FakePWM{},
+        Air:      air,
+        Soil:     probes,
+        Clock:    d.clock,
+        Storage:  &firmware.FakeStorage{},
+        Version:  firmwareVersion,
+        Commit:   buildCommit(),
+        DeviceID: deviceID,
+    }
+    d.boot()
+    return d
+}
+
+func (d *Device) boot() {
+    d.fw = firmware.New(d.board)
+    d.fw.Logf(protocol.LevelInfo, "🚀 Pico multi-sensor: Air & Soil, separate JSON")
+    d.fw.Boot()
+}
+
+// Reboot จำลองไฟตก: firmware เริ่มใหม่ทั้งหมด แต่ flash (settings, ค่า actuator ที่เก็บไว้) ยังอยู่
+// เรียกจาก goroutine เดียวกับ Step เท่านั้น
+func (d *Device) Reboot() {
+    d.boot()
+}
+
+// Input เก็บบรรทัดคำสั่งที่ได้รับ (firmware จะทำทีละคำสั่งต่อรอบ)
+func (d *Device) Input(line string) {
+    if len(line) == 0 || line[len(line)-1] != '\n' {
+        line += "\n"
+    }
+    d.port.Feed(line)
+}
+
+// Step เดินนาฬิกาไปถึง task ถัดไปของ firmware แล้วทำ task ที่ถึงเวลา คืนเวลาที่เดินไป
+func (d *Device) Step() time.Duration {
+    dt := max(d.fw.NextDue().Sub(d.clock.Now()), 0)
+    d.clock.Advance(dt)
+    d.env.advance(dt)
+    d.fw.Step()
+    return dt
+}
+
+// Advance เรียก Step จนนาฬิกาจำลองเดินไปอย่างน้อย dt (เช่นรอให้คำสั่งที่ Input ไปถูกทำ)
+func (d *Device) Advance(dt time.Duration) {
+    for dt > 0 {
+        dt -= d.Step()
+    }
+}
+
+// PumpOn / RelayOn / LightDuty ให้การทดสอบตรวจสถานะ "ขา" ของ device ได้
+func (d *Device) PumpOn() bool { return d.fw.PumpOn() }
+
+func (d *Device) RelayOn(name string) bool { return d.fw.RelayOn(name) }
+
+func (d *Device) LightDuty(name string) uint32 { return d.fw.LightDuty(name) }
+
+// SetAirFault จำลอง DHT22 air_id อ่านไม่ได้ เช่น "no_signal" (สายหลุด) ส่ง "" = กลับมาปกติ
+func (d *Device) SetAirFault(id int, kind string) {
+    d.env.mu.Lock()
+    if id >= 1 && id <= len(d.env.airFault) {
+        d.env.airFault[id-1] = kind
+    }
+    d.env.mu.Unlock()
+}
+
+// Uptime นับจากจำนวนรอบ loop
+func (d *Device) Uptime() time.Duration {
+    return d.fw.Uptime()
+}
+
+func (e *environment) advance(dt time.Duration) {
+    e.pending += dt
+    for e.pending >= envTick {
+        e.pending -= envTick
+        e.simulate()
+    }
+}
+
+// สภาพแวดล้อมเปลี่ยนช้าๆ ทีละ envTick: ปั๊มเปิดดินชื้นขึ้น ปิดแล้วค่อยๆ แห้ง (แปลงหลังๆ แห้งเร็วกว่า)
+func (e *environment) simulate() {
+    e.temp += (e.rng.Float64() - 0.5) * 0.3
+    e.hum += (e.rng.Float64() - 0.5) * 0.8
+    if e.fan.On {
+        e.temp -= 0.1
+        e.hum -= 0.3
+    }
+    for i := range e.soil {
+        if e.pump.On {
+            e.soil[i] += 1.5
+        } else {
+            e.soil[i] -= (0.05 + e.rng.Float64()*0.05) * (1 + float64(i)*0.5)
+        }
+        e.soil[i] = clamp(e.soil[i], 0, 100)
+    }
+    e.temp = clamp(e.temp, 10, 45)
+    e.hum = clamp(e.hum, 10, 99)
+}
+
+// Measurements = DHT22 (หน่วย 0.1)
+func (s airSensor) Measurements() (int16, uint16, error) {
+    s.env.mu.Lock()
+    fault := s.env.airFault[s.i]
+    s.env.mu.Unlock()
+    if fault != "" {
+        return 0, 0, firmware.SensorError{Kind: fault}
+    }
+    temp := s.env.temp + float64(s.i)*0.4
+    hum := clamp(s.env.hum-float64(s.i)*1.5, 0, 100)
+    return int16(math.Round(temp * 10)), uint16(math.Round(hum * 10)), nil
+}
+
+// สัญญาณรบกวนของ ADC (หน่วย ADC) และโอกาสเกิด spike ต่อการอ่านหนึ่งครั้ง
+const (
+    adcNoise     = 150
+    adcSpikeRate = 0.02
+    adcSpike     = 8000
+)
+
+// Get = ADC ของ soil: ดินยิ่งชื้นค่ายิ่งต่ำ (firmware แปลงกลับเป็น %)
+func (p soilProbe) Get() uint16 {
+    v := (100-p.env.soil[p.i])/100*65535 + p.env.rng.NormFloat64()*adcNoise
+    if p.env.rng.Float64() < adcSpikeRate {
+        v += adcSpike
+    }
+    return uint16(math.Round(clamp(v, 0, 65535)))
+}
+
+// Run อ่านคำสั่งจาก conn และเรียก Step จนกว่า conn จะถูกปิด
+// period = 0 => พักตามเวลาจริงเท่ากับที่นาฬิกาจำลองเดิน, period > 0 => พักเท่านี้ทุก Step (เร่ง/หน่วงเวลา)
+func (d *Device) Run(conn io.Reader, period time.Duration) {
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        r := bufio.NewReader(conn)
+        for {
+            line, err := r.ReadString('\n')
+            if err != nil {
+                return
+            }
+            d.Input(line)
+        }
+    }()
+
+    for {
+        wait := d.Step()
+        if period > 0 {
+            wait = period
+        }
+        select {
+        case <-done:
+            return
+        case <-time.After(wait):
+        }
+    }
+}
+
+// Pipe เปิด device จำลองบนปลายหนึ่งของท่อในหน่วยความจำ แล้วคืนอีกปลายให้ server ใช้แทนพอร์ต Serial
+func Pipe(cfg Config) io.ReadWriteCloser {
+    host, dev := net.Pipe()
+    go func() {
+        // net.Pipe ไม่มี buffer: ข้อความ boot จะรอจนกว่า server เริ่มอ่าน
+        d := New(cfg, dev)
+        d.Run(dev, 0)
+        dev.Close()
+    }()
+    return host
+}
+
+// buildCommit คือ commit ที่ go build ฝังไว้ในโปรแกรม ("" ถ้า build ด้วย go run หรือไม่ได้อยู่ใน git)
+func buildCommit() string {
+    info, ok := debug.ReadBuildInfo()
+    if !ok {
+        return ""
+    }
+    commit, dirty := "", false
+    for _, s := range info.Settings {
+        switch s.Key {
+        case "vcs.revision":
+            commit = s.Value
+        case "vcs.modified":
+            dirty = s.Value == "true"
+        }
+    }
+    if len(commit) > 7 {
+        commit = commit[:7]
+    }
+    if commit != "" && dirty {
+        commit += "-dirty"
+    }
+    return commit
+}
+
+func clamp(v, lo, hi float64) float64 {
+    return math.Max(lo, math.Min(hi, v))
+}
@@ -0,0 +1,104 @@
+package firmware
+
+import (
+    "math"
+    "strconv"
+)
+
+// การกรองค่า ADC ของ soil: ทุกรอบอ่าน ADC หลายครั้ง (oversampling) แล้วกรองตาม ADCFilter.Mode
+//   - mean:   ค่าเฉลี่ยของรอบนี้
+//   - median: ค่ากลางของรอบนี้ (ตัด spike จากสัญญาณรบกวนได้ดีกว่า mean)
+//   - ema:    ค่าเฉลี่ยของรอบนี้ผ่าน exponential moving average ข้ามรอบ alpha = 2/(EMAWindow+1)
+//
+// variance ของค่าดิบในรอบนั้นส่งไปกับ telemetry (raw_var) ให้ server ดูคุณภาพสัญญาณ
+
+// อ่าน ADC ได้มากสุดเท่านี้ครั้งต่อรอบ (buffer ต่อ probe)
+const maxADCSamples = 32
+
+const (
+    filterMean uint8 = iota
+    filterMedian
+    filterEMA
+)
+
+var filterNames = []string{"mean", "median", "ema"}
+
+func filterName(mode uint8) string {
+    if int(mode) < len(filterNames) {
+        return filterNames[mode]
+    }
+    return "mean"
+}
+
+func parseFilterMode(s string) (uint8, bool) {
+    for i, name := range filterNames {
+        if name == s {
+            return uint8(i), true
+        }
+    }
+    return 0, false
+}
+
+// sampleSoil อ่าน probe ตาม filter ตอนนี้ คืนค่าหลังกรองและ variance ของค่าดิบ (หน่วย ADC²)
+func (f *Firmware) sampleSoil(s *soilState) (uint16, float64) {
+    fl := f.settings.filter
+    n := min(max(int(fl.Samples), 1), maxADCSamples)
+    buf := s.samples[:n]
+    sum := 0.0
+    for i := range buf {
+        buf[i] = s.ADC.Get()
+        sum += float64(buf[i])
+    }
+    mean := sum / float64(n)
+    variance := 0.0
+    for _, v := range buf {
+        d := float64(v) - mean
+        variance += d * d
+    }
+    variance /= float64(n)
+
+    value := mean
+    switch fl.Mode {
+    case filterMedian:
+        value = median(buf)
+    case filterEMA:
+        if !s.emaOK {
+            s.ema, s.emaOK = mean, true
+        } else {
+            s.ema += 2 / (float64(max(fl.EMAWindow, 1)) + 1) * (mean - s.ema)
+        }
+        value = s.ema
+    }
+    return uint16(math.Round(value)), variance
+}
+
+// median เรียง b ในที่ (insertion sort พอสำหรับไม่กี่สิบค่า) แล้วคืนค่ากลาง
+func median(b []uint16) float64 {
+    for i := 1; i < len(b); i++ {
+        for j := i; j > 0 && b[j] < b[j-1]; j-- {
+            b[j], b[j-1] = b[j-1], b[j]
+        }
+    }
+    mid := len(b) / 2
+    if len(b)%2 == 0 {
+        return (float64(b[mid-1]) + float64(b[mid])) / 2
+    }
+    return float64(b[mid])
+}
+
+// resetSoilFilter ล้าง EMA ของทุก probe (ตอนเปลี่ยน filter) และส่งค่าใหม่ในรอบถัดไป
+func (f *Firmware) resetSoilFilter() {
+    for _, s := range f.soil {
+        s.emaOK = false
+        s.sent = false
+    }
+}
+
+func (f *Firmware) filterString() string {
+    fl := f.settings.filter
+    str := filterName(fl.Mode) + " x" + strconv.Itoa(int(fl.Samples))
+    if fl.Mode == filterEMA {
+        str += " window=" + strconv.Itoa(int(fl.EMAWindow))
+    }
+    return str
+}
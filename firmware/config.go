@@ -0,0 +1,250 @@
+package firmware
+
+import (
+    "fmt"
+    "math"
+    "strconv"
+    "strings"
+    "time"
+
+    "smart_farm/protocol"
+)
+
+// ค่าที่ปรับได้ตอนรันด้วยคำสั่ง config (เก็บลง flash ทุกครั้งที่ตั้ง)
+//   - config:get        => JSON ของทุกค่า เช่น {"temp_threshold":0.20,"loop_ms":500,...}
+//   - config:get:<key>  => "<key>=<value>"
+//   - config:set:<key>=<value> => ตั้งค่าทีละตัว (Serial รับบรรทัดละไม่เกิน 64 ไบต์) ตอบ "<key>=<value>"
+//
+// soilcal, pumpguard, fallback, keepalive ยังใช้ได้เหมือนเดิม ค่าพวกนั้นบางส่วนอยู่ในนี้ด้วย
+
+// ช่วงของ loop_ms ที่ตั้งได้ (ค่าจาก flash ที่อยู่นอกช่วงนี้ใช้ LoopPeriod แทน)
+const (
+    minLoopMs = 50
+    maxLoopMs = 10000
+)
+
+type configKey struct {
+    name string
+    get  func(f *Firmware) string           // ค่าในรูป JSON
+    set  func(f *Firmware, v string) string // คืนข้อความ error ("" = สำเร็จ)
+}
+
+var configKeys = []configKey{
+    {"temp_threshold", getThreshold(func(s *settings) *float64 { return &s.tempThreshold }),
+        setThreshold(func(s *settings) *float64 { return &s.tempThreshold })},
+    {"hum_threshold", getThreshold(func(s *settings) *float64 { return &s.humThreshold }),
+        setThreshold(func(s *settings) *float64 { return &s.humThreshold })},
+    {"soil_threshold", getThreshold(func(s *settings) *float64 { return &s.soilThreshold }),
+        setThreshold(func(s *settings) *float64 { return &s.soilThreshold })},
+    {"loop_ms",
+        func(f *Firmware) string { return strconv.Itoa(int(f.settings.loop / time.Millisecond)) },
+        func(f *Firmware, v string) string {
+            n, ok := parseRange(v, minLoopMs, maxLoopMs)
+            if !ok {
+                return fmt.Sprintf("loop_ms must be %d..%d", minLoopMs, maxLoopMs)
+            }
+            f.settings.loop = time.Duration(n) * time.Millisecond
+            return ""
+        }},
+    {"keepalive_s",
+        func(f *Firmware) string { return strconv.Itoa(int(f.settings.keepalive / time.Second)) },
+        func(f *Firmware, v string) string {
+            n, ok := parseRange(v, 0, 65535)
+            if !ok {
+                return "keepalive_s must be 0..65535"
+            }
+            f.settings.keepalive = time.Duration(n) * time.Second
+            f.sendHello() // server ใช้ keepalive_s ใน hello ตัดสินว่า sensor เงียบผิดปกติ
+            return ""
+        }},
+    {"soil_filter",
+        func(f *Firmware) string { return `"` + filterName(f.settings.filter.Mode) + `"` },
+        func(f *Firmware, v string) string {
+            mode, ok := parseFilterMode(v)
+            if !ok {
+                return "soil_filter must be mean, median or ema"
+            }
+            f.settings.filter.Mode = mode
+            f.resetSoilFilter()
+            return ""
+        }},
+    {"soil_samples",
+        func(f *Firmware) string { return strconv.Itoa(int(f.settings.filter.Samples)) },
+        func(f *Firmware, v string) string {
+            n, ok := parseRange(v, 1, maxADCSamples)
+            if !ok {
+                return fmt.Sprintf("soil_samples must be 1..%d", maxADCSamples)
+            }
+            f.settings.filter.Samples = uint8(n)
+            f.resetSoilFilter()
+            return ""
+        }},
+    {"soil_ema_window",
+        func(f *Firmware) string { return strconv.Itoa(int(f.settings.filter.EMAWindow)) },
+        func(f *Firmware, v string) string {
+            n, ok := parseRange(v, 1, 100)
+            if !ok {
+                return "soil_ema_window must be 1..100"
+            }
+            f.settings.filter.EMAWindow = uint8(n)
+            f.resetSoilFilter()
+            return ""
+        }},
+    {"pump_max_on_s", getSeconds(func(s *settings) *time.Duration { return &s.pump.MaxOn }),
+        setSeconds(func(s *settings) *time.Duration { return &s.pump.MaxOn })},
+    {"pump_min_off_s", getSeconds(func(s *settings) *time.Duration { return &s.pump.MinOff }),
+        setSeconds(func(s *settings) *time.Duration { return &s.pump.MinOff })},
+    {"fallback_after_s", getSeconds(func(s *settings) *time.Duration { return &s.fallback.After }),
+        setSeconds(func(s *settings) *time.Duration { return &s.fallback.After })},
+    {"fallback_soil_low",
+        func(f *Firmware) string { return strconv.Itoa(int(f.settings.fallback.SoilLow)) },
+        func(f *Firmware, v string) string {
+            n, ok := parseRange(v, 0, 100)
+            if !ok || n >= int(f.settings.fallback.SoilHigh) {
+                return "fallback_soil_low must be 0..100 and below fallback_soil_high"
+            }
+            f.settings.fallback.SoilLow = uint8(n)
+            return ""
+        }},
+    {"fallback_soil_high",
+        func(f *Firmware) string { return strconv.Itoa(int(f.settings.fallback.SoilHigh)) },
+        func(f *Firmware, v string) string {
+            n, ok := parseRange(v, 0, 100)
+            if !ok || n <= int(f.settings.fallback.SoilLow) {
+                return "fallback_soil_high must be 0..100 and above fallback_soil_low"
+            }
+            f.settings.fallback.SoilHigh = uint8(n)
+            return ""
+        }},
+    {"fallback_light_on", getMinute(func(s *settings) *uint16 { return &s.fallback.LightOn }),
+        setMinute(func(s *settings) *uint16 { return &s.fallback.LightOn })},
+    {"fallback_light_off", getMinute(func(s *settings) *uint16 { return &s.fallback.LightOff }),
+        setMinute(func(s *settings) *uint16 { return &s.fallback.LightOff })},
+    {"fallback_light_duty",
+        func(f *Firmware) string { return strconv.Itoa(int(f.settings.fallback.LightDuty)) },
+        func(f *Firmware, v string) string {
+            n, ok := parseRange(v, 0, 100)
+            if !ok {
+                return "fallback_light_duty must be 0..100"
+            }
+            f.settings.fallback.LightDuty = uint8(n)
+            return ""
+        }},
+    {"restore_lights", getRestore(func(s *settings) *bool { return &s.restore.Lights }),
+        setRestore(func(s *settings) *bool { return &s.restore.Lights })},
+    {"restore_relays", getRestore(func(s *settings) *bool { return &s.restore.Relays }),
+        setRestore(func(s *settings) *bool { return &s.restore.Relays })},
+}
+
+func (f *Firmware) handleConfig(arg string) (string, bool) {
+    switch {
+    case arg == "get":
+        parts := make([]string, len(configKeys))
+        for i, k := range configKeys {
+            parts[i] = fmt.Sprintf(`"%s":%s`, k.name, k.get(f))
+        }
+        return "{" + strings.Join(parts, ",") + "}", true
+
+    case strings.HasPrefix(arg, "get:"):
+        k, ok := findConfigKey(strings.TrimPrefix(arg, "get:"))
+        if !ok {
+            return "Unknown key", false
+        }
+        return k.name + "=" + strings.Trim(k.get(f), `"`), true
+
+    case strings.HasPrefix(arg, "set:"):
+        kv := strings.SplitN(strings.TrimPrefix(arg, "set:"), "=", 2)
+        if len(kv) != 2 {
+            return "Bad value", false
+        }
+        k, ok := findConfigKey(kv[0])
+        if !ok {
+            return "Unknown key", false
+        }
+        old := strings.Trim(k.get(f), `"`)
+        if msg := k.set(f, strings.Trim(strings.TrimSpace(kv[1]), `"`)); msg != "" {
+            return msg, false
+        }
+        value := strings.Trim(k.get(f), `"`)
+        f.Logf(protocol.LevelInfo, "config %s=%s", k.name, value)
+        if !f.saveSettings() {
+            // เขียน flash ไม่ได้ => กลับไปใช้ค่าเดิม ไม่ให้ค่าที่ใช้อยู่ต่างจากที่เก็บไว้
+            k.set(f, old)
+            return "flash error", false
+        }
+        return k.name + "=" + value, true
+    }
+    return "Unknown", false
+}
+
+func findConfigKey(name string) (configKey, bool) {
+    name = strings.TrimSpace(name)
+    for _, k := range configKeys {
+        if k.name == name {
+            return k, true
+        }
+    }
+    return configKey{}, false
+}
+
+// parseRange แปลงจำนวนเต็มที่ต้องอยู่ใน lo..hi
+func parseRange(v string, lo, hi int) (int, bool) {
+    n, err := strconv.Atoi(v)
+    if err != nil || n < lo || n > hi {
+        return 0, false
+    }
+    return n, true
+}
+
+// threshold เก็บใน flash ละเอียด 0.01 (0 = ส่งทุกครั้งที่ค่าเปลี่ยน)
+func getThreshold(field func(*settings) *float64) func(*Firmware) string {
+    return func(f *Firmware) string {
+        return strconv.FormatFloat(*field(&f.settings), 'f', 2, 64)
+    }
+}
+
+func setThreshold(field func(*settings) *float64) func(*Firmware, string) string {
+    return func(f *Firmware, v string) string {
+        x, err := strconv.ParseFloat(v, 64)
+        if err != nil || x < 0 || x > 100 {
+            return "threshold must be 0..100"
+        }
+        *field(&f.settings) = math.Round(x*100) / 100
+        return ""
+    }
+}
+
+func getSeconds(field func(*settings) *time.Duration) func(*Firmware) string {
+    return func(f *Firmware) string {
+        return strconv.Itoa(int(*field(&f.settings) / time.Second))
+    }
+}
+
+func setSeconds(field func(*settings) *time.Duration) func(*Firmware, string) string {
+    return func(f *Firmware, v string) string {
+        n, ok := parseRange(v, 0, 65535)
+        if !ok {
+            return "seconds must be 0..65535"
+        }
+        *field(&f.settings) = time.Duration(n) * time.Second
+        return ""
+    }
+}
+
+// เวลาของวันแสดงเป็น "HH:MM"
+func getMinute(field func(*settings) *uint16) func(*Firmware) string {
+    return func(f *Firmware) string {
+        return `"` + formatMinute(int(*field(&f.settings))) + `"`
+    }
+}
+
+func setMinute(field func(*settings) *uint16) func(*Firmware, string) string {
+    return func(f *Firmware, v string) string {
+        m, ok := parseMinute(v)
+        if !ok {
+            return "time must be HH:MM"
+        }
+        *field(&f.settings) = m
+        return ""
+    }
+}
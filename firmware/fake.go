@@ -0,0 +1,174 @@
+package firmware
+
+import (
+    "bytes"
+    "errors"
+    "io"
+    "sync"
+    "time"
+)
+
+// ฮาร์ดแวร์ปลอมสำหรับรัน firmware ด้วย Go ปกติ (ทดสอบ threshold/คำสั่งโดยไม่ต้องมี Pico)
+
+// FakeRelay จำสถานะล่าสุดที่ถูกสั่ง
+type FakeRelay struct {
+    On bool
+}
+
+func (r *FakeRelay) Set(on bool) { r.On = on }
+
+// FakePWM จำ duty ล่าสุด (%)
+type FakePWM struct {
+    Percent uint32
+}
+
+func (p *FakePWM) SetPercent(pct uint32) { p.Percent = pct }
+
+// FakeHumiditySensor คืนค่าที่ตั้งไว้ (หน่วย 0.1 เหมือน DHT22)
+type FakeHumiditySensor struct {
+    Temp int16
+    Hum  uint16
+    Err  error
+}
+
+func (s *FakeHumiditySensor) Measurements() (int16, uint16, error) {
+    return s.Temp, s.Hum, s.Err
+}
+
+// FakeADC คืนค่าที่ตั้งไว้
+type FakeADC struct {
+    Value uint16
+}
+
+func (a *FakeADC) Get() uint16 { return a.Value }
+
+// FakePort: Feed = สิ่งที่ server ส่งมา, ทุกอย่างที่ firmware เขียนจะไปที่ Out
+// (ถ้า Out เป็น nil จะเก็บไว้ใน buffer อ่านได้ด้วย Output)
+type FakePort struct {
+    Out io.Writer
+
+    mu  sync.Mutex
+    in  []byte
+    out bytes.Buffer
+}
+
+// Feed ใส่ข้อมูลเข้าพอร์ต เหมือน server เขียนมา
+func (p *FakePort) Feed(s string) {
+    p.mu.Lock()
+    p.in = append(p.in, s...)
+    p.mu.Unlock()
+}
+
+func (p *FakePort) Buffered() int {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return len(p.in)
+}
+
+func (p *FakePort) ReadByte() (byte, error) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if len(p.in) == 0 {
+        return 0, errors.New("no data")
+    }
+    b := p.in[0]
+    p.in = p.in[1:]
+    return b, nil
+}
+
+func (p *FakePort) Write(b []byte) (int, error) {
+    if p.Out != nil {
+        return p.Out.Write(b)
+    }
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return p.out.Write(b)
+}
+
+// Output คืนและล้างสิ่งที่ firmware เขียนออกมา (เมื่อ Out เป็น nil)
+func (p *FakePort) Output() string {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    s := p.out.String()
+    p.out.Reset()
+    return s
+}
+
+// FakeClock เดินเฉพาะตอนถูก Sleep/Advance จึงคาดเดาผลได้
+type FakeClock struct {
+    mu sync.Mutex
+    t  time.Time
+}
+
+func (c *FakeClock) Now() time.Time {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.t
+}
+
+func (c *FakeClock) Sleep(d time.Duration) { c.Advance(d) }
+
+func (c *FakeClock) Advance(d time.Duration) {
+    c.mu.Lock()
+    c.t = c.t.Add(d)
+    c.mu.Unlock()
+}
+
+// FakeStorage คือ flash ในหน่วยความจำ (fakeBlocks block ค่าเริ่มต้น = ลบแล้ว 0xFF)
+type FakeStorage struct {
+    mu   sync.Mutex
+    data []byte
+}
+
+const (
+    fakeBlockSize = 4096
+    fakeBlocks    = 2
+)
+
+func (s *FakeStorage) init() {
+    if s.data == nil {
+        s.data = bytes.Repeat([]byte{0xFF}, fakeBlockSize*fakeBlocks)
+    }
+}
+
+func (s *FakeStorage) ReadAt(p []byte, off int64) (int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.init()
+    if off < 0 || off+int64(len(p)) > int64(len(s.data)) {
+        return 0, errors.New("out of range")
+    }
+    return copy(p, s.data[off:]), nil
+}
+
+func (s *FakeStorage) WriteAt(p []byte, off int64) (int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.init()
+    if off < 0 || off+int64(len(p)) > int64(len(s.data)) {
+        return 0, errors.New("out of range")
+    }
+    // flash เขียนได้แค่เปลี่ยนบิต 1 => 0
+    for i, b := range p {
+        s.data[off+int64(i)] &= b
+    }
+    return len(p), nil
+}
+
+func (s *FakeStorage) EraseBlocks(start, length int64) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.init()
+    if start < 0 || length < 1 || start+length > fakeBlocks {
+        return errors.New("out of range")
+    }
+    block := s.data[start*fakeBlockSize : (start+length)*fakeBlockSize]
+    for i := range block {
+        block[i] = 0xFF
+    }
+    return nil
+}
+
+func (s *FakeStorage) EraseBlockSize() int64 {
+    return fakeBlockSize
+}
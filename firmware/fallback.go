@@ -0,0 +1,220 @@
+package firmware
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+
+    "smart_farm/protocol"
+)
+
+// โหมด fallback: ถ้าไม่ได้คำสั่ง/ping จาก server นานเกิน FallbackPolicy.After
+// firmware จะดูแลปั๊มและไฟเอง (ดู FallbackPolicy ใน settings.go) และจดทุกอย่างที่ทำไว้
+// พอได้คำสั่งจาก server อีกครั้งจะออกจากโหมดนี้ แล้วส่ง event fallback_action ทีละรายการ
+// ตามด้วย fallback_end ให้ server รู้ว่าเกิดอะไรขึ้นระหว่างนั้น
+
+// จด action ได้สูงสุดเท่านี้ (RAM ของ Pico มีน้อย) เกินนี้นับเป็น dropped
+const fallbackLogSize = 32
+
+type fallbackAction struct {
+    uptimeMs int64
+    actuator string
+    value    uint32
+    reason   string
+}
+
+type fallbackState struct {
+    lastHost time.Time // ได้คำสั่งจาก server ครั้งล่าสุด
+    active   bool
+    since    time.Time
+    actions  []fallbackAction
+    dropped  int
+
+    // เวลาของวันจาก ping:<วินาทีนับจากเที่ยงคืน> (บอร์ดไม่มี RTC)
+    timeKnown bool
+    pingAt    time.Time
+    pingDay   time.Duration
+}
+
+// hostSeen ถูกเรียกทุกครั้งที่ได้คำสั่งจาก server
+func (f *Firmware) hostSeen() {
+    f.fb.lastHost = f.board.Clock.Now()
+    if f.fb.active {
+        f.endFallback()
+    }
+}
+
+// handlePing = heartbeat ของ server: "ping" หรือ "ping:<วินาทีนับจากเที่ยงคืนตามเวลาท้องถิ่น>"
+func (f *Firmware) handlePing(arg string) (string, bool) {
+    if arg != "" {
+        sec, err := strconv.Atoi(arg)
+        if err != nil || sec < 0 || sec >= 24*60*60 {
+            return "Bad value", false
+        }
+        f.fb.timeKnown = true
+        f.fb.pingAt = f.board.Clock.Now()
+        f.fb.pingDay = time.Duration(sec) * time.Second
+    }
+    return "pong", true
+}
+
+// minuteOfDay คือเวลาตอนนี้เป็นนาทีนับจากเที่ยงคืน (ok=false ถ้ายังไม่เคยได้เวลา)
+func (f *Firmware) minuteOfDay() (int, bool) {
+    if !f.fb.timeKnown {
+        return 0, false
+    }
+    t := f.fb.pingDay + f.board.Clock.Now().Sub(f.fb.pingAt)
+    return int(t/time.Minute) % (24 * 60), true
+}
+
+// checkFallback เข้าโหมด fallback เมื่อ server เงียบนานเกินไป และทำตาม policy ระหว่างอยู่ในโหมด
+// soilOK = false (ไม่มี probe) => ไม่แตะปั๊ม
+func (f *Firmware) checkFallback(soil float64, soilOK bool) {
+    p := f.settings.fallback
+    if !f.fb.active {
+        if p.After == 0 || f.board.Clock.Now().Sub(f.fb.lastHost) < p.After {
+            return
+        }
+        f.fb.active = true
+        f.fb.since = f.board.Clock.Now()
+        f.fb.actions = f.fb.actions[:0]
+        f.fb.dropped = 0
+        f.Logf(protocol.LevelWarn, "⚠ no host for %ds, fallback mode", int(p.After/time.Second))
+        f.sendEvent(`{"event":"fallback_start"}`)
+    }
+
+    // ช่องรดน้ำ: hysteresis ตามความชื้นดิน
+    for _, r := range f.relays {
+        switch {
+        case !soilOK || !r.Water:
+        case !r.on && soil < float64(p.SoilLow):
+            if _, ok := f.startRelay(r); ok {
+                f.recordFallback(r.Name, 1, fmt.Sprintf("soil %.1f%% < %d%%", soil, p.SoilLow))
+            }
+        case r.on && soil > float64(p.SoilHigh):
+            f.stopRelay(r)
+            f.recordFallback(r.Name, 0, fmt.Sprintf("soil %.1f%% > %d%%", soil, p.SoilHigh))
+        }
+    }
+
+    // ไฟ: ตามช่วงเวลาของวัน
+    minute, ok := f.minuteOfDay()
+    if !ok {
+        return
+    }
+    want := uint32(0)
+    if inWindow(minute, int(p.LightOn), int(p.LightOff)) {
+        want = uint32(p.LightDuty)
+    }
+    for _, l := range f.lights {
+        if l.target() != want {
+            // ค่อยๆ สว่าง/มืดแบบ sunrise/sunset
+            f.startRamp(l, want, fallbackLightRamp, true)
+            f.recordFallback(l.name, want, fmt.Sprintf("schedule %s", formatMinute(minute)))
+        }
+    }
+}
+
+// inWindow บอกว่า minute อยู่ในช่วง [on, off) หรือไม่ (off < on = ข้ามเที่ยงคืน)
+func inWindow(minute, on, off int) bool {
+    if on <= off {
+        return minute >= on && minute < off
+    }
+    return minute >= on || minute < off
+}
+
+func (f *Firmware) recordFallback(actuator string, value uint32, reason string) {
+    f.Logf(protocol.LevelInfo, "fallback: %s=%d (%s)", actuator, value, reason)
+    if len(f.fb.actions) >= fallbackLogSize {
+        f.fb.dropped++
+        return
+    }
+    f.fb.actions = append(f.fb.actions, fallbackAction{
+        uptimeMs: f.Uptime().Milliseconds(),
+        actuator: actuator,
+        value:    value,
+        reason:   reason,
+    })
+}
+
+// endFallback ออกจากโหมด fallback แล้วรายงานทุก action ที่ทำไป
+func (f *Firmware) endFallback() {
+    f.fb.active = false
+    for _, a := range f.fb.actions {
+        f.sendEvent(fmt.Sprintf(`{"event":"fallback_action","uptime_ms":%d,"actuator":%s,"value":%d,"reason":"%s"}`,
+            a.uptimeMs, jsonString(a.actuator), a.value, a.reason))
+    }
+    f.sendEvent(fmt.Sprintf(`{"event":"fallback_end","duration_ms":%d,"actions":%d,"dropped":%d}`,
+        f.board.Clock.Now().Sub(f.fb.since).Milliseconds(), len(f.fb.actions), f.fb.dropped))
+    f.Logf(protocol.LevelInfo, "host is back, fallback mode ended (%d actions)", len(f.fb.actions)+f.fb.dropped)
+    f.fb.actions = f.fb.actions[:0]
+    f.fb.dropped = 0
+}
+
+// configureFallback ทำคำสั่ง fallback
+//   - fallback => ดูค่าปัจจุบัน
+//   - fallback:<after_s>,<soil_low>,<soil_high>,<HH:MM on>,<HH:MM off>,<duty> => ตั้งค่าและเก็บลง flash
+//     after_s = 0 ปิดโหมดนี้
+func (f *Firmware) configureFallback(arg string) (string, bool) {
+    if arg == "" {
+        return f.fallbackString(), true
+    }
+    parts := strings.Split(arg, ",")
+    if len(parts) != 6 {
+        return "Bad value", false
+    }
+    for i := range parts {
+        parts[i] = strings.TrimSpace(parts[i])
+    }
+    after, e1 := strconv.ParseUint(parts[0], 10, 16)
+    low, e2 := strconv.ParseUint(parts[1], 10, 8)
+    high, e3 := strconv.ParseUint(parts[2], 10, 8)
+    on, ok1 := parseMinute(parts[3])
+    off, ok2 := parseMinute(parts[4])
+    duty, e4 := strconv.ParseUint(parts[5], 10, 8)
+    if e1 != nil || e2 != nil || e3 != nil || e4 != nil || !ok1 || !ok2 {
+        return "Bad value", false
+    }
+    if low >= high || high > 100 || duty > 100 {
+        return "need soil_low < soil_high <= 100, duty <= 100", false
+    }
+    f.settings.fallback = FallbackPolicy{
+        After:     time.Duration(after) * time.Second,
+        SoilLow:   uint8(low),
+        SoilHigh:  uint8(high),
+        LightOn:   on,
+        LightOff:  off,
+        LightDuty: uint8(duty),
+    }
+    f.Logf(protocol.LevelInfo, "%s", f.fallbackString())
+    if !f.saveSettings() {
+        return "flash error", false
+    }
+    return f.fallbackString(), true
+}
+
+func (f *Firmware) fallbackString() string {
+    p := f.settings.fallback
+    return fmt.Sprintf("fallback after=%ds soil=%d..%d%% light=%s-%s@%d%%",
+        int(p.After/time.Second), p.SoilLow, p.SoilHigh,
+        formatMinute(int(p.LightOn)), formatMinute(int(p.LightOff)), p.LightDuty)
+}
+
+// parseMinute แปลง "HH:MM" เป็นนาทีของวัน
+func parseMinute(s string) (uint16, bool) {
+    hm := strings.Split(s, ":")
+    if len(hm) != 2 {
+        return 0, false
+    }
+    h, e1 := strconv.Atoi(hm[0])
+    m, e2 := strconv.Atoi(hm[1])
+    if e1 != nil || e2 != nil || h < 0 || h > 23 || m < 0 || m > 59 {
+        return 0, false
+    }
+    return uint16(h*60 + m), true
+}
+
+func formatMinute(m int) string {
+    return fmt.Sprintf("%02d:%02d", m/60, m%60)
+}
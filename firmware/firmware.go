@@ -0,0 +1,498 @@
+// Package firmware คือ logic ของ Pico: อ่าน sensor, ส่ง telemetry เมื่อค่าเปลี่ยนเกิน threshold,
+// และรับคำสั่งจาก server โดยคุยกับฮาร์ดแวร์ผ่าน interface ใน hal.go เท่านั้น
+//
+// main.go (TinyGo) ต่อ interface เข้ากับ package machine ส่วน package emulator ต่อเข้ากับ
+// environment จำลอง ทั้งสองจึงใช้ loop เดียวกันนี้
+package firmware
+
+import (
+    "fmt"
+    "math"
+    "strconv"
+    "strings"
+    "time"
+
+    "smart_farm/protocol"
+)
+
+// Threshold เริ่มต้นสำหรับส่งข้อมูลเมื่อเปลี่ยนเกินค่านี้ (เปลี่ยนได้ด้วย config:set ดู config.go)
+const (
+    defaultTempThreshold = 0.2
+    defaultHumThreshold  = 0.5
+    defaultSoilThreshold = 1.0
+)
+
+// LoopPeriod คือรอบอ่าน soil และตรวจ fallback เริ่มต้น (config loop_ms) ดู scheduler.go
+const LoopPeriod = 500 * time.Millisecond
+
+// sensor ที่อ่านไม่ได้ต่อเนื่อง จะส่ง frame health ซ้ำทุกกี่รอบการอ่านของ sensor นั้น (รอบแรกที่พังส่งทันที)
+const healthRepeat = 10
+
+// จำนวนครั้งที่อ่าน ADC มาเฉลี่ยตอนจับจุด dry/wet
+const calSamples = 8
+
+// โครงสร้างสำหรับส่ง JSON 2 แบบ
+// - toJSONAir =>  {\"type\":\"air\",\"air_id\":...,\"temp\":...,\"air_humidity\":...,\"pump_status\":bool}
+// - toJSONSoil => {\"type\":\"soil\",\"soil_id\":...,\"soil_raw\":...,\"soil_humidity\":...,\"pump_status\":bool,
+//                  \"filter\":\"median\",\"samples\":9,\"ema_window\":4,\"raw_var\":...}
+//   soil_raw = ค่า ADC หลังกรอง, soil_humidity = % หลังผ่าน calibration (ดู settings.go)
+//   filter/samples/ema_window = การกรองที่ใช้, raw_var = variance ของค่าดิบในรอบนั้น (ดู adcfilter.go)
+// JSON ทั้งสองแบบจะถูกห่อใน frame ชนิด data (ดู package protocol)
+
+// อุปกรณ์บนบอร์ดนี้ ส่งให้ server ใน frame hello เพื่อสร้าง registry/route/ปุ่มบน GUI
+// - sensors:   kind + id ตรงกับ air_id/soil_id ใน telemetry, ranges = ช่วงค่าที่วัดได้
+//              ตาม Board.Air/Board.Soil, soil มี cal = ค่า calibration ปัจจุบัน (ดู toJSONSensors)
+// - actuators: name ใช้เป็นคำสั่ง "<name>:<value>", min/max = ช่วงค่าที่รับได้
+//              relay ทุกช่องตาม Board.Relays ตามด้วยไฟ (ดู toJSONActuators)
+//              ramp = รับ "<name>:<value>,<ms>[,linear|gamma]" ได้ด้วย (ดู ramp.go)
+// - keepalive_s: ส่งค่าซ้ำอย่างน้อยทุกกี่วินาทีแม้ค่าไม่เปลี่ยน (server ใช้ตัดสินว่า sensor เงียบผิดปกติ)
+// - fw/commit/built: รุ่นของ firmware ที่ฝังตอน build, proto = protocol.Version (server ใช้ตรวจว่าคุยกันได้)
+
+// Board คือฮาร์ดแวร์ของบอร์ดหนึ่งตัว
+type Board struct {
+    Serial Port
+
+    // relay แต่ละช่อง (name ห้ามซ้ำ) ดู relays.go
+    Relays []RelayChannel
+
+    // ไฟ: Outer1=GPIO13, Outer2=GPIO14, Inner=GPIO15
+    Light13 PWMChannel
+    Light14 PWMChannel
+    Light15 PWMChannel
+
+    // sensor ทั้งหมดบนบอร์ด (id ห้ามซ้ำในชนิดเดียวกัน) ดู sensors.go
+    Air  []AirSensor // DHT22
+    Soil []SoilProbe // ADC ไม่เกิน MaxSoilProbes ตัว
+
+    Clock Clock
+
+    // flash สำหรับ calibration (nil = เก็บใน RAM อย่างเดียว หายเมื่อ reboot)
+    Storage Storage
+
+    // ส่งใน frame hello และตอบคำสั่ง version (Commit/Built ว่าง = ไม่รู้)
+    Version  string
+    Commit   string
+    Built    string
+    DeviceID string
+}
+
+// Firmware เก็บสถานะทั้งหมดที่เคยเป็นตัวแปร global ใน main.go
+type Firmware struct {
+    board Board
+
+    relays []*relayState
+
+    // ไฟทั้งสามช่อง light13, light14, light15 (ดู ramp.go)
+    lights []*lightChannel
+
+    // task ของ main loop (scheduler.go) และบรรทัดคำสั่งที่ยังรับไม่ครบ
+    // rxDrop = กำลังทิ้งบรรทัดที่ยาวเกิน rx จนถึง '\n'
+    tasks  []*task
+    rx     [64]byte
+    rxLen  int
+    rxDrop bool
+
+    // ค่า actuator ที่สั่งแล้วแต่ยังไม่ได้เขียนลง flash และเวลาที่เปลี่ยนล่าสุด (ดู persist.go)
+    actuatorsDirty   bool
+    actuatorsChanged time.Time
+
+    // เลข id ของ frame ที่ Pico ส่งเอง (telemetry)
+    txID uint16
+
+    // ลำดับของทุก frame ที่ส่ง (รวม ack/err/log) ใส่ในหัว frame คู่กับ uptime_ms
+    seq uint32
+
+    // ใช้คำนวณ uptime_ms ในหัว frame และใน frame status
+    bootTime time.Time
+
+    // สถานะ threshold/keepalive/health ของ sensor แต่ละตัว
+    air  []*airState
+    soil []*soilState
+
+    // ค่าที่โหลดจาก flash ตอน Boot
+    settings settings
+
+    // โหมดทำงานเองเมื่อ server เงียบ (fallback.go)
+    fb fallbackState
+
+    // สิ่งที่ Boot คืนค่าจาก flash ("<name>":<value>) และที่เริ่มจากปิด/0% ("<name>") สำหรับ frame boot
+    bootRestored []string
+    bootReset    []string
+}
+
+func New(b Board) *Firmware {
+    now := b.Clock.Now()
+    f := &Firmware{board: b, bootTime: now, settings: defaultSettings(), fb: fallbackState{lastHost: now}}
+    f.lights = []*lightChannel{
+        {name: "light13", label: "Brightness Outer 1", ch: b.Light13},
+        {name: "light14", label: "Brightness Outer 2", ch: b.Light14},
+        {name: "light15", label: "Brightness Inner", ch: b.Light15},
+    }
+    f.relays = newRelayStates(b.Relays)
+    f.air = newAirStates(b.Air)
+    f.soil = f.newSoilStates(b.Soil)
+    f.tasks = newTasks(now)
+    return f
+}
+
+// Boot ตั้งค่าเริ่มต้นของ output (relay ปิด ไฟ 0%) คืนค่าที่ server สั่งไว้จาก flash (persist.go)
+// แล้วส่ง hello และ boot
+func (f *Firmware) Boot() {
+    f.Logf(protocol.LevelInfo, "firmware %s commit %s built %s protocol %d",
+        f.board.Version, orUnknown(f.board.Commit), orUnknown(f.board.Built), protocol.Version)
+    for _, r := range f.relays {
+        r.Relay.Set(false)
+        r.on = false
+    }
+    for _, l := range f.lights {
+        l.ramp = nil
+        l.set(0)
+    }
+    f.Logf(protocol.LevelInfo, "✅ PWM on GPIO13,14,15 = 0%% initially")
+
+    if f.board.Storage != nil {
+        st, err := loadSettings(f.board.Storage)
+        if err == errBadSettings {
+            f.Logf(protocol.LevelInfo, "no settings in flash, using defaults")
+        } else if err != nil {
+            f.Logf(protocol.LevelWarn, "read settings error: %v, using defaults", err)
+        }
+        f.settings = st
+    }
+    if len(f.board.Soil) > MaxSoilProbes {
+        f.Logf(protocol.LevelWarn, "only %d soil probes supported, ignoring %d", MaxSoilProbes, len(f.board.Soil)-MaxSoilProbes)
+    }
+    for _, s := range f.soil {
+        f.Logf(protocol.LevelInfo, "soil %d calibration dry=%d wet=%d", s.ID, s.cal.Dry, s.cal.Wet)
+    }
+    f.Logf(protocol.LevelInfo, "%s", f.pumpGuardString())
+    f.Logf(protocol.LevelInfo, "%s", f.fallbackString())
+    f.Logf(protocol.LevelInfo, "keepalive=%ds", int(f.settings.keepalive/time.Second))
+    f.Logf(protocol.LevelInfo, "soil filter %s", f.filterString())
+    f.restoreActuators()
+
+    // บอก server ว่าบอร์ดนี้มีอะไรบ้างและคืนค่าอะไรไป (server จะขอซ้ำด้วยคำสั่ง hello/boot ตอนเปิดพอร์ต)
+    f.sendHello()
+    f.sendBoot()
+}
+
+// keepaliveDue บอกว่าไม่ได้ส่งค่ามานานเกิน keepalive แล้ว (stable ไม่ใช่ sensor ตาย)
+func (f *Firmware) keepaliveDue(sentAt time.Time) bool {
+    return f.settings.keepalive > 0 && f.board.Clock.Now().Sub(sentAt) >= f.settings.keepalive
+}
+
+func (f *Firmware) receive(line string) {
+    f.Logf(protocol.LevelDebug, "Received cmd = %q", line)
+
+    if protocol.IsFrame(line) {
+        // frame แบบใหม่ => ตอบด้วย id เดียวกับคำสั่ง
+        fr, err := protocol.Decode(line)
+        switch {
+        case err == protocol.ErrChecksum:
+            f.sendFrame(fr.ID, protocol.TypeErr, "checksum")
+        case err != nil:
+            f.sendFrame(0, protocol.TypeErr, "malformed")
+        case fr.Type != protocol.TypeCommand:
+            f.sendFrame(fr.ID, protocol.TypeErr, "not a command")
+        default:
+            f.hostSeen()
+            reply, ok := f.HandleCommand(strings.TrimSpace(fr.Payload))
+            if ok {
+                f.sendFrame(fr.ID, protocol.TypeAck, reply)
+            } else {
+                f.sendFrame(fr.ID, protocol.TypeErr, reply)
+            }
+        }
+    } else if line != "" {
+        // คำสั่งแบบเดิม (เช่นพิมพ์จาก serial monitor) => ตอบ "ACK: ..." แบบเดิม
+        f.hostSeen()
+        reply, ok := f.HandleCommand(line)
+        if ok {
+            f.board.Serial.Write([]byte("ACK: " + reply + "\n"))
+        } else {
+            f.board.Serial.Write([]byte("ERR: " + reply + "\n"))
+        }
+    }
+}
+
+// =============== คำสั่งจาก Server ===============
+// HandleCommand คืนข้อความตอบกลับ และ ok=false ถ้าคำสั่งใช้ไม่ได้
+func (f *Firmware) HandleCommand(cmd string) (string, bool) {
+    switch {
+    case cmd == "hello":
+        f.sendHello()
+        return "hello", true
+
+    case cmd == "boot":
+        f.sendBoot()
+        return "boot", true
+
+    case cmd == "version":
+        // {"fw":"1.2.0","commit":"abc1234","built":"2024-05-01T10:00Z","proto":4}
+        return "{" + f.versionFields() + "}", true
+
+    case cmd == "status":
+        // สถานะจริงของขา relay/PWM ให้ server เทียบกับค่าที่ต้องการ
+        f.txID++
+        f.sendFrame(f.txID, protocol.TypeStatus, f.toJSONStatus())
+        return "status", true
+
+    case cmd == "ping", strings.HasPrefix(cmd, "ping:"):
+        return f.handlePing(strings.TrimPrefix(strings.TrimPrefix(cmd, "ping"), ":"))
+
+    case cmd == "on":
+        return f.setWater(true)
+
+    case cmd == "off":
+        return f.setWater(false)
+
+    case cmd == "pumpguard", strings.HasPrefix(cmd, "pumpguard:"):
+        return f.configurePumpGuard(strings.TrimPrefix(strings.TrimPrefix(cmd, "pumpguard"), ":"))
+
+    case cmd == "config", strings.HasPrefix(cmd, "config:"):
+        return f.handleConfig(strings.TrimPrefix(strings.TrimPrefix(cmd, "config"), ":"))
+
+    case cmd == "keepalive", strings.HasPrefix(cmd, "keepalive:"):
+        return f.configureKeepalive(strings.TrimPrefix(strings.TrimPrefix(cmd, "keepalive"), ":"))
+
+    case cmd == "fallback", strings.HasPrefix(cmd, "fallback:"):
+        return f.configureFallback(strings.TrimPrefix(strings.TrimPrefix(cmd, "fallback"), ":"))
+
+    case strings.HasPrefix(cmd, "soilcal"):
+        return f.calibrateSoil(strings.TrimPrefix(cmd, "soilcal"))
+
+    }
+    if name, arg, ok := strings.Cut(cmd, ":"); ok {
+        if l := f.light(name); l != nil {
+            reply, ok := f.setLight(l, arg)
+            if ok {
+                f.rememberLight(l)
+            }
+            return reply, ok
+        }
+        if r := f.relay(name); r != nil {
+            reply, ok := f.setRelay(r, arg)
+            if ok {
+                f.rememberRelay(r)
+            }
+            return reply, ok
+        }
+    }
+    return "Unknown", false
+}
+
+// configureKeepalive ทำคำสั่ง keepalive (หน่วยวินาที 0 = ส่งเฉพาะตอนค่าเปลี่ยน)
+//   - keepalive     => ดูค่าปัจจุบัน
+//   - keepalive:<s> => ตั้งค่าและเก็บลง flash แล้วส่ง hello ใหม่ (server ใช้คำนวณว่า sensor เงียบผิดปกติ)
+func (f *Firmware) configureKeepalive(arg string) (string, bool) {
+    if arg != "" {
+        sec, err := strconv.ParseUint(strings.TrimSpace(arg), 10, 16)
+        if err != nil {
+            return "Bad value", false
+        }
+        f.settings.keepalive = time.Duration(sec) * time.Second
+        f.Logf(protocol.LevelInfo, "keepalive=%ds", sec)
+        if !f.saveSettings() {
+            return "flash error", false
+        }
+        f.sendHello()
+    }
+    return fmt.Sprintf("keepalive=%ds", int(f.settings.keepalive/time.Second)), true
+}
+
+// saveSettings เก็บ f.settings ลง flash (ไม่มี Storage = สำเร็จเสมอ)
+func (f *Firmware) saveSettings() bool {
+    if f.board.Storage == nil {
+        return true
+    }
+    if err := saveSettings(f.board.Storage, &f.settings); err != nil {
+        f.Logf(protocol.LevelError, "❌ save settings error: %v", err)
+        return false
+    }
+    // บันทึกทั้งก้อนรวมค่า actuator ล่าสุดไปแล้ว
+    f.actuatorsDirty = false
+    return true
+}
+
+// lightChannel คือไฟหนึ่งช่อง duty = ค่าที่สั่งขาไว้ตอนนี้ (ระหว่าง ramp จะค่อยๆ เปลี่ยน)
+type lightChannel struct {
+    name  string
+    label string
+    ch    PWMChannel
+    duty  uint32
+    ramp  *lightRamp // nil = ไม่ได้ ramp
+}
+
+func (l *lightChannel) set(pct uint32) {
+    l.duty = pct
+    l.ch.SetPercent(pct)
+}
+
+// target คือค่าที่ช่องนี้กำลังจะไป (ไม่ ramp = duty ตอนนี้)
+func (l *lightChannel) target() uint32 {
+    if l.ramp != nil {
+        return l.ramp.to
+    }
+    return l.duty
+}
+
+func (f *Firmware) light(name string) *lightChannel {
+    for _, l := range f.lights {
+        if l.name == name {
+            return l
+        }
+    }
+    return nil
+}
+
+// PumpOn / RelayOn / LightDuty คือค่าที่ firmware สั่งขาไว้ล่าสุด (PumpOn = มีช่องรดน้ำเปิดอยู่)
+func (f *Firmware) PumpOn() bool { return f.watering() }
+
+func (f *Firmware) RelayOn(name string) bool {
+    r := f.relay(name)
+    return r != nil && r.on
+}
+
+func (f *Firmware) LightDuty(name string) uint32 {
+    if l := f.light(name); l != nil {
+        return l.duty
+    }
+    return 0
+}
+
+// Uptime นับจาก New ตามนาฬิกาของบอร์ด
+func (f *Firmware) Uptime() time.Duration {
+    return f.board.Clock.Now().Sub(f.bootTime)
+}
+
+// =============== ส่ง frame ===============
+func (f *Firmware) sendFrame(id uint16, typ, payload string) {
+    f.seq++
+    fr := protocol.Frame{ID: id, Type: typ, Payload: payload, Seq: f.seq, UptimeMs: uint64(f.Uptime().Milliseconds())}
+    f.board.Serial.Write([]byte(fr.Encode() + "\n"))
+}
+
+// telemetry ใช้ id ของ Pico เอง นับขึ้นเรื่อยๆ
+func (f *Firmware) sendData(json string) {
+    f.txID++
+    f.sendFrame(f.txID, protocol.TypeData, json)
+}
+
+// sendHealth บอก server ว่า sensor อ่านไม่ได้ (errKind != "") หรือกลับมาอ่านได้แล้ว
+func (f *Firmware) sendHealth(kind string, id int, errKind string, failures int) {
+    f.txID++
+    f.sendFrame(f.txID, protocol.TypeHealth, toJSONHealth(kind, id, errKind, failures))
+}
+
+// sendEvent แจ้งสิ่งที่ firmware ทำเอง (pump_timeout, fallback_*)
+func (f *Firmware) sendEvent(json string) {
+    f.txID++
+    f.sendFrame(f.txID, protocol.TypeEvent, json)
+}
+
+func (f *Firmware) sendHello() {
+    f.txID++
+    f.sendFrame(f.txID, protocol.TypeHello, f.toJSONHello())
+}
+
+// Logf ส่งข้อความ debug/สถานะเป็น frame log แยกจาก telemetry (server กรองตาม level)
+func (f *Firmware) Logf(level, format string, a ...interface{}) {
+    f.txID++
+    f.sendFrame(f.txID, protocol.TypeLog, protocol.LogPayload(level, fmt.Sprintf(format, a...)))
+}
+
+// =============== ฟังก์ชัน JSON แยก ===============
+func (f *Firmware) toJSONStatus() string {
+    parts := make([]string, 0, len(f.relays)+len(f.lights))
+    for _, r := range f.relays {
+        on := 0
+        if r.on {
+            on = 1
+        }
+        parts = append(parts, fmt.Sprintf(`%s:%d`, jsonString(r.Name), on))
+    }
+    // ไฟที่กำลัง ramp รายงานค่าปลายทาง ไม่งั้น server จะเห็นว่าค่าไม่ตรงแล้วส่งค่าทับจนหยุด ramp
+    for _, l := range f.lights {
+        parts = append(parts, fmt.Sprintf(`%s:%d`, jsonString(l.name), l.target()))
+    }
+    return fmt.Sprintf(`{"actuators":{%s},"uptime_ms":%d}`, strings.Join(parts, ","), f.Uptime().Milliseconds())
+}
+
+func (f *Firmware) toJSONHello() string {
+    return fmt.Sprintf(`{%s,"device":%s,"keepalive_s":%d,"sensors":%s,"actuators":%s}`,
+        f.versionFields(), jsonString(f.board.DeviceID), int(f.settings.keepalive/time.Second), f.toJSONSensors(), f.toJSONActuators())
+}
+
+// versionFields คือ field รุ่นของ firmware ที่ใช้ทั้งใน hello และคำตอบของคำสั่ง version
+func (f *Firmware) versionFields() string {
+    return fmt.Sprintf(`"fw":%s,"commit":%s,"built":%s,"proto":%d`,
+        jsonString(f.board.Version), jsonString(f.board.Commit), jsonString(f.board.Built), protocol.Version)
+}
+
+// jsonString คือ s ในรูป JSON string (ค่าจาก -ldflags หรือชื่อที่ตั้งใน Board อาจมี " \ หรือตัวควบคุม)
+func jsonString(s string) string {
+    var b strings.Builder
+    b.WriteByte('"')
+    for _, c := range s {
+        switch {
+        case c == '"' || c == '\\':
+            b.WriteByte('\\')
+            b.WriteRune(c)
+        case c < 0x20:
+            fmt.Fprintf(&b, `\u%04x`, c)
+        default:
+            b.WriteRune(c)
+        }
+    }
+    b.WriteByte('"')
+    return b.String()
+}
+
+func toJSONAir(airID int, temp, hum float64, pumpStatus bool) string {
+    // type=air , air_id=??
+    return fmt.Sprintf(`{"type":"air","air_id":%d,"temp":%.1f,"air_humidity":%.1f,"pump_status":%t}`,
+        airID, temp, hum, pumpStatus)
+}
+
+func toJSONSoil(soilID int, raw uint16, soil float64, pumpStatus bool, fl ADCFilter, variance float64) string {
+    // type=soil , soil_id=??
+    return fmt.Sprintf(`{"type":"soil","soil_id":%d,"soil_raw":%d,"soil_humidity":%.1f,"pump_status":%t,`+
+        `"filter":"%s","samples":%d,"ema_window":%d,"raw_var":%.1f}`,
+        soilID, raw, soil, pumpStatus, filterName(fl.Mode), fl.Samples, fl.EMAWindow, variance)
+}
+
+func toJSONHealth(kind string, id int, errKind string, failures int) string {
+    if errKind == "" {
+        return fmt.Sprintf(`{"kind":"%s","id":%d,"ok":true,"failures":0}`, kind, id)
+    }
+    return fmt.Sprintf(`{"kind":"%s","id":%d,"ok":false,"error":"%s","failures":%d}`, kind, id, errKind, failures)
+}
+
+// ชนิดของปัญหาจาก SensorError (error อื่น = "read")
+func errorKind(err error) string {
+    if se, ok := err.(SensorError); ok {
+        return se.Kind
+    }
+    return "read"
+}
+
+func orUnknown(s string) string {
+    if s == "" {
+        return "unknown"
+    }
+    return s
+}
+
+// ตรวจ threshold
+func changedBeyondThreshold(oldVal, newVal, threshold float64) bool {
+    return math.Abs(newVal-oldVal) > threshold
+}
+
+func clampValue(v int) uint32 {
+    if v < 0 {
+        return 0
+    } else if v > 100 {
+        return 100
+    }
+    return uint32(v)
+}
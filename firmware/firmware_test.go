@@ -0,0 +1,259 @@
+package firmware
+
+import (
+    "strings"
+    "testing"
+    "time"
+
+    "smart_farm/protocol"
+)
+
+// testRig คือบอร์ดปลอมหนึ่งชุด: air 1 ตัว, soil 1 ตัว, ปั๊ม 1 ช่อง (flash nil = ไม่มี Storage)
+type testRig struct {
+    fw    *Firmware
+    port  *FakePort
+    clock *FakeClock
+    air   *FakeHumiditySensor
+    adc   *FakeADC
+    pump  *FakeRelay
+    light *FakePWM
+}
+
+func newTestRig(t *testing.T, flash Storage) *testRig {
+    t.Helper()
+    r := &testRig{
+        port:  &FakePort{},
+        clock: &FakeClock{},
+        air:   &FakeHumiditySensor{Temp: 250, Hum: 600},
+        adc:   &FakeADC{Value: 32768},
+        pump:  &FakeRelay{},
+        light: &FakePWM{},
+    }
+    b := Board{
+        Serial:  r.port,
+        Relays:  []RelayChannel{{Name: "pump", Label: "Water Pump", Relay: r.pump, Water: true}},
+        Light13: r.light,
+        Light14: &FakePWM{},
+        Light15: &FakePWM{},
+        Air:     []AirSensor{{ID: 1, Sensor: r.air}},
+        Soil:    []SoilProbe{{ID: 1, ADC: r.adc}},
+        Clock:   r.clock,
+        Storage: flash,
+        Version: "test",
+    }
+    r.fw = New(b)
+    r.fw.Boot()
+    r.port.Output()
+    return r
+}
+
+// runFor ทำ task ของ firmware ตามเวลาไปอีก d แล้วคืน frame ที่ส่งออกมา
+func (r *testRig) runFor(t *testing.T, d time.Duration) []protocol.Frame {
+    t.Helper()
+    end := r.clock.Now().Add(d)
+    for {
+        r.fw.Step()
+        next := r.fw.NextDue()
+        if next.After(end) {
+            r.clock.Advance(end.Sub(r.clock.Now()))
+            break
+        }
+        r.clock.Advance(next.Sub(r.clock.Now()))
+    }
+    return r.frames(t)
+}
+
+// frames แยก frame ทุกบรรทัดที่ firmware เขียนออกมาตั้งแต่ครั้งก่อน (ข้ามบรรทัดแบบเดิม)
+func (r *testRig) frames(t *testing.T) []protocol.Frame {
+    t.Helper()
+    var out []protocol.Frame
+    for _, line := range strings.Split(r.port.Output(), "\n") {
+        if !protocol.IsFrame(line) {
+            continue
+        }
+        f, err := protocol.Decode(line)
+        if err != nil {
+            t.Fatalf("firmware sent a bad frame %q: %v", line, err)
+        }
+        out = append(out, f)
+    }
+    return out
+}
+
+// command ส่งคำสั่งเป็น frame แล้วคืนคำตอบ (ack/err) ที่มี id เดียวกัน
+func (r *testRig) command(t *testing.T, id uint16, cmd string) protocol.Frame {
+    t.Helper()
+    r.port.Feed(protocol.Frame{ID: id, Type: protocol.TypeCommand, Payload: cmd}.Encode() + "\n")
+    for _, f := range r.runFor(t, cmdPeriod) {
+        if f.ID == id && (f.Type == protocol.TypeAck || f.Type == protocol.TypeErr) {
+            return f
+        }
+    }
+    t.Fatalf("no reply to %q", cmd)
+    return protocol.Frame{}
+}
+
+func countData(frames []protocol.Frame, kind string) int {
+    n := 0
+    for _, f := range frames {
+        if f.Type == protocol.TypeData && strings.Contains(f.Payload, `"type":"`+kind+`"`) {
+            n++
+        }
+    }
+    return n
+}
+
+func TestAirThresholdReporting(t *testing.T) {
+    r := newTestRig(t, nil)
+    if n := countData(r.runFor(t, time.Millisecond), "air"); n != 1 {
+        t.Fatalf("first reading: %d air frames, want 1", n)
+    }
+
+    // เปลี่ยนไม่เกิน threshold (0.2 °C / 0.5 %) => ไม่ส่ง
+    r.air.Temp, r.air.Hum = 251, 604
+    if n := countData(r.runFor(t, 3*airPeriod), "air"); n != 0 {
+        t.Fatalf("change below threshold: %d air frames, want 0", n)
+    }
+
+    r.air.Temp = 255
+    frames := r.runFor(t, airPeriod)
+    if n := countData(frames, "air"); n != 1 {
+        t.Fatalf("change above threshold: %d air frames, want 1", n)
+    }
+}
+
+func TestSoilThresholdReporting(t *testing.T) {
+    r := newTestRig(t, nil)
+    if n := countData(r.runFor(t, time.Millisecond), "soil"); n != 1 {
+        t.Fatalf("first reading: %d soil frames, want 1", n)
+    }
+
+    // 300 จาก 65535 ≈ 0.5% < soil_threshold 1%
+    r.adc.Value += 300
+    if n := countData(r.runFor(t, 5*LoopPeriod), "soil"); n != 0 {
+        t.Fatalf("change below threshold: %d soil frames, want 0", n)
+    }
+
+    r.adc.Value += 1000
+    if n := countData(r.runFor(t, LoopPeriod), "soil"); n != 1 {
+        t.Fatalf("change above threshold: %d soil frames, want 1", n)
+    }
+}
+
+func TestKeepaliveResendsStableValues(t *testing.T) {
+    r := newTestRig(t, nil)
+    r.runFor(t, time.Millisecond)
+
+    frames := r.runFor(t, defaultKeepalive-airPeriod)
+    if n := countData(frames, "air") + countData(frames, "soil"); n != 0 {
+        t.Fatalf("before keepalive: %d data frames, want 0", n)
+    }
+    frames = r.runFor(t, airPeriod+LoopPeriod)
+    if countData(frames, "air") != 1 || countData(frames, "soil") != 1 {
+        t.Fatalf("at keepalive: air=%d soil=%d, want 1 each", countData(frames, "air"), countData(frames, "soil"))
+    }
+
+    // keepalive 0 = ส่งเฉพาะตอนค่าเปลี่ยน
+    if reply := r.command(t, 1, "keepalive:0"); reply.Type != protocol.TypeAck {
+        t.Fatalf("keepalive:0 => %+v", reply)
+    }
+    frames = r.runFor(t, 3*defaultKeepalive)
+    if n := countData(frames, "air") + countData(frames, "soil"); n != 0 {
+        t.Fatalf("keepalive off: %d data frames, want 0", n)
+    }
+}
+
+func TestFrameCommandReplies(t *testing.T) {
+    r := newTestRig(t, nil)
+    tests := []struct {
+        cmd   string
+        typ   string
+        reply string
+    }{
+        {"light13:150", protocol.TypeAck, "light13=100"},
+        {"light13:-5,1000", protocol.TypeAck, "light13=0 over 1000ms linear"},
+        {"light13:40", protocol.TypeAck, "light13=40"},
+        {"pump:on", protocol.TypeAck, ""},
+        {"pump:maybe", protocol.TypeErr, "Bad value"},
+        {"light13:x", protocol.TypeErr, "Bad value"},
+        {"keepalive:abc", protocol.TypeErr, "Bad value"},
+        {"bogus", protocol.TypeErr, "Unknown"},
+    }
+    for i, tt := range tests {
+        id := uint16(100 + i)
+        got := r.command(t, id, tt.cmd)
+        if got.Type != tt.typ || (tt.reply != "" && got.Payload != tt.reply) {
+            t.Errorf("%q => %s %q, want %s %q", tt.cmd, got.Type, got.Payload, tt.typ, tt.reply)
+        }
+    }
+    if r.light.Percent != 40 {
+        t.Errorf("light13 duty = %d, want 40", r.light.Percent)
+    }
+    if !r.pump.On {
+        t.Errorf("pump is off after pump:on")
+    }
+}
+
+func TestFrameErrors(t *testing.T) {
+    r := newTestRig(t, nil)
+
+    // CRC ไม่ตรง => err checksum พร้อม id เดิม
+    line := protocol.Frame{ID: 9, Type: protocol.TypeCommand, Payload: "light13:70"}.Encode()
+    r.port.Feed(strings.Replace(line, ":70*", ":71*", 1) + "\n")
+    // frame ที่ไม่ใช่คำสั่ง
+    r.port.Feed(protocol.Frame{ID: 10, Type: protocol.TypeData, Payload: "{}"}.Encode() + "\n")
+    want := map[uint16]string{9: "checksum", 10: "not a command"}
+    for _, f := range r.runFor(t, cmdPeriod) {
+        if f.Type != protocol.TypeErr {
+            continue
+        }
+        if f.Payload != want[f.ID] {
+            t.Errorf("err frame %d = %q, want %q", f.ID, f.Payload, want[f.ID])
+        }
+        delete(want, f.ID)
+    }
+    if len(want) != 0 {
+        t.Errorf("no err frame for ids %v", want)
+    }
+    if r.light.Percent != 0 {
+        t.Errorf("light13 duty = %d after a bad checksum, want 0", r.light.Percent)
+    }
+}
+
+func TestLegacyCommandReplies(t *testing.T) {
+    r := newTestRig(t, nil)
+    r.port.Feed("light13:25\nbogus\n")
+    r.fw.Step()
+    out := r.port.Output()
+    if !strings.Contains(out, "ACK: light13=25\n") {
+        t.Errorf("no ACK line for light13:25 in %q", out)
+    }
+    if !strings.Contains(out, "ERR: Unknown\n") {
+        t.Errorf("no ERR line for bogus in %q", out)
+    }
+}
+
+func TestLongLineIsDropped(t *testing.T) {
+    r := newTestRig(t, nil)
+    long := protocol.Frame{ID: 5, Type: protocol.TypeCommand, Payload: "light13:50" + strings.Repeat(",0", 40)}.Encode()
+    r.port.Feed(long + "\n")
+    r.port.Feed(protocol.Frame{ID: 6, Type: protocol.TypeCommand, Payload: "light13:20"}.Encode() + "\n")
+    replies := map[uint16]protocol.Frame{}
+    for _, f := range r.runFor(t, cmdPeriod) {
+        if f.Type == protocol.TypeAck || f.Type == protocol.TypeErr {
+            replies[f.ID] = f
+        }
+    }
+    if got := replies[5]; got.Type != protocol.TypeErr || got.Payload != "line too long" {
+        t.Errorf("long line => %+v, want err \"line too long\"", got)
+    }
+    if got := replies[6]; got.Type != protocol.TypeAck {
+        t.Errorf("command after long line => %+v", got)
+    }
+    if len(replies) != 2 {
+        t.Errorf("replies = %v, want only ids 5 and 6", replies)
+    }
+    if r.light.Percent != 20 {
+        t.Errorf("light13 duty = %d, want 20", r.light.Percent)
+    }
+}
@@ -0,0 +1,63 @@
+package firmware
+
+import "time"
+
+// ฮาร์ดแวร์ที่ firmware ใช้ ผ่าน interface เพื่อให้ logic เดียวกันรันได้ทั้งบน Pico (TinyGo)
+// และบน Linux ด้วย Go ปกติ (ใช้ fake ใน fake.go หรือ environment จำลองของ package emulator)
+
+// Relay คือ relay ของปั๊ม (บนบอร์ดจริงเป็น active low ตัว implementation จัดการเอง)
+type Relay interface {
+    Set(on bool)
+}
+
+// PWMChannel คือช่อง PWM หนึ่งช่อง รับ duty เป็น % (0..100)
+type PWMChannel interface {
+    SetPercent(pct uint32)
+}
+
+// HumiditySensor คือ DHT22: อุณหภูมิ/ความชื้นหน่วย 0.1 (เหมือน drivers/dht)
+// อ่านไม่ได้ให้คืน SensorError เพื่อบอกชนิดของปัญหา (error อื่นจะถือเป็น "read")
+type HumiditySensor interface {
+    Measurements() (temp int16, hum uint16, err error)
+}
+
+// SensorError บอกชนิดของปัญหาของ sensor เช่น "no_signal", "checksum"
+// ส่งให้ server ใน frame health
+type SensorError struct {
+    Kind string
+}
+
+func (e SensorError) Error() string { return "sensor error: " + e.Kind }
+
+// ADC อ่านค่า 16 บิต (0..65535)
+type ADC interface {
+    Get() uint16
+}
+
+// Port คือ Serial ที่คุยกับ server (machine.Serial มี method ครบอยู่แล้ว)
+type Port interface {
+    Buffered() int
+    ReadByte() (byte, error)
+    Write(p []byte) (int, error)
+}
+
+// Clock ใช้คำนวณ uptime และหน่วงเวลาระหว่างรอบ loop
+type Clock interface {
+    Now() time.Time
+    Sleep(d time.Duration)
+}
+
+// SystemClock ใช้นาฬิกาจริงของระบบ
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time        { return time.Now() }
+func (SystemClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// Storage คือ flash สำหรับค่าที่ต้องอยู่รอดหลัง reboot (machine.Flash มี method ครบอยู่แล้ว)
+// offset นับจากต้นพื้นที่ข้อมูล ต้อง EraseBlocks ก่อน WriteAt ทับที่เดิม ต้องมีอย่างน้อย 2 erase block
+type Storage interface {
+    ReadAt(p []byte, off int64) (int, error)
+    WriteAt(p []byte, off int64) (int, error)
+    EraseBlocks(start, length int64) error
+    EraseBlockSize() int64
+}
@@ -0,0 +1,149 @@
+package firmware
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+
+    "smart_farm/protocol"
+)
+
+// ค่าของ actuator ที่อยู่รอดหลัง reboot (ไฟตก/brownout)
+//   - ทุกครั้งที่ server สั่งไฟหรือ relay ค่าที่สั่ง (ปลายทางของ ramp) ถูกเก็บลง flash เฉพาะเมื่อค่าเปลี่ยน
+//     และนิ่งมาแล้ว actuatorSaveDelay (เลื่อน slider ทีละขั้นไม่ต้องลบ flash ทุกขั้น)
+//   - ตอน Boot ไฟกลับเป็นค่านั้น (restore_lights, default เปิด)
+//   - relay กลับมาเปิดเฉพาะเมื่อ restore_relays = true ช่องรดน้ำยังอยู่ใต้ pump guard (MaxOn นับจาก boot)
+//   - ค่าที่ firmware เปลี่ยนเองในโหมด fallback ไม่ถูกเก็บ แต่ watchdog ปิดปั๊มถูกเก็บ (ไม่งั้น reboot แล้วเปิดอีก)
+//
+// หลัง Boot ส่ง frame boot บอก server ว่าคืนค่าอะไร และอะไรเริ่มจากปิด/0% (server ขอซ้ำได้ด้วยคำสั่ง boot)
+//   {"uptime_ms":1200,"restored":{"light13":60,"light14":0,"light15":0},"reset":["pump","relay2"]}
+
+const actuatorSaveDelay = 5 * time.Second
+
+// restoreActuators ตั้ง output ตามค่าใน flash (เรียกใน Boot หลังโหลด settings)
+func (f *Firmware) restoreActuators() {
+    st := f.settings.actuators
+    f.actuatorsDirty = false
+    f.bootRestored = f.bootRestored[:0]
+    f.bootReset = f.bootReset[:0]
+    for i, r := range f.relays {
+        if f.settings.actuatorsSaved && f.settings.restore.Relays && i < 8 && st.Relays&(1<<i) != 0 {
+            if _, ok := f.startRelay(r); ok {
+                f.bootRestored = append(f.bootRestored, fmt.Sprintf(`%s:1`, jsonString(r.Name)))
+                continue
+            }
+        }
+        if f.settings.actuatorsSaved && f.settings.restore.Relays {
+            f.bootRestored = append(f.bootRestored, fmt.Sprintf(`%s:0`, jsonString(r.Name)))
+        } else {
+            f.bootReset = append(f.bootReset, jsonString(r.Name))
+        }
+    }
+    for i, l := range f.lights {
+        if f.settings.actuatorsSaved && f.settings.restore.Lights {
+            l.set(clampValue(int(st.Lights[i])))
+            f.bootRestored = append(f.bootRestored, fmt.Sprintf(`%s:%d`, jsonString(l.name), l.duty))
+        } else {
+            f.bootReset = append(f.bootReset, jsonString(l.name))
+        }
+    }
+    // ค่าใน RAM = สิ่งที่ขาเป็นจริงตอนนี้ relay ที่ไม่ได้คืนจะไม่ถูกเปิดจากคำสั่งเก่าใน reboot ครั้งหน้า
+    f.settings.actuators = f.actuatorState()
+    if len(f.bootRestored) > 0 {
+        f.Logf(protocol.LevelInfo, "restored from flash: %s", strings.ReplaceAll(strings.Join(f.bootRestored, " "), `"`, ""))
+    }
+}
+
+// actuatorState คือค่าของทุกช่องตอนนี้ (ไฟที่กำลัง ramp ใช้ค่าปลายทาง)
+func (f *Firmware) actuatorState() ActuatorState {
+    var st ActuatorState
+    for i, l := range f.lights {
+        if i < len(st.Lights) {
+            st.Lights[i] = uint8(l.target())
+        }
+    }
+    for i, r := range f.relays {
+        if r.on && i < 8 {
+            st.Relays |= 1 << i
+        }
+    }
+    return st
+}
+
+// rememberLight / rememberRelay จำค่าที่สั่งของช่องนั้นไว้เขียนลง flash ถ้าเปลี่ยน
+// (ไม่อ่านทุกช่องจากขา เพราะช่องอื่นอาจเป็นค่าที่โหมด fallback ตั้งไว้)
+func (f *Firmware) rememberLight(l *lightChannel) {
+    st := f.settings.actuators
+    for i, x := range f.lights {
+        if x == l && i < len(st.Lights) {
+            st.Lights[i] = uint8(l.target())
+        }
+    }
+    f.rememberActuators(st)
+}
+
+func (f *Firmware) rememberRelay(r *relayState) {
+    st := f.settings.actuators
+    for i, x := range f.relays {
+        if x != r || i >= 8 {
+            continue
+        }
+        if r.on {
+            st.Relays |= 1 << i
+        } else {
+            st.Relays &^= 1 << i
+        }
+    }
+    f.rememberActuators(st)
+}
+
+func (f *Firmware) rememberActuators(st ActuatorState) {
+    if f.settings.actuatorsSaved && st == f.settings.actuators {
+        return
+    }
+    f.settings.actuators = st
+    f.settings.actuatorsSaved = true
+    f.actuatorsDirty = true
+    f.actuatorsChanged = f.board.Clock.Now()
+}
+
+// saveActuators (task persist) เขียนค่าที่สั่งลง flash เมื่อไม่เปลี่ยนมาแล้ว actuatorSaveDelay
+// เขียนไม่สำเร็จ => ลองใหม่หลังรออีกรอบ
+func (f *Firmware) saveActuators() {
+    now := f.board.Clock.Now()
+    if !f.actuatorsDirty || now.Sub(f.actuatorsChanged) < actuatorSaveDelay {
+        return
+    }
+    if !f.saveSettings() {
+        f.actuatorsChanged = now
+    }
+}
+
+func (f *Firmware) sendBoot() {
+    f.txID++
+    f.sendFrame(f.txID, protocol.TypeBoot, f.toJSONBoot())
+}
+
+func (f *Firmware) toJSONBoot() string {
+    return fmt.Sprintf(`{"uptime_ms":%d,"restored":{%s},"reset":[%s]}`,
+        f.Uptime().Milliseconds(), strings.Join(f.bootRestored, ","), strings.Join(f.bootReset, ","))
+}
+
+// config restore_lights / restore_relays รับ true/false หรือ 1/0
+func getRestore(field func(*settings) *bool) func(*Firmware) string {
+    return func(f *Firmware) string {
+        return strconv.FormatBool(*field(&f.settings))
+    }
+}
+
+func setRestore(field func(*settings) *bool) func(*Firmware, string) string {
+    return func(f *Firmware, v string) string {
+        b, err := strconv.ParseBool(v)
+        if err != nil {
+            return "value must be true or false"
+        }
+        *field(&f.settings) = b
+        return ""
+    }
+}
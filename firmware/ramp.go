@@ -0,0 +1,122 @@
+package firmware
+
+import (
+    "fmt"
+    "math"
+    "strconv"
+    "strings"
+    "time"
+
+    "smart_farm/protocol"
+)
+
+// ไฟค่อยๆ เปลี่ยนความสว่าง (fade / sunrise / sunset)
+//   - light13:<pct>                    => ตั้งทันที (แบบเดิม)
+//   - light13:<pct>,<ms>[,linear|gamma] => ค่อยๆ ไปที่ pct ภายใน ms
+//
+// linear เปลี่ยน duty เท่าๆ กัน ส่วน gamma เปลี่ยนตามความสว่างที่ตาเห็น (ช่วงมืดจะค่อยๆ ขึ้น
+// เหมาะกับ sunrise) ramp ไม่ block loop: task ramp ใน scheduler.go เลื่อน duty ทุก rampTick
+
+// ระหว่าง ramp อัปเดต PWM ทุกช่วงนี้ (ไม่รอจนครบ loop_ms)
+const rampTick = 20 * time.Millisecond
+
+// ramp นานสุด 24 ชั่วโมง
+const maxRampMs = 24 * 60 * 60 * 1000
+
+// gamma ของตาคน ใช้กับ curve "gamma"
+const lightGamma = 2.2
+
+// ไฟในโหมด fallback เปิด/ปิดแบบ sunrise/sunset ใช้เวลาเท่านี้
+const fallbackLightRamp = 15 * time.Minute
+
+type lightRamp struct {
+    from, to uint32
+    start    time.Time
+    dur      time.Duration
+    gamma    bool
+}
+
+// at คือ duty ที่ควรเป็นเมื่อผ่านไป elapsed
+func (r *lightRamp) at(elapsed time.Duration) uint32 {
+    p := float64(elapsed) / float64(r.dur)
+    if p >= 1 {
+        return r.to
+    }
+    from, to := float64(r.from), float64(r.to)
+    if !r.gamma {
+        return uint32(math.Round(from + (to-from)*p))
+    }
+    a := math.Pow(from/100, 1/lightGamma)
+    b := math.Pow(to/100, 1/lightGamma)
+    return uint32(math.Round(100 * math.Pow(a+(b-a)*p, lightGamma)))
+}
+
+// setLight ทำคำสั่ง <name>:<pct>[,<ms>[,linear|gamma]]
+func (f *Firmware) setLight(l *lightChannel, arg string) (string, bool) {
+    parts := strings.Split(arg, ",")
+    if len(parts) > 3 {
+        return "Bad value", false
+    }
+    val, e := strconv.Atoi(strings.TrimSpace(parts[0]))
+    if e != nil {
+        return "Bad value", false
+    }
+    if len(parts) == 1 {
+        l.ramp = nil
+        l.set(clampValue(val))
+        return fmt.Sprintf("%s=%d", l.name, l.duty), true
+    }
+
+    ms, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 32)
+    if err != nil || ms > maxRampMs {
+        return "Bad value", false
+    }
+    gamma := false
+    if len(parts) == 3 {
+        switch strings.TrimSpace(parts[2]) {
+        case "linear":
+        case "gamma":
+            gamma = true
+        default:
+            return "curve must be linear or gamma", false
+        }
+    }
+    to := clampValue(val)
+    f.startRamp(l, to, time.Duration(ms)*time.Millisecond, gamma)
+    return fmt.Sprintf("%s=%d over %dms %s", l.name, to, ms, curveName(gamma)), true
+}
+
+// startRamp เริ่มเปลี่ยน l ไปที่ to ภายใน dur (ramp เดิมของช่องนี้ถูกแทนที่ เริ่มจาก duty ตอนนี้)
+func (f *Firmware) startRamp(l *lightChannel, to uint32, dur time.Duration, gamma bool) {
+    if dur <= 0 || l.duty == to {
+        l.ramp = nil
+        l.set(to)
+        return
+    }
+    l.ramp = &lightRamp{from: l.duty, to: to, start: f.board.Clock.Now(), dur: dur, gamma: gamma}
+    f.Logf(protocol.LevelDebug, "%s ramp %d%% => %d%% in %dms (%s)", l.name, l.duty, to, dur.Milliseconds(), curveName(gamma))
+}
+
+// stepRamps เลื่อน duty ของทุกช่องที่กำลัง ramp ตามเวลาตอนนี้
+func (f *Firmware) stepRamps() {
+    now := f.board.Clock.Now()
+    for _, l := range f.lights {
+        if l.ramp == nil {
+            continue
+        }
+        if duty := l.ramp.at(now.Sub(l.ramp.start)); duty != l.duty {
+            l.set(duty)
+        }
+        if now.Sub(l.ramp.start) >= l.ramp.dur {
+            l.ramp = nil
+            f.Logf(protocol.LevelDebug, "%s ramp done at %d%%", l.name, l.duty)
+        }
+    }
+}
+
+func curveName(gamma bool) string {
+    if gamma {
+        return "gamma"
+    }
+    return "linear"
+}
@@ -0,0 +1,196 @@
+package firmware
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+
+    "smart_farm/protocol"
+)
+
+// relay แต่ละช่องเป็น actuator แยกกัน (เช่น valve สองตัว หรือปั๊มกับพัดลม)
+//   - <name>:on / <name>:off (หรือ 1/0) => สั่งทีละช่อง
+//   - on / off                        => คำสั่งแบบเดิม สั่งทุกช่องที่ Water
+//
+// ช่องที่ Water = true ใช้รดน้ำ: มี pump guard (MaxOn/MinOff) และโหมด fallback เปิด/ปิดตามความชื้นดิน
+// pump_status ใน telemetry = มีช่อง Water เปิดอยู่อย่างน้อยหนึ่งช่อง
+
+// RelayChannel คือ relay หนึ่งช่องบนบอร์ด
+type RelayChannel struct {
+    Name  string // ชื่อ actuator ใช้เป็นคำสั่ง เช่น "pump", "relay2"
+    Label string // ชื่อที่แสดงบน GUI
+    Relay Relay
+    Water bool
+}
+
+type relayState struct {
+    RelayChannel
+    on     bool
+    onAt   time.Time // เวลาที่เปิดครั้งล่าสุด
+    offAt  time.Time // เวลาที่ปิดครั้งล่าสุด
+    hasRun bool      // ยังไม่เคยเปิดตั้งแต่ boot => ไม่ต้องพัก
+}
+
+func newRelayStates(channels []RelayChannel) []*relayState {
+    out := make([]*relayState, len(channels))
+    for i, c := range channels {
+        out[i] = &relayState{RelayChannel: c}
+    }
+    return out
+}
+
+func (f *Firmware) relay(name string) *relayState {
+    for _, r := range f.relays {
+        if r.Name == name {
+            return r
+        }
+    }
+    return nil
+}
+
+// setRelay ทำคำสั่ง <name>:on|off|1|0
+func (f *Firmware) setRelay(r *relayState, arg string) (string, bool) {
+    switch strings.TrimSpace(arg) {
+    case "on", "1":
+        return f.startRelay(r)
+    case "off", "0":
+        f.stopRelay(r)
+        return r.Name + " OFF", true
+    }
+    return "Bad value", false
+}
+
+// setWater ทำคำสั่ง on/off แบบเดิม กับทุกช่องที่ใช้รดน้ำ
+func (f *Firmware) setWater(on bool) (string, bool) {
+    for _, r := range f.relays {
+        if !r.Water {
+            continue
+        }
+        if !on {
+            f.stopRelay(r)
+        } else if reply, ok := f.startRelay(r); !ok {
+            return reply, false
+        }
+        f.rememberRelay(r)
+    }
+    if on {
+        return "Pump ON", true
+    }
+    return "Pump OFF", true
+}
+
+// startRelay เปิด relay ถ้าเป็นช่องรดน้ำที่เพิ่งหยุด ต้องพักให้ครบ MinOff ก่อน
+func (f *Firmware) startRelay(r *relayState) (string, bool) {
+    if rest := f.restLeft(r); rest > 0 {
+        return fmt.Sprintf("%s resting %ds", r.Name, int((rest+time.Second-1)/time.Second)), false
+    }
+    if !r.on {
+        r.onAt = f.board.Clock.Now()
+    }
+    f.Logf(protocol.LevelDebug, "relay %s => ON", r.Name)
+    r.Relay.Set(true)
+    r.on = true
+    return r.Name + " ON", true
+}
+
+// stopRelay ปิด relay แล้วเริ่มนับเวลาพัก
+func (f *Firmware) stopRelay(r *relayState) {
+    if r.on {
+        r.offAt = f.board.Clock.Now()
+        r.hasRun = true
+        f.Logf(protocol.LevelDebug, "relay %s => OFF", r.Name)
+    }
+    r.Relay.Set(false)
+    r.on = false
+}
+
+// restLeft คือเวลาพักที่เหลือก่อนเปิดช่องรดน้ำใหม่ได้ (ช่องอื่นไม่ต้องพัก)
+func (f *Firmware) restLeft(r *relayState) time.Duration {
+    if !r.Water || r.on || !r.hasRun || f.settings.pump.MinOff == 0 {
+        return 0
+    }
+    rested := f.board.Clock.Now().Sub(r.offAt)
+    if rested >= f.settings.pump.MinOff {
+        return 0
+    }
+    return f.settings.pump.MinOff - rested
+}
+
+// checkRelays ปิดช่องรดน้ำเองเมื่อเปิดนานเกิน MaxOn (เช่น server ค้างหลังสั่ง on) แล้วแจ้ง server
+func (f *Firmware) checkRelays() {
+    if f.settings.pump.MaxOn == 0 {
+        return
+    }
+    for _, r := range f.relays {
+        if !r.Water || !r.on {
+            continue
+        }
+        ran := f.board.Clock.Now().Sub(r.onAt)
+        if ran < f.settings.pump.MaxOn {
+            continue
+        }
+        f.stopRelay(r)
+        f.rememberRelay(r)
+        f.Logf(protocol.LevelWarn, "⏱ %s ran %ds, turned off by watchdog", r.Name, int(ran/time.Second))
+        f.sendEvent(fmt.Sprintf(`{"event":"pump_timeout","actuator":%s,"ran_ms":%d,"rest_ms":%d}`,
+            jsonString(r.Name), ran.Milliseconds(), f.settings.pump.MinOff.Milliseconds()))
+        if f.fb.active {
+            f.recordFallback(r.Name, 0, "pump_timeout")
+        }
+    }
+}
+
+// watering บอกว่ามีช่องรดน้ำเปิดอยู่ (pump_status)
+func (f *Firmware) watering() bool {
+    for _, r := range f.relays {
+        if r.Water && r.on {
+            return true
+        }
+    }
+    return false
+}
+
+// configurePumpGuard ทำคำสั่ง pumpguard (หน่วยวินาที 0 = ไม่จำกัด ใช้กับทุกช่องรดน้ำ)
+//   - pumpguard                    => ดูค่าปัจจุบัน
+//   - pumpguard:<max_on>,<min_off> => ตั้งค่าและเก็บลง flash
+func (f *Firmware) configurePumpGuard(arg string) (string, bool) {
+    if arg == "" {
+        return f.pumpGuardString(), true
+    }
+    parts := strings.Split(arg, ",")
+    if len(parts) != 2 {
+        return "Bad value", false
+    }
+    maxOn, e1 := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 16)
+    minOff, e2 := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 16)
+    if e1 != nil || e2 != nil {
+        return "Bad value", false
+    }
+    f.settings.pump = PumpGuard{
+        MaxOn:  time.Duration(maxOn) * time.Second,
+        MinOff: time.Duration(minOff) * time.Second,
+    }
+    f.Logf(protocol.LevelInfo, "%s", f.pumpGuardString())
+    if !f.saveSettings() {
+        return "flash error", false
+    }
+    return f.pumpGuardString(), true
+}
+
+func (f *Firmware) pumpGuardString() string {
+    return fmt.Sprintf("pump max_on=%ds min_off=%ds",
+        int(f.settings.pump.MaxOn/time.Second), int(f.settings.pump.MinOff/time.Second))
+}
+
+// toJSONActuators คือ list actuators ใน hello: relay ทุกช่องตามด้วยไฟ
+func (f *Firmware) toJSONActuators() string {
+    parts := make([]string, 0, len(f.relays)+len(f.lights))
+    for _, r := range f.relays {
+        parts = append(parts, fmt.Sprintf(`{"name":%s,"kind":"relay","label":%s,"min":0,"max":1}`, jsonString(r.Name), jsonString(r.Label)))
+    }
+    for _, l := range f.lights {
+        parts = append(parts, fmt.Sprintf(`{"name":%s,"kind":"pwm","label":%s,"min":0,"max":100,"ramp":true}`, jsonString(l.name), jsonString(l.label)))
+    }
+    return "[" + strings.Join(parts, ",") + "]"
+}
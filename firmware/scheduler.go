@@ -0,0 +1,147 @@
+package firmware
+
+import (
+    "strconv"
+    "strings"
+    "time"
+
+    "smart_farm/protocol"
+)
+
+// main loop แบ่งเป็น task ที่มีรอบของตัวเอง (cooperative: ทำทีละ task จนจบ ไม่มี goroutine)
+//   - watchdog: ปิดช่องรดน้ำที่เปิดนานเกิน MaxOn ทุก watchdogPeriod
+//   - ramp:     เลื่อน duty ของไฟที่กำลัง fade ทุก rampTick
+//   - air:      อ่าน DHT22 ทุก airPeriod (DHT22 อ่านถี่กว่า 2 s ไม่ได้)
+//   - soil:     oversample ADC ของ soil แล้วตรวจ fallback ทุก loop_ms
+//   - cmd:      อ่าน Serial และทำทุกคำสั่งที่ครบบรรทัด ทุก cmdPeriod (ไม่ต้องรอรอบ loop_ms)
+//   - persist:  เขียนค่า actuator ที่สั่งแล้วนิ่งลง flash ทุก persistPeriod (ดู persist.go)
+//
+// Step ทำทุก task ที่ถึงเวลาตามลำดับนี้ Run พักจนกว่า task ถัดไปจะถึงเวลา
+// task ที่ทำช้าจนเลยรอบไป (เช่นเขียน flash) ไม่ทำซ้ำเพื่อไล่ตาม รอบถัดไปนับจากตอนนี้
+
+const (
+    cmdPeriod      = 10 * time.Millisecond
+    airPeriod      = 2 * time.Second
+    watchdogPeriod = 100 * time.Millisecond
+    persistPeriod  = 500 * time.Millisecond
+)
+
+type task struct {
+    name   string
+    period func(f *Firmware) time.Duration
+    run    func(f *Firmware)
+    next   time.Time
+}
+
+func every(d time.Duration) func(*Firmware) time.Duration {
+    return func(*Firmware) time.Duration { return d }
+}
+
+// ทุก task เริ่มทำใน Step แรก
+func newTasks(now time.Time) []*task {
+    return []*task{
+        {name: "watchdog", period: every(watchdogPeriod), run: (*Firmware).checkRelays, next: now},
+        {name: "ramp", period: every(rampTick), run: (*Firmware).stepRamps, next: now},
+        {name: "air", period: every(airPeriod), run: (*Firmware).readAllAir, next: now},
+        {name: "soil", period: func(f *Firmware) time.Duration { return f.settings.loop }, run: (*Firmware).readAllSoil, next: now},
+        {name: "cmd", period: every(cmdPeriod), run: (*Firmware).pollSerial, next: now},
+        {name: "persist", period: every(persistPeriod), run: (*Firmware).saveActuators, next: now},
+    }
+}
+
+// Step ทำทุก task ที่ถึงเวลาแล้ว (ไม่รวมการพัก)
+func (f *Firmware) Step() {
+    now := f.board.Clock.Now()
+    for _, t := range f.tasks {
+        if now.Before(t.next) {
+            continue
+        }
+        t.run(f)
+        p := t.period(f)
+        t.next = t.next.Add(p)
+        if !t.next.After(now) {
+            t.next = now.Add(p)
+        }
+    }
+}
+
+// NextDue คือเวลาที่ task ถัดไปถึงกำหนด
+func (f *Firmware) NextDue() time.Time {
+    next := f.tasks[0].next
+    for _, t := range f.tasks[1:] {
+        if t.next.Before(next) {
+            next = t.next
+        }
+    }
+    return next
+}
+
+// Run = main loop: Step แล้วพักจนถึง task ถัดไป
+func (f *Firmware) Run() {
+    for {
+        f.Step()
+        if d := f.NextDue().Sub(f.board.Clock.Now()); d > 0 {
+            f.board.Clock.Sleep(d)
+        }
+    }
+}
+
+func (f *Firmware) readAllAir() {
+    for _, a := range f.air {
+        f.readAir(a)
+    }
+}
+
+// server เงียบนานเกินไป => ดูแลปั๊ม/ไฟเอง (ปั๊มตัวเดียวรดทุกแปลง จึงใช้ค่าเฉลี่ยของทุก probe)
+func (f *Firmware) readAllSoil() {
+    soilSum := 0.0
+    for _, s := range f.soil {
+        soilSum += f.readSoil(s)
+    }
+    f.checkFallback(soilSum/float64(len(f.soil)), len(f.soil) > 0)
+}
+
+// pollSerial อ่านไบต์ที่มีใน buffer และทำทุกคำสั่งที่ครบบรรทัด ส่วนที่ยังไม่ครบเก็บไว้รอบหน้า
+// บรรทัดที่ยาวเกิน rx ถูกทิ้งทั้งบรรทัดและตอบ ERR (ไม่ตัดไปทำเป็นคำสั่ง)
+func (f *Firmware) pollSerial() {
+    for f.board.Serial.Buffered() > 0 {
+        b, err := f.board.Serial.ReadByte()
+        if err != nil {
+            return
+        }
+        if f.rxDrop {
+            f.rxDrop = b != '\n'
+            continue
+        }
+        if b != '\n' {
+            if f.rxLen == len(f.rx) {
+                f.rejectLongLine()
+                f.rxLen = 0
+                f.rxDrop = true
+                continue
+            }
+            f.rx[f.rxLen] = b
+            f.rxLen++
+            continue
+        }
+        line := string(f.rx[:f.rxLen])
+        f.rxLen = 0
+        f.receive(strings.TrimSpace(line))
+    }
+}
+
+// rejectLongLine ตอบ ERR ให้บรรทัดที่ยาวเกิน rx
+// ถ้าเป็น frame ใช้ id จากส่วนต้นของบรรทัด คำสั่งที่รออยู่ฝั่ง server จะได้ ERR แทนการรอจนหมดเวลา
+func (f *Firmware) rejectLongLine() {
+    head := string(f.rx[:f.rxLen])
+    f.Logf(protocol.LevelWarn, "line longer than %d bytes dropped", len(f.rx))
+    if !strings.HasPrefix(head, "$") {
+        f.board.Serial.Write([]byte("ERR: line too long\n"))
+        return
+    }
+    var id uint64
+    if end := strings.IndexAny(head, ":,"); end > 1 {
+        id, _ = strconv.ParseUint(head[1:end], 10, 16)
+    }
+    f.sendFrame(uint16(id), protocol.TypeErr, "line too long")
+}
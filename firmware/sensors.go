@@ -0,0 +1,204 @@
+package firmware
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+
+    "smart_farm/protocol"
+)
+
+// sensor หลายตัวต่อบอร์ด (เช่นหนึ่งตัวต่อแปลง) แต่ละตัวมี id ของตัวเองใน telemetry
+// และมีสถานะ threshold/keepalive/health แยกกัน
+
+// AirSensor คือ DHT22 หนึ่งตัว ID = air_id
+type AirSensor struct {
+    ID     int
+    Sensor HumiditySensor
+}
+
+// SoilProbe คือ probe ความชื้นดินหนึ่งตัว ID = soil_id
+type SoilProbe struct {
+    ID  int
+    ADC ADC
+}
+
+// Pico ต่อ probe ได้ 3 ช่อง (ADC0..2 = GP26/27/28) flash จึงเก็บ calibration ไว้ 3 ชุด
+// ตามลำดับใน Board.Soil
+const MaxSoilProbes = 3
+
+type airState struct {
+    AirSensor
+    lastTemp, lastHum float64
+    sent              bool
+    sentAt            time.Time // ส่งค่าล่าสุดเมื่อไร (สำหรับ keepalive)
+    failures          int       // อ่านไม่ได้ติดกันกี่ครั้ง
+}
+
+type soilState struct {
+    SoilProbe
+    cal    *SoilCalibration // ชี้ไปที่ช่องของ probe นี้ใน f.settings.soil
+    last   float64
+    sent   bool
+    sentAt time.Time
+
+    // filter ของ ADC (adcfilter.go)
+    samples [maxADCSamples]uint16
+    ema     float64
+    emaOK   bool
+}
+
+func newAirStates(sensors []AirSensor) []*airState {
+    out := make([]*airState, len(sensors))
+    for i, s := range sensors {
+        out[i] = &airState{AirSensor: s}
+    }
+    return out
+}
+
+// newSoilStates ผูก probe เข้ากับ calibration ตามลำดับ (เกิน MaxSoilProbes จะถูกตัดทิ้ง)
+func (f *Firmware) newSoilStates(probes []SoilProbe) []*soilState {
+    if len(probes) > MaxSoilProbes {
+        probes = probes[:MaxSoilProbes]
+    }
+    out := make([]*soilState, len(probes))
+    for i, p := range probes {
+        out[i] = &soilState{SoilProbe: p, cal: &f.settings.soil[i]}
+    }
+    return out
+}
+
+// readAir อ่าน DHT หนึ่งตัว: อ่านไม่ได้ => ไม่ส่งค่า (ไม่งั้น server จะได้ 0.0/0.0) แต่ส่ง frame health แทน
+func (f *Firmware) readAir(a *airState) {
+    tRaw, hRaw, err := a.Sensor.Measurements()
+    if err != nil {
+        a.failures++
+        if a.failures == 1 || a.failures%healthRepeat == 0 {
+            f.sendHealth("air", a.ID, errorKind(err), a.failures)
+        }
+        return
+    }
+    if a.failures > 0 {
+        a.failures = 0
+        f.sendHealth("air", a.ID, "", 0)
+    }
+    newTemp := float64(tRaw) / 10.0
+    newHum := float64(hRaw) / 10.0
+
+    // ครั้งแรกส่งเลย หลังจากนั้นส่งเมื่อเปลี่ยนเกิน threshold หรือเงียบนานเกิน keepalive
+    changed := !a.sent ||
+        changedBeyondThreshold(a.lastTemp, newTemp, f.settings.tempThreshold) ||
+        changedBeyondThreshold(a.lastHum, newHum, f.settings.humThreshold)
+    if changed || f.keepaliveDue(a.sentAt) {
+        f.sendData(toJSONAir(a.ID, newTemp, newHum, f.watering()))
+        a.lastTemp = newTemp
+        a.lastHum = newHum
+        a.sent = true
+        a.sentAt = f.board.Clock.Now()
+    }
+}
+
+// readSoil อ่าน probe หนึ่งตัว ค่าดิบ (ผ่าน filter) => % ตาม calibration ของ probe นั้น คืน % ที่อ่านได้
+func (f *Firmware) readSoil(s *soilState) float64 {
+    raw, variance := f.sampleSoil(s)
+    pct := s.cal.Percent(raw)
+    if !s.sent || changedBeyondThreshold(s.last, pct, f.settings.soilThreshold) || f.keepaliveDue(s.sentAt) {
+        f.sendData(toJSONSoil(s.ID, raw, pct, f.watering(), f.settings.filter, variance))
+        s.last = pct
+        s.sent = true
+        s.sentAt = f.board.Clock.Now()
+    }
+    return pct
+}
+
+// soilProbe หา probe ตาม soil_id
+func (f *Firmware) soilProbe(id int) (*soilState, bool) {
+    for _, s := range f.soil {
+        if s.ID == id {
+            return s, true
+        }
+    }
+    return nil, false
+}
+
+// calibrateSoil ทำคำสั่ง soilcal[<id>][:arg] (ไม่ใส่ id = probe ตัวแรก)
+//   - soilcal2             => ดูค่าปัจจุบันของ soil_id 2
+//   - soilcal2:dry / :wet  => ใช้ค่า ADC ตอนนี้ (เฉลี่ย calSamples ครั้ง) เป็นจุดแห้ง/ชุ่ม
+//   - soilcal2:<dry>,<wet> => ตั้งค่าดิบของปลายทั้งสองเอง
+//   - soilcal2:reset       => กลับเป็นค่า default
+//
+// ตอบ "soil<id> dry=<dry> wet=<wet>" แล้วส่ง soil ใหม่ในรอบถัดไปทันที
+func (f *Firmware) calibrateSoil(cmd string) (string, bool) {
+    target, arg, _ := strings.Cut(cmd, ":")
+    if len(f.soil) == 0 {
+        return "No soil probe", false
+    }
+    s := f.soil[0]
+    if target != "" {
+        id, err := strconv.Atoi(target)
+        if err != nil {
+            return "Bad value", false
+        }
+        var ok bool
+        if s, ok = f.soilProbe(id); !ok {
+            return "Unknown soil probe", false
+        }
+    }
+
+    cal := *s.cal
+    switch arg {
+    case "":
+        return fmt.Sprintf("soil%d dry=%d wet=%d", s.ID, cal.Dry, cal.Wet), true
+    case "dry":
+        cal.Dry = sampleADC(s.ADC)
+    case "wet":
+        cal.Wet = sampleADC(s.ADC)
+    case "reset":
+        cal = defaultSoilCalibration
+    default:
+        parts := strings.Split(arg, ",")
+        if len(parts) != 2 {
+            return "Bad value", false
+        }
+        dry, e1 := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 16)
+        wet, e2 := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 16)
+        if e1 != nil || e2 != nil {
+            return "Bad value", false
+        }
+        cal = SoilCalibration{Dry: uint16(dry), Wet: uint16(wet)}
+    }
+    if cal.Dry == cal.Wet {
+        return "dry and wet must differ", false
+    }
+
+    *s.cal = cal
+    s.sent = false
+    f.Logf(protocol.LevelInfo, "soil %d calibration dry=%d wet=%d", s.ID, cal.Dry, cal.Wet)
+    if !f.saveSettings() {
+        return "flash error", false
+    }
+    return fmt.Sprintf("soil%d dry=%d wet=%d", s.ID, cal.Dry, cal.Wet), true
+}
+
+// sampleADC เฉลี่ยค่า ADC หลายครั้งกันค่ากระโดดตอนจับจุด calibration
+func sampleADC(adc ADC) uint16 {
+    sum := uint32(0)
+    for i := 0; i < calSamples; i++ {
+        sum += uint32(adc.Get())
+    }
+    return uint16(sum / calSamples)
+}
+
+// toJSONSensors คือ list sensors ใน hello (soil มี cal = ค่า calibration ปัจจุบัน)
+func (f *Firmware) toJSONSensors() string {
+    parts := make([]string, 0, len(f.air)+len(f.soil))
+    for _, a := range f.air {
+        parts = append(parts, fmt.Sprintf(`{"kind":"air","id":%d,"ranges":{"temp":[-40,80],"air_humidity":[0,100]}}`, a.ID))
+    }
+    for _, s := range f.soil {
+        parts = append(parts, fmt.Sprintf(`{"kind":"soil","id":%d,"ranges":{"soil_humidity":[0,100],"soil_raw":[0,65535]},"cal":{"dry":%d,"wet":%d}}`,
+            s.ID, s.cal.Dry, s.cal.Wet))
+    }
+    return "[" + strings.Join(parts, ",") + "]"
+}
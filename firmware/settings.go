@@ -0,0 +1,332 @@
+package firmware
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "math"
+    "time"
+
+    "smart_farm/protocol"
+)
+
+// ค่าที่เก็บใน flash ตัวเลขเป็น little endian
+// มีสอง slot (erase block 0 และ 1 ของ Storage) เขียนสลับกัน: ไฟตกระหว่างลบ/เขียน slot หนึ่ง
+// บันทึกเก่าในอีก slot ยังใช้ได้ ตอนโหลดใช้บันทึกที่ CRC ถูกและ generation สูงกว่า
+//
+//    [0:3]   magic "SFs"
+//    [3]     version เป็นตัวอักษร '1', '2', ...
+//    [4:6]   soil dry (ค่า ADC ตอนดินแห้ง)
+//    [6:8]   soil wet (ค่า ADC ตอนดินชุ่ม)
+//    [8:10]  pump max on (วินาที) ตั้งแต่ version 2
+//    [10:12] pump min off (วินาที) ตั้งแต่ version 2
+//    [12:14] fallback after (วินาที) ตั้งแต่ version 3
+//    [14]    fallback soil low (%)     [15] fallback soil high (%)
+//    [16:18] fallback light on (นาทีของวัน)  [18:20] light off  [20] light duty (%)  [21] ว่าง
+//    [22:24] keepalive (วินาที) ตั้งแต่ version 4
+//    [24:26] temp threshold  [26:28] hum threshold  [28:30] soil threshold (หน่วย 0.01) ตั้งแต่ version 5
+//    [30:32] loop period (ms) ตั้งแต่ version 5
+//    [32:36] soil dry/wet ของ probe ตัวที่ 2  [36:40] ของ probe ตัวที่ 3 ตั้งแต่ version 6
+//            ([4:8] คือ probe ตัวแรก ตามลำดับใน Board.Soil)
+//    [40] soil filter mode  [41] samples ต่อรอบ  [42] EMA window  [43] ว่าง ตั้งแต่ version 7
+//    [44:47] ไฟ light13/14/15 ที่ server สั่งล่าสุด (%)  [47] relay ที่สั่งเปิดไว้ (bit i = Board.Relays[i])
+//    [48] คืนค่าตอน boot: bit0 = ไฟ, bit1 = relay  [49] ว่าง ตั้งแต่ version 8 (ดู persist.go)
+//    [50:54] generation (เพิ่มทุกครั้งที่เขียน อยู่ใน slot generation % 2) ตั้งแต่ version 9
+//            version ก่อนหน้ามีแค่ใน slot 0 นับเป็น generation 0
+//    ต่อท้ายด้วย CRC16 ของทุกไบต์ก่อนหน้า
+//
+// magic/CRC ไม่ตรง (flash ว่างหรือเสีย) => ใช้ค่า default
+// บันทึก version เก่ายังอ่านได้ ค่าที่ version นั้นยังไม่มีจะใช้ default
+const (
+    settingsMagic   = "SFs"
+    settingsVersion = '9'
+)
+
+// settingsLen คือจำนวนไบต์ก่อน CRC ของแต่ละ version (0 = ไม่รู้จัก)
+func settingsLen(version byte) int {
+    switch version {
+    case '1':
+        return 8
+    case '2':
+        return 12
+    case '3':
+        return 22
+    case '4':
+        return 24
+    case '5':
+        return 32
+    case '6':
+        return 40
+    case '7':
+        return 44
+    case '8':
+        return 50
+    case '9':
+        return 54
+    }
+    return 0
+}
+
+// SoilCalibration คือค่า ADC ดิบที่ปลายทั้งสองของ probe: dry = 0%, wet = 100%
+// ค่า default (65535/0) ให้ผลเท่ากับสูตรเดิม 100 - raw/65535*100
+type SoilCalibration struct {
+    Dry uint16
+    Wet uint16
+}
+
+var defaultSoilCalibration = SoilCalibration{Dry: 65535, Wet: 0}
+
+var errBadSettings = errors.New("no valid settings in flash")
+
+// Percent แปลงค่า ADC ดิบเป็น % ความชื้น (ตัดให้อยู่ใน 0..100)
+// probe แบบ capacitive ค่าจะลดลงเมื่อดินชื้น แต่ถ้า wet > dry ก็คำนวณได้เหมือนกัน
+func (c SoilCalibration) Percent(raw uint16) float64 {
+    span := float64(c.Dry) - float64(c.Wet)
+    if span == 0 {
+        return 0
+    }
+    pct := (float64(c.Dry) - float64(raw)) / span * 100
+    if pct < 0 {
+        return 0
+    } else if pct > 100 {
+        return 100
+    }
+    return pct
+}
+
+// PumpGuard คือข้อจำกัดของปั๊มที่ firmware บังคับเอง (0 = ไม่จำกัด)
+//   - MaxOn:  เปิดต่อเนื่องได้นานสุดเท่านี้ แล้ว firmware ปิดเองพร้อมส่ง event pump_timeout
+//   - MinOff: หลังปิดต้องพักอย่างน้อยเท่านี้ก่อนเปิดใหม่
+type PumpGuard struct {
+    MaxOn  time.Duration
+    MinOff time.Duration
+}
+
+var defaultPumpGuard = PumpGuard{MaxOn: 5 * time.Minute, MinOff: time.Minute}
+
+// FallbackPolicy คือสิ่งที่ firmware ทำเองเมื่อไม่ได้ยินจาก server นานเกิน After (0 = ปิดโหมดนี้)
+//   - ปั๊ม: ดินต่ำกว่า SoilLow% => เปิด, สูงกว่า SoilHigh% => ปิด (PumpGuard ยังบังคับอยู่)
+//   - ไฟ: LightDuty% ระหว่าง LightOn..LightOff (นาทีของวัน ข้ามเที่ยงคืนได้) นอกนั้น 0%
+//     ต้องรู้เวลาจาก ping ของ server อย่างน้อยครั้งหนึ่ง ไม่งั้นไฟคงค่าเดิม
+type FallbackPolicy struct {
+    After     time.Duration
+    SoilLow   uint8
+    SoilHigh  uint8
+    LightOn   uint16
+    LightOff  uint16
+    LightDuty uint8
+}
+
+var defaultFallbackPolicy = FallbackPolicy{
+    After:     2 * time.Minute,
+    SoilLow:   30,
+    SoilHigh:  60,
+    LightOn:   6 * 60,
+    LightOff:  18 * 60,
+    LightDuty: 80,
+}
+
+// ADCFilter คือการอ่านและกรองค่า ADC ของ soil (ดู adcfilter.go)
+//   - Mode:      filterMean / filterMedian / filterEMA
+//   - Samples:   อ่าน ADC กี่ครั้งต่อรอบ (1..maxADCSamples)
+//   - EMAWindow: ใช้กับ ema เท่านั้น เฉลี่ยประมาณกี่รอบ (1..100)
+type ADCFilter struct {
+    Mode      uint8
+    Samples   uint8
+    EMAWindow uint8
+}
+
+var defaultADCFilter = ADCFilter{Mode: filterMedian, Samples: 9, EMAWindow: 4}
+
+// ActuatorState คือค่าที่ server สั่ง actuator ไว้ล่าสุด ใช้คืนค่าหลัง reboot (ดู persist.go)
+type ActuatorState struct {
+    Lights [3]uint8 // light13, light14, light15 (%)
+    Relays uint8    // bit i = Board.Relays[i] เปิดอยู่
+}
+
+// RestorePolicy บอกว่าตอน boot จะคืนค่าอะไร (relay ปิดไว้ก่อน: ปั๊มที่เปิดเองหลังไฟกลับมาอาจรดน้ำโดยไม่มีใครเห็น)
+type RestorePolicy struct {
+    Lights bool
+    Relays bool
+}
+
+var defaultRestorePolicy = RestorePolicy{Lights: true}
+
+// ถ้าค่าไม่เปลี่ยนเกิน threshold นานเท่านี้ จะส่งค่าปัจจุบันซ้ำ ให้ server รู้ว่า sensor ยังอยู่ (0 = ไม่ส่ง)
+const defaultKeepalive = time.Minute
+
+type settings struct {
+    soil      [MaxSoilProbes]SoilCalibration
+    pump      PumpGuard
+    fallback  FallbackPolicy
+    keepalive time.Duration
+    filter    ADCFilter
+    restore   RestorePolicy
+
+    // actuators มีความหมายเฉพาะเมื่อ actuatorsSaved (โหลดจาก flash version 8 ขึ้นไป)
+    actuators      ActuatorState
+    actuatorsSaved bool
+
+    tempThreshold, humThreshold, soilThreshold float64
+    loop                                       time.Duration
+
+    // generation ของบันทึกที่โหลด/เขียนล่าสุด (ครั้งหน้าเขียนลงอีก slot)
+    gen uint32
+}
+
+func defaultSettings() settings {
+    return settings{
+        soil:          [MaxSoilProbes]SoilCalibration{defaultSoilCalibration, defaultSoilCalibration, defaultSoilCalibration},
+        pump:          defaultPumpGuard,
+        fallback:      defaultFallbackPolicy,
+        keepalive:     defaultKeepalive,
+        filter:        defaultADCFilter,
+        restore:       defaultRestorePolicy,
+        tempThreshold: defaultTempThreshold,
+        humThreshold:  defaultHumThreshold,
+        soilThreshold: defaultSoilThreshold,
+        loop:          LoopPeriod,
+    }
+}
+
+var errSettingsVerify = errors.New("settings read back differ from what was written")
+
+// loadSettings อ่านทั้งสอง slot แล้วใช้บันทึกที่ถูกต้องและ generation สูงกว่า
+func loadSettings(s Storage) (settings, error) {
+    st, err := loadSlot(s, 0)
+    if st1, err1 := loadSlot(s, 1); err1 == nil && (err != nil || st1.gen > st.gen) {
+        return st1, nil
+    }
+    return st, err
+}
+
+func loadSlot(s Storage, slot int64) (settings, error) {
+    st := defaultSettings()
+    off := slot * s.EraseBlockSize()
+    head := make([]byte, 4)
+    if _, err := s.ReadAt(head, off); err != nil {
+        return st, err
+    }
+    n := settingsLen(head[3])
+    if string(head[0:3]) != settingsMagic || n == 0 {
+        return st, errBadSettings
+    }
+    buf := make([]byte, n+2)
+    if _, err := s.ReadAt(buf, off); err != nil {
+        return st, err
+    }
+    if binary.LittleEndian.Uint16(buf[n:]) != protocol.CRC16(string(buf[:n])) {
+        return st, errBadSettings
+    }
+
+    st.soil[0] = readSoilCalibration(buf[4:8])
+    if n >= 12 {
+        st.pump = PumpGuard{
+            MaxOn:  time.Duration(binary.LittleEndian.Uint16(buf[8:10])) * time.Second,
+            MinOff: time.Duration(binary.LittleEndian.Uint16(buf[10:12])) * time.Second,
+        }
+    }
+    if n >= 22 {
+        st.fallback = FallbackPolicy{
+            After:     time.Duration(binary.LittleEndian.Uint16(buf[12:14])) * time.Second,
+            SoilLow:   buf[14],
+            SoilHigh:  buf[15],
+            LightOn:   binary.LittleEndian.Uint16(buf[16:18]),
+            LightOff:  binary.LittleEndian.Uint16(buf[18:20]),
+            LightDuty: buf[20],
+        }
+    }
+    if n >= 24 {
+        st.keepalive = time.Duration(binary.LittleEndian.Uint16(buf[22:24])) * time.Second
+    }
+    if n >= 32 {
+        st.tempThreshold = float64(binary.LittleEndian.Uint16(buf[24:26])) / 100
+        st.humThreshold = float64(binary.LittleEndian.Uint16(buf[26:28])) / 100
+        st.soilThreshold = float64(binary.LittleEndian.Uint16(buf[28:30])) / 100
+        if ms := binary.LittleEndian.Uint16(buf[30:32]); ms >= minLoopMs && ms <= maxLoopMs {
+            st.loop = time.Duration(ms) * time.Millisecond
+        }
+    }
+    if n >= 40 {
+        st.soil[1] = readSoilCalibration(buf[32:36])
+        st.soil[2] = readSoilCalibration(buf[36:40])
+    }
+    if n >= 44 {
+        st.filter = ADCFilter{Mode: buf[40], Samples: buf[41], EMAWindow: buf[42]}
+    }
+    if n >= 50 {
+        st.actuators = ActuatorState{Lights: [3]uint8{buf[44], buf[45], buf[46]}, Relays: buf[47]}
+        st.actuatorsSaved = true
+        st.restore = RestorePolicy{Lights: buf[48]&1 != 0, Relays: buf[48]&2 != 0}
+    }
+    if n >= 54 {
+        st.gen = binary.LittleEndian.Uint32(buf[50:54])
+    }
+    return st, nil
+}
+
+func readSoilCalibration(b []byte) SoilCalibration {
+    return SoilCalibration{Dry: binary.LittleEndian.Uint16(b[0:2]), Wet: binary.LittleEndian.Uint16(b[2:4])}
+}
+
+func putSoilCalibration(b []byte, c SoilCalibration) {
+    binary.LittleEndian.PutUint16(b[0:2], c.Dry)
+    binary.LittleEndian.PutUint16(b[2:4], c.Wet)
+}
+
+// saveSettings เขียนบันทึก generation ถัดไปลง slot ที่ไม่ได้ใช้อยู่ แล้วอ่านกลับมาตรวจ
+// st.gen เปลี่ยนเมื่อเขียนสำเร็จเท่านั้น (ไม่สำเร็จ = ครั้งหน้าเขียน slot เดิมซ้ำ)
+func saveSettings(s Storage, st *settings) error {
+    gen := st.gen + 1
+    n := settingsLen(settingsVersion)
+    buf := make([]byte, n+2)
+    copy(buf[0:3], settingsMagic)
+    buf[3] = settingsVersion
+    putSoilCalibration(buf[4:8], st.soil[0])
+    binary.LittleEndian.PutUint16(buf[8:10], uint16(st.pump.MaxOn/time.Second))
+    binary.LittleEndian.PutUint16(buf[10:12], uint16(st.pump.MinOff/time.Second))
+    binary.LittleEndian.PutUint16(buf[12:14], uint16(st.fallback.After/time.Second))
+    buf[14] = st.fallback.SoilLow
+    buf[15] = st.fallback.SoilHigh
+    binary.LittleEndian.PutUint16(buf[16:18], st.fallback.LightOn)
+    binary.LittleEndian.PutUint16(buf[18:20], st.fallback.LightOff)
+    buf[20] = st.fallback.LightDuty
+    binary.LittleEndian.PutUint16(buf[22:24], uint16(st.keepalive/time.Second))
+    binary.LittleEndian.PutUint16(buf[24:26], uint16(math.Round(st.tempThreshold*100)))
+    binary.LittleEndian.PutUint16(buf[26:28], uint16(math.Round(st.humThreshold*100)))
+    binary.LittleEndian.PutUint16(buf[28:30], uint16(math.Round(st.soilThreshold*100)))
+    binary.LittleEndian.PutUint16(buf[30:32], uint16(st.loop/time.Millisecond))
+    putSoilCalibration(buf[32:36], st.soil[1])
+    putSoilCalibration(buf[36:40], st.soil[2])
+    buf[40] = st.filter.Mode
+    buf[41] = st.filter.Samples
+    buf[42] = st.filter.EMAWindow
+    copy(buf[44:47], st.actuators.Lights[:])
+    buf[47] = st.actuators.Relays
+    if st.restore.Lights {
+        buf[48] |= 1
+    }
+    if st.restore.Relays {
+        buf[48] |= 2
+    }
+    binary.LittleEndian.PutUint32(buf[50:54], gen)
+    binary.LittleEndian.PutUint16(buf[n:], protocol.CRC16(string(buf[:n])))
+
+    slot := int64(gen % 2)
+    if err := s.EraseBlocks(slot, 1); err != nil {
+        return err
+    }
+    off := slot * s.EraseBlockSize()
+    if _, err := s.WriteAt(buf, off); err != nil {
+        return err
+    }
+    check := make([]byte, len(buf))
+    if _, err := s.ReadAt(check, off); err != nil {
+        return err
+    }
+    if !bytes.Equal(check, buf) {
+        return errSettingsVerify
+    }
+    st.gen = gen
+    return nil
+}
@@ -0,0 +1,366 @@
+package firmware
+
+import (
+    "encoding/binary"
+    "errors"
+    "strconv"
+    "testing"
+    "time"
+
+    "smart_farm/protocol"
+)
+
+// writeRecord เขียนบันทึก settings ที่สร้างเอง (magic + version + ค่า) ลง slot พร้อม CRC
+func writeRecord(t *testing.T, s *FakeStorage, slot int64, body []byte) {
+    t.Helper()
+    buf := append([]byte(nil), body...)
+    buf = binary.LittleEndian.AppendUint16(buf, protocol.CRC16(string(body)))
+    if err := s.EraseBlocks(slot, 1); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := s.WriteAt(buf, slot*s.EraseBlockSize()); err != nil {
+        t.Fatal(err)
+    }
+}
+
+// oldRecord คือบันทึก version v ตาม layout ใน settings.go (ค่าที่ version นั้นยังไม่มีไม่ถูกใส่)
+func oldRecord(v byte) []byte {
+    b := make([]byte, settingsLen(v))
+    copy(b, settingsMagic)
+    b[3] = v
+    put := func(off int, x uint16) {
+        if off+2 <= len(b) {
+            binary.LittleEndian.PutUint16(b[off:], x)
+        }
+    }
+    put(4, 40000) // soil dry
+    put(6, 15000) // soil wet
+    put(8, 120)   // pump max on
+    put(10, 30)   // pump min off
+    put(12, 300)  // fallback after
+    if len(b) >= 22 {
+        b[14], b[15], b[20] = 20, 70, 50
+    }
+    put(16, 7*60)
+    put(18, 19*60)
+    put(22, 30)  // keepalive
+    put(24, 50)  // temp threshold 0.5
+    put(26, 100) // hum threshold 1.0
+    put(28, 200) // soil threshold 2.0
+    put(30, 1000)
+    put(32, 41000)
+    put(34, 16000)
+    put(36, 42000)
+    put(38, 17000)
+    if len(b) >= 44 {
+        b[40], b[41], b[42] = filterEMA, 5, 8
+    }
+    if len(b) >= 50 {
+        b[44], b[45], b[46], b[47], b[48] = 60, 0, 25, 1, 3
+    }
+    return b
+}
+
+func TestLoadSettingsOldVersions(t *testing.T) {
+    def := defaultSettings()
+    tests := []struct {
+        version byte
+        check   func(t *testing.T, st settings)
+    }{
+        {'1', func(t *testing.T, st settings) {
+            if st.soil[0] != (SoilCalibration{Dry: 40000, Wet: 15000}) {
+                t.Errorf("soil = %+v", st.soil[0])
+            }
+            if st.pump != def.pump || st.keepalive != def.keepalive {
+                t.Errorf("v1 must keep default pump guard and keepalive, got %+v %v", st.pump, st.keepalive)
+            }
+        }},
+        {'2', func(t *testing.T, st settings) {
+            if st.pump != (PumpGuard{MaxOn: 2 * time.Minute, MinOff: 30 * time.Second}) {
+                t.Errorf("pump = %+v", st.pump)
+            }
+            if st.fallback != def.fallback {
+                t.Errorf("v2 must keep default fallback, got %+v", st.fallback)
+            }
+        }},
+        {'3', func(t *testing.T, st settings) {
+            want := FallbackPolicy{After: 5 * time.Minute, SoilLow: 20, SoilHigh: 70, LightOn: 7 * 60, LightOff: 19 * 60, LightDuty: 50}
+            if st.fallback != want {
+                t.Errorf("fallback = %+v, want %+v", st.fallback, want)
+            }
+        }},
+        {'4', func(t *testing.T, st settings) {
+            if st.keepalive != 30*time.Second {
+                t.Errorf("keepalive = %v", st.keepalive)
+            }
+            if st.tempThreshold != def.tempThreshold || st.loop != def.loop {
+                t.Errorf("v4 must keep default thresholds, got %v %v", st.tempThreshold, st.loop)
+            }
+        }},
+        {'5', func(t *testing.T, st settings) {
+            if st.tempThreshold != 0.5 || st.humThreshold != 1 || st.soilThreshold != 2 || st.loop != time.Second {
+                t.Errorf("thresholds = %v %v %v loop %v", st.tempThreshold, st.humThreshold, st.soilThreshold, st.loop)
+            }
+            if st.soil[1] != defaultSoilCalibration {
+                t.Errorf("v5 must keep default calibration for probe 2, got %+v", st.soil[1])
+            }
+        }},
+        {'6', func(t *testing.T, st settings) {
+            if st.soil[1] != (SoilCalibration{Dry: 41000, Wet: 16000}) || st.soil[2] != (SoilCalibration{Dry: 42000, Wet: 17000}) {
+                t.Errorf("soil = %+v", st.soil)
+            }
+        }},
+        {'7', func(t *testing.T, st settings) {
+            if st.filter != (ADCFilter{Mode: filterEMA, Samples: 5, EMAWindow: 8}) {
+                t.Errorf("filter = %+v", st.filter)
+            }
+            if st.actuatorsSaved || st.restore != def.restore {
+                t.Errorf("v7 has no actuator values, got saved=%v restore=%+v", st.actuatorsSaved, st.restore)
+            }
+        }},
+        {'8', func(t *testing.T, st settings) {
+            want := ActuatorState{Lights: [3]uint8{60, 0, 25}, Relays: 1}
+            if !st.actuatorsSaved || st.actuators != want {
+                t.Errorf("actuators = %+v (saved %v), want %+v", st.actuators, st.actuatorsSaved, want)
+            }
+            if st.restore != (RestorePolicy{Lights: true, Relays: true}) {
+                t.Errorf("restore = %+v", st.restore)
+            }
+        }},
+    }
+    for _, tt := range tests {
+        t.Run(string(tt.version), func(t *testing.T) {
+            s := &FakeStorage{}
+            writeRecord(t, s, 0, oldRecord(tt.version))
+            st, err := loadSettings(s)
+            if err != nil {
+                t.Fatalf("loadSettings: %v", err)
+            }
+            if st.gen != 0 {
+                t.Errorf("gen = %d, want 0 for a version %c record", st.gen, tt.version)
+            }
+            tt.check(t, st)
+        })
+    }
+}
+
+func TestSoilCalibrationPercent(t *testing.T) {
+    tests := []struct {
+        cal  SoilCalibration
+        raw  uint16
+        want float64
+    }{
+        {defaultSoilCalibration, 0, 100},
+        {defaultSoilCalibration, 65535, 0},
+        {SoilCalibration{Dry: 40000, Wet: 20000}, 30000, 50},
+        {SoilCalibration{Dry: 40000, Wet: 20000}, 45000, 0},
+        {SoilCalibration{Dry: 40000, Wet: 20000}, 10000, 100},
+        // probe ที่ค่าเพิ่มเมื่อดินชื้น
+        {SoilCalibration{Dry: 20000, Wet: 40000}, 25000, 25},
+    }
+    for _, tt := range tests {
+        if got := tt.cal.Percent(tt.raw); got != tt.want {
+            t.Errorf("%+v.Percent(%d) = %v, want %v", tt.cal, tt.raw, got, tt.want)
+        }
+    }
+}
+
+func TestLoadSettingsRejectsBadRecords(t *testing.T) {
+    tests := []struct {
+        name string
+        fill func(t *testing.T, s *FakeStorage)
+    }{
+        {"erased", func(t *testing.T, s *FakeStorage) {}},
+        {"unknown version", func(t *testing.T, s *FakeStorage) {
+            b := oldRecord('8')
+            b[3] = 'z'
+            writeRecord(t, s, 0, b)
+        }},
+        {"bad crc", func(t *testing.T, s *FakeStorage) {
+            writeRecord(t, s, 0, oldRecord('8'))
+            s.WriteAt([]byte{0}, 10)
+        }},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            s := &FakeStorage{}
+            tt.fill(t, s)
+            st, err := loadSettings(s)
+            if err != errBadSettings {
+                t.Fatalf("err = %v, want errBadSettings", err)
+            }
+            if st != defaultSettings() {
+                t.Fatalf("settings = %+v, want defaults", st)
+            }
+        })
+    }
+}
+
+func TestLoadSettingsLoopOutOfRange(t *testing.T) {
+    for _, ms := range []uint16{0, minLoopMs - 1, maxLoopMs + 1, 65535} {
+        s := &FakeStorage{}
+        b := oldRecord('5')
+        binary.LittleEndian.PutUint16(b[30:32], ms)
+        writeRecord(t, s, 0, b)
+        st, err := loadSettings(s)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if st.loop != LoopPeriod {
+            t.Errorf("loop_ms %d loaded as %v, want %v", ms, st.loop, LoopPeriod)
+        }
+    }
+}
+
+func TestSaveSettingsRoundTrip(t *testing.T) {
+    s := &FakeStorage{}
+    st := defaultSettings()
+    st.soil[2] = SoilCalibration{Dry: 50000, Wet: 20000}
+    st.pump.MaxOn = 90 * time.Second
+    st.keepalive = 15 * time.Second
+    st.filter.Mode = filterMean
+    st.restore.Relays = true
+    st.actuators = ActuatorState{Lights: [3]uint8{10, 20, 30}, Relays: 1}
+    st.actuatorsSaved = true
+    st.soilThreshold = 1.5
+
+    if err := saveSettings(s, &st); err != nil {
+        t.Fatal(err)
+    }
+    got, err := loadSettings(s)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got != st {
+        t.Fatalf("loaded %+v\nwant   %+v", got, st)
+    }
+}
+
+func TestSoilCalibrationSurvivesReboot(t *testing.T) {
+    flash := &FakeStorage{}
+    r := newTestRig(t, flash)
+    if got := r.command(t, 1, "soilcal:40000,15000"); got.Type != protocol.TypeAck || got.Payload != "soil1 dry=40000 wet=15000" {
+        t.Fatalf("soilcal => %s %q", got.Type, got.Payload)
+    }
+    if got := r.command(t, 2, "soilcal:5,5"); got.Type != protocol.TypeErr {
+        t.Fatalf("soilcal with dry == wet => %s %q, want err", got.Type, got.Payload)
+    }
+
+    // บอร์ดใหม่ที่ใช้ flash เดิม = รีบูต
+    r = newTestRig(t, flash)
+    if got := r.command(t, 3, "soilcal"); got.Payload != "soil1 dry=40000 wet=15000" {
+        t.Fatalf("after reboot soilcal = %q", got.Payload)
+    }
+}
+
+func TestSaveSettingsAlternatesSlots(t *testing.T) {
+    s := &FakeStorage{}
+    // บันทึก version เก่าอยู่ใน slot 0 = generation 0
+    writeRecord(t, s, 0, oldRecord('8'))
+    st, err := loadSettings(s)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    for i := 1; i <= 3; i++ {
+        st.keepalive = time.Duration(i) * time.Second
+        if err := saveSettings(s, &st); err != nil {
+            t.Fatal(err)
+        }
+        if st.gen != uint32(i) {
+            t.Fatalf("gen = %d after save %d", st.gen, i)
+        }
+        got, err := loadSettings(s)
+        if err != nil || got.keepalive != st.keepalive {
+            t.Fatalf("after save %d: keepalive %v err %v", i, got.keepalive, err)
+        }
+        // อีก slot ยังเป็นบันทึกก่อนหน้าที่ใช้ได้
+        prev, err := loadSlot(s, int64((i+1)%2))
+        if err != nil || prev.gen != uint32(i-1) {
+            t.Fatalf("after save %d: other slot gen %d err %v", i, prev.gen, err)
+        }
+    }
+
+    // ไฟตกระหว่างเขียน generation 4 (slot 0): ลบแล้วแต่เขียนได้ครึ่งเดียว => ใช้ generation 3
+    if err := s.EraseBlocks(0, 1); err != nil {
+        t.Fatal(err)
+    }
+    s.WriteAt([]byte(settingsMagic+string(rune(settingsVersion))+"\x01\x02"), 0)
+    got, err := loadSettings(s)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got.gen != 3 || got.keepalive != 3*time.Second {
+        t.Fatalf("after torn write: gen %d keepalive %v, want gen 3 keepalive 3s", got.gen, got.keepalive)
+    }
+}
+
+// countingStorage นับจำนวนครั้งที่ลบ flash
+type countingStorage struct {
+    *FakeStorage
+    erases int
+}
+
+func (s *countingStorage) EraseBlocks(start, length int64) error {
+    s.erases++
+    return s.FakeStorage.EraseBlocks(start, length)
+}
+
+func TestActuatorSaveIsDebounced(t *testing.T) {
+    flash := &countingStorage{FakeStorage: &FakeStorage{}}
+    r := newTestRig(t, flash)
+
+    // เลื่อน slider ทีละขั้น => ยังไม่เขียน
+    for v := 1; v <= 20; v++ {
+        r.command(t, uint16(v), "light13:"+strconv.Itoa(v))
+    }
+    r.runFor(t, actuatorSaveDelay/2)
+    if flash.erases != 0 {
+        t.Fatalf("%d erases while the value is still changing, want 0", flash.erases)
+    }
+    r.runFor(t, actuatorSaveDelay)
+    if flash.erases != 1 {
+        t.Fatalf("%d erases after the value settled, want 1", flash.erases)
+    }
+    r.runFor(t, 3*actuatorSaveDelay)
+    if flash.erases != 1 {
+        t.Fatalf("%d erases with nothing changed, want 1", flash.erases)
+    }
+
+    st, err := loadSettings(flash)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if st.actuators.Lights[0] != 20 || !st.actuatorsSaved {
+        t.Fatalf("saved lights = %v (saved %v), want light13 = 20", st.actuators.Lights, st.actuatorsSaved)
+    }
+}
+
+// brokenStorage เขียน flash ไม่ได้ตั้งแต่ broken = true
+type brokenStorage struct {
+    *FakeStorage
+    broken bool
+}
+
+func (s *brokenStorage) EraseBlocks(start, length int64) error {
+    if s.broken {
+        return errors.New("flash broken")
+    }
+    return s.FakeStorage.EraseBlocks(start, length)
+}
+
+func TestConfigSetKeepsOldValueOnFlashError(t *testing.T) {
+    flash := &brokenStorage{FakeStorage: &FakeStorage{}}
+    r := newTestRig(t, flash)
+    before := r.command(t, 1, "config:get").Payload
+    flash.broken = true
+
+    for i, cmd := range []string{"config:set:loop_ms=200", "config:set:keepalive_s=5", "config:set:fallback_light_on=06:30"} {
+        if got := r.command(t, uint16(10+i), cmd); got.Type != protocol.TypeErr || got.Payload != "flash error" {
+            t.Errorf("%q => %s %q, want err \"flash error\"", cmd, got.Type, got.Payload)
+        }
+    }
+    if after := r.command(t, 2, "config:get").Payload; after != before {
+        t.Errorf("config after failed saves = %s\nwant %s", after, before)
+    }
+}
@@ -0,0 +1,160 @@
+//go:build !tinygo
+
+package main
+
+import (
+    "fmt"
+    "sort"
+    "sync"
+    "time"
+)
+
+// ค้นหา Pico ที่เพิ่งเสียบทุกๆ ช่วงนี้ (เมื่อไม่ได้กำหนดพอร์ตเอง)
+const discoverInterval = 3 * time.Second
+
+// gateway ดูแล Pico หลายตัว ตัวละหนึ่ง serialLink
+//   - กำหนดพอร์ตเอง (-serial a,b,c) => ต่อเฉพาะพอร์ตเหล่านั้น
+//   - ไม่กำหนด => ค้นหาพอร์ตใหม่เรื่อยๆ ด้วย findSerialPorts() เสียบเพิ่มตอนไหนก็ได้
+//
+// แต่ละตัวมี registry ของตัวเอง อ้างอิงด้วย id จาก hello (หรือชื่อพอร์ตถ้าเป็น firmware รุ่นเก่า)
+type gateway struct {
+    fixed   []string
+    capture *captureFile
+
+    mu      sync.Mutex
+    links   map[string]*serialLink // key = ชื่อพอร์ต
+    stopped bool
+
+    // ค่าที่ต้องการของ device ที่ถูกถอดไป (key = id) คืนให้ตอนเสียบกลับมา แม้จะคนละพอร์ต
+    saved map[string]map[string]int
+}
+
+func newGateway(ports []string) *gateway {
+    return &gateway{fixed: ports, links: make(map[string]*serialLink), saved: make(map[string]map[string]int)}
+}
+
+// add เพิ่ม link ที่สร้างไว้แล้ว (emulator, replay) เข้า gateway
+func (g *gateway) add(l *serialLink) {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    if l.capture == nil {
+        l.capture = g.capture
+    }
+    g.links[l.portName] = l
+}
+
+// run เริ่ม link ทุกตัวที่ add ไว้ แล้วต่อพอร์ตที่กำหนด หรือค้นหาพอร์ตไปเรื่อยๆ จนกว่าจะ stop()
+func (g *gateway) run() {
+    g.mu.Lock()
+    for _, l := range g.links {
+        go l.run()
+    }
+    g.mu.Unlock()
+
+    if len(g.fixed) > 0 {
+        for _, name := range g.fixed {
+            g.start(newSerialLink(name))
+        }
+        return
+    }
+    if g.hasLinks() {
+        // emulator: ไม่ต้องค้นหาพอร์ตจริง
+        return
+    }
+    for !g.isStopped() {
+        for _, name := range findSerialPorts() {
+            if !g.hasPort(name) {
+                l := newSerialLink(name)
+                l.discovered = true
+                g.start(l)
+            }
+        }
+        time.Sleep(discoverInterval)
+    }
+}
+
+// start เพิ่ม link แล้วรันจนกว่า link จะจบ (พอร์ตที่ค้นเจอถูกถอด) จากนั้นเอาออก
+func (g *gateway) start(l *serialLink) {
+    g.add(l)
+    fmt.Println("Device port added:", l.portName)
+    l.registry.subscribe(func(c capabilities) {
+        g.mu.Lock()
+        desired := g.saved[c.DeviceID]
+        delete(g.saved, c.DeviceID)
+        g.mu.Unlock()
+        if desired != nil {
+            l.registry.restoreDesired(desired)
+        }
+    })
+    go func() {
+        l.run()
+        g.mu.Lock()
+        if g.links[l.portName] == l {
+            delete(g.links, l.portName)
+        }
+        if id := l.registry.capabilities().DeviceID; id != "" {
+            g.saved[id] = l.registry.desiredSnapshot()
+        }
+        g.mu.Unlock()
+        fmt.Println("Device port removed:", l.portName)
+    }()
+}
+
+func (g *gateway) hasPort(name string) bool {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    _, ok := g.links[name]
+    return ok
+}
+
+func (g *gateway) hasLinks() bool {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    return len(g.links) > 0
+}
+
+// devices คืน link ทั้งหมดเรียงตาม id
+func (g *gateway) devices() []*serialLink {
+    g.mu.Lock()
+    out := make([]*serialLink, 0, len(g.links))
+    for _, l := range g.links {
+        out = append(out, l)
+    }
+    g.mu.Unlock()
+    sort.Slice(out, func(i, j int) bool { return out[i].id() < out[j].id() })
+    return out
+}
+
+// device หา link จาก id ของ device (หรือชื่อพอร์ต)
+func (g *gateway) device(id string) (*serialLink, bool) {
+    for _, l := range g.devices() {
+        if l.id() == id || l.portName == id {
+            return l, true
+        }
+    }
+    return nil, false
+}
+
+// defaultDevice คือตัวแรกตาม id ใช้กับ route เดิมที่ไม่ระบุ device
+func (g *gateway) defaultDevice() (*serialLink, bool) {
+    devs := g.devices()
+    if len(devs) == 0 {
+        return nil, false
+    }
+    return devs[0], true
+}
+
+func (g *gateway) isStopped() bool {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    return g.stopped
+}
+
+func (g *gateway) stop() {
+    g.mu.Lock()
+    g.stopped = true
+    g.mu.Unlock()
+    for _, l := range g.devices() {
+        l.stop()
+    }
+}
@@ -0,0 +1,102 @@
+//go:build !tinygo
+
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/gorilla/mux"
+
+    "smart_farm/emulator"
+)
+
+// startTestGateway ตั้ง picoGateway เป็น Pico จำลองตาม ids (เหมือน -emulate) แล้วรอจนได้ hello ครบ
+func startTestGateway(t *testing.T, ids ...string) *gateway {
+    t.Helper()
+    g := newGateway(nil)
+    for i, id := range ids {
+        g.add(newEmulatedLink(id, emulator.Config{Seed: int64(i + 1), DeviceID: id}))
+    }
+    old := picoGateway
+    picoGateway = g
+    go g.run()
+    t.Cleanup(func() {
+        g.stop()
+        picoGateway = old
+    })
+    for _, id := range ids {
+        waitFor(t, "hello from "+id, func() bool {
+            for _, l := range g.devices() {
+                if l.registry.capabilities().DeviceID == id {
+                    return true
+                }
+            }
+            return false
+        })
+    }
+    return g
+}
+
+// control ส่ง POST /devices/{id}/control-{name} ผ่าน router แบบเดียวกับ main
+func control(id, name, body string) *httptest.ResponseRecorder {
+    router := mux.NewRouter()
+    router.HandleFunc("/devices/{id}/control-{name}", controlActuator).Methods("POST")
+    w := httptest.NewRecorder()
+    router.ServeHTTP(w, httptest.NewRequest("POST", "/devices/"+id+"/control-"+name, strings.NewReader(body)))
+    return w
+}
+
+func TestGatewayKeepsDevicesApart(t *testing.T) {
+    g := startTestGateway(t, "emulator-1", "emulator-2")
+
+    devs := g.devices()
+    if len(devs) != 2 || devs[0].id() != "emulator-1" || devs[1].id() != "emulator-2" {
+        ids := []string{}
+        for _, l := range devs {
+            ids = append(ids, l.id())
+        }
+        t.Fatalf("devices = %v, want emulator-1 and emulator-2", ids)
+    }
+    for _, l := range devs {
+        if got, ok := g.device(l.id()); !ok || got != l {
+            t.Errorf("device(%q) does not find its own link", l.id())
+        }
+    }
+    if def, _ := g.defaultDevice(); def != devs[0] {
+        t.Errorf("default device is %s, want emulator-1", def.id())
+    }
+
+    if w := control("emulator-2", "light13", `{"brightness":70}`); w.Code != http.StatusOK {
+        t.Fatalf("control emulator-2: HTTP %d %s", w.Code, w.Body.String())
+    }
+    if got := devs[1].registry.stateOf("light13"); got != 70 {
+        t.Errorf("emulator-2 light13 = %d, want 70", got)
+    }
+    if got := devs[0].registry.stateOf("light13"); got != 0 {
+        t.Errorf("emulator-1 light13 = %d, want 0 (command went to the wrong device)", got)
+    }
+}
+
+func TestGatewayControlOfflineDevice(t *testing.T) {
+    g := startTestGateway(t, "emulator-1")
+
+    // Pico ที่รู้จักแต่ไม่ได้เสียบอยู่ (add แต่ไม่ run)
+    offline := newSerialLink(filepath.Join(t.TempDir(), "ttyACM9"))
+    offline.queue.retryDelay = time.Millisecond
+    g.add(offline)
+
+    if w := control("ttyACM9", "pump", `{"command":"on"}`); w.Code != http.StatusServiceUnavailable {
+        t.Errorf("control offline device: HTTP %d %s, want 503", w.Code, w.Body.String())
+    }
+    if w := control("ttyACM7", "pump", `{"command":"on"}`); w.Code != http.StatusNotFound {
+        t.Errorf("control unknown device: HTTP %d, want 404", w.Code)
+    }
+    if w := control("emulator-1", "pump", `{"command":"on"}`); w.Code != http.StatusOK {
+        t.Errorf("control online device: HTTP %d %s", w.Code, w.Body.String())
+    }
+}
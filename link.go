@@ -0,0 +1,253 @@
+//go:build !tinygo
+
+package main
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+
+    "github.com/tarm/serial"
+
+    "smart_farm/emulator"
+)
+
+const (
+    serialBaud        = 115200
+    serialReadTimeout = 2 * time.Second
+    reconnectMinDelay = time.Second
+    reconnectMaxDelay = 30 * time.Second
+)
+
+var errDeviceOffline = errors.New("device offline")
+
+// serialLink คือ Pico หนึ่งตัวบนพอร์ตหนึ่ง ดูแลการเชื่อมต่อ:
+// เปิดพอร์ต => อ่านจนหลุด => ปิด => รอ (backoff) => เปิดใหม่
+// ระหว่างที่หลุด session() จะคืน errDeviceOffline แต่ HTTP/GUI ยังทำงานต่อได้
+type serialLink struct {
+    portName string
+
+    // true = gateway เจอพอร์ตนี้เอง ถ้า device node หายไป link จะจบ (เสียบใหม่จะถูกค้นเจออีกครั้ง)
+    discovered bool
+
+    // ถ้าไม่ใช่ nil จะต่อกับ Pico จำลองแทนพอร์ตจริง
+    emulate *emulator.Config
+
+    // ถ้าไม่ใช่ nil จะบันทึกทุกบรรทัดที่อ่าน/เขียนลงไฟล์ capture
+    capture *captureFile
+
+    // sensor/actuator และสถานะของ Pico ตัวนี้
+    registry *deviceRegistry
+
+    // คำสั่งตั้งค่า actuator ที่รอส่ง/ส่งซ้ำ
+    queue *commandQueue
+
+    // frame log ล่าสุดจาก Pico ตัวนี้
+    logs *deviceLog
+
+    // เวลาจริงของ frame, frame ที่หาย และการ reset จาก seq/uptime_ms (devicetime.go)
+    clock *deviceClock
+
+    mu       sync.Mutex
+    sess     *serialSession
+    openPort string
+    lastErr  error
+    stopped  bool
+}
+
+func newSerialLink(portName string) *serialLink {
+    l := &serialLink{portName: portName, registry: newDeviceRegistry(), logs: newDeviceLog(), clock: newDeviceClock()}
+    l.queue = newCommandQueue(l)
+    return l
+}
+
+// newEmulatedLink ต่อกับ Pico จำลอง (package emulator) ผ่านท่อในหน่วยความจำ
+func newEmulatedLink(name string, cfg emulator.Config) *serialLink {
+    l := newSerialLink(name)
+    l.emulate = &cfg
+    return l
+}
+
+// id ของ device: ใช้ id จาก hello ถ้ามี ไม่งั้น (firmware รุ่นเก่า) ใช้ชื่อพอร์ต
+func (l *serialLink) id() string {
+    if id := l.registry.capabilities().DeviceID; id != "" {
+        return id
+    }
+    return filepath.Base(l.portName)
+}
+
+// run วนเชื่อมต่อไปเรื่อยๆ จนกว่าจะ stop() หรือพอร์ตที่ค้นเจอถูกถอดออก
+func (l *serialLink) run() {
+    delay := reconnectMinDelay
+    for !l.isStopped() {
+        name, port, err := l.open()
+        if err != nil {
+            l.setOffline(err)
+            if l.discovered && !portExists(l.portName) {
+                return
+            }
+            fmt.Printf("Serial: %v (retry in %v)\n", err, delay)
+            time.Sleep(delay)
+            delay *= 2
+            if delay > reconnectMaxDelay {
+                delay = reconnectMaxDelay
+            }
+            continue
+        }
+        delay = reconnectMinDelay
+
+        if l.capture != nil {
+            l.capture.record(name, captureOpen, name)
+            port = newRecordingPort(name, port, l.capture)
+        }
+        sess := newSerialSession(port, l)
+        l.setOnline(name, sess)
+        fmt.Println("Serial opened:", name)
+
+        // ถ้า device node หายไป (ถอดสาย) ให้ปิดพอร์ตเพื่อให้ readLoop หลุดออกมา
+        done := make(chan struct{})
+        if l.emulate == nil {
+            go watchPortPath(name, sess, done)
+        }
+        go func() {
+            handshake(sess)
+            go heartbeatLoop(sess)
+            stateSyncLoop(sess)
+        }()
+
+        err = sess.readLoop()
+        close(done)
+        sess.close()
+        l.setOffline(err)
+        fmt.Println("Serial lost:", name, err)
+        if l.capture != nil {
+            l.capture.record(name, captureLost, fmt.Sprintf("%s: %v", name, err))
+        }
+    }
+}
+
+func (l *serialLink) open() (string, io.ReadWriteCloser, error) {
+    if l.emulate != nil {
+        return l.portName, emulator.Pipe(*l.emulate), nil
+    }
+    cfg := &serial.Config{Name: l.portName, Baud: serialBaud, ReadTimeout: serialReadTimeout}
+    port, err := serial.OpenPort(cfg)
+    if err != nil {
+        return "", nil, fmt.Errorf("open %s: %w", l.portName, err)
+    }
+    return l.portName, port, nil
+}
+
+func portExists(name string) bool {
+    _, err := os.Stat(name)
+    return err == nil
+}
+
+func watchPortPath(name string, sess *serialSession, done chan struct{}) {
+    ticker := time.NewTicker(time.Second)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-done:
+            return
+        case <-ticker.C:
+            if !portExists(name) {
+                sess.close()
+                return
+            }
+        }
+    }
+}
+
+func (l *serialLink) setOnline(name string, sess *serialSession) {
+    l.mu.Lock()
+    l.sess = sess
+    l.openPort = name
+    l.lastErr = nil
+    l.mu.Unlock()
+}
+
+func (l *serialLink) setOffline(err error) {
+    l.mu.Lock()
+    l.sess = nil
+    l.openPort = ""
+    l.lastErr = err
+    l.mu.Unlock()
+}
+
+// session คืน session ปัจจุบัน หรือ errDeviceOffline ถ้ายังไม่ได้เชื่อมต่อ
+func (l *serialLink) session() (*serialSession, error) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.sess == nil {
+        return nil, errDeviceOffline
+    }
+    return l.sess, nil
+}
+
+// sendCommand ส่งคำสั่งผ่าน session ปัจจุบัน
+func (l *serialLink) sendCommand(cmd string) (string, error) {
+    sess, err := l.session()
+    if err != nil {
+        return "", err
+    }
+    return sess.sendCommand(cmd)
+}
+
+// สถานะสำหรับแสดงใน API/GUI
+type linkStatus struct {
+    ID     string `json:"id"`
+    Online bool   `json:"online"`
+    Port   string `json:"port,omitempty"`
+    Error  string `json:"error,omitempty"`
+
+    // รุ่น firmware จาก hello และคำเตือนเรื่อง protocol
+    Firmware string `json:"firmware,omitempty"`
+    Commit   string `json:"commit,omitempty"`
+    Protocol int    `json:"protocol,omitempty"`
+    Warning  string `json:"warning,omitempty"`
+
+    // จาก seq/uptime_ms ในหัว frame (firmware protocol 4 ขึ้นไป)
+    BootedAt      *time.Time `json:"booted_at,omitempty"`
+    DroppedFrames int        `json:"dropped_frames"`
+    Resets        int        `json:"resets"`
+}
+
+func (l *serialLink) status() linkStatus {
+    id := l.id()
+    caps := l.registry.capabilities()
+    clock := l.clock.stats()
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    st := linkStatus{ID: id, Online: l.sess != nil, Port: l.openPort, Firmware: caps.Firmware, Commit: caps.Commit}
+    if !caps.Legacy {
+        st.Protocol = caps.protocolVersion()
+    }
+    st.Warning = caps.compatibility()
+    st.BootedAt, st.DroppedFrames, st.Resets = clock.BootedAt, clock.Dropped, clock.Resets
+    if l.sess == nil && l.lastErr != nil {
+        st.Error = l.lastErr.Error()
+    }
+    return st
+}
+
+func (l *serialLink) isStopped() bool {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return l.stopped
+}
+
+func (l *serialLink) stop() {
+    l.mu.Lock()
+    l.stopped = true
+    sess := l.sess
+    l.mu.Unlock()
+    l.queue.stop()
+    if sess != nil {
+        sess.close()
+    }
+}
@@ -1,262 +1,183 @@
+//go:build tinygo
+
 package main
 
 import (
     "fmt"
     "machine"
-    "math"
-    "strconv"
-    "strings"
-    "time"
 
+    "smart_farm/firmware"
+    "smart_farm/protocol"
     "tinygo.org/x/drivers/dht"
 )
 
-// Threshold สำหรับส่งข้อมูลเมื่อเปลี่ยนเกินค่านี้
-const (
-    tempThreshold = 0.2
-    humThreshold  = 0.5
-    soilThreshold = 1.0
+// รุ่นของ firmware ส่งใน hello และตอบคำสั่ง version
+// commit/built ฝังตอน build ด้วย -ldflags (ดู README) ถ้าไม่ใส่จะเป็น "unknown"
+var (
+    firmwareVersion = "1.2.0"
+    firmwareCommit  = ""
+    firmwareBuilt   = ""
 )
 
-// โครงสร้างสำหรับส่ง JSON 2 แบบ
-// - toJSONAir =>  {\"type\":\"air\",\"air_id\":...,\"temp\":...,\"air_humidity\":...,\"pump_status\":bool}
-// - toJSONSoil => {\"type\":\"soil\",\"soil_id\":...,\"soil_humidity\":...,\"pump_status\":bool}
+// logic ทั้งหมดอยู่ใน package firmware ไฟล์นี้แค่ต่อขาของ Pico เข้ากับ interface ใน firmware/hal.go
 
-var (
-    // Serial & Pump
-    serial = machine.Serial
-    relay1 = machine.GP3
-    relay2 = machine.GP4
-    pumpOn bool
+// ความถี่ PWM (1 kHz)
+const freqHz = uint64(1000)
 
-    // ความถี่ PWM (1 kHz)
-    freqHz = uint64(1000)
+// pwmGroup คือ method ที่ใช้ของ machine.PWM6/PWM7
+type pwmGroup interface {
+    Configure(config machine.PWMConfig) error
+    Channel(pin machine.Pin) (uint8, error)
+    Set(channel uint8, value uint32)
+    Top() uint32
+}
 
-    // PWM สำหรับไฟ: สมมติ Outer1=GPIO13, Outer2=GPIO14, Inner=GPIO15
-    pwmA  = machine.PWM6
-    pinA  = machine.GPIO13
-    chA   uint8
+// picoPWM คือช่อง PWM หนึ่งช่องบน Pico
+type picoPWM struct {
+    pwm pwmGroup
+    pin machine.Pin
+    ch  uint8
+}
 
-    pwmB = machine.PWM7
-    pinB = machine.GPIO14
-    chB  uint8
+func (p *picoPWM) SetPercent(pct uint32) {
+    p.pwm.Set(p.ch, p.pwm.Top()*pct/100)
+}
 
-    pinC = machine.GPIO15
-    chC  uint8
+// picoDHT แปลง error ของ drivers/dht เป็น firmware.SensorError
+type picoDHT struct {
+    dev dht.Device
+}
 
-    lightDuty13 uint32
-    lightDuty14 uint32
-    lightDuty15 uint32
-)
+func (d picoDHT) Measurements() (int16, uint16, error) {
+    t, h, err := d.dev.Measurements()
+    if err == nil {
+        return t, h, nil
+    }
+    kind := "read"
+    switch err {
+    case dht.NoSignalError:
+        kind = "no_signal" // สายหลุด/ผิดขา
+    case dht.NoDataError:
+        kind = "no_data"
+    case dht.ChecksumError:
+        kind = "checksum"
+    case dht.UpdateError:
+        kind = "update"
+    case dht.UninitializedDataError:
+        kind = "uninitialized"
+    }
+    return 0, 0, firmware.SensorError{Kind: kind}
+}
 
-// =============== MAIN LOOP ===============
-func main() {
-    fmt.Println("🚀 Pico multi-sensor: Air & Soil, separate JSON")
+// picoRelay คือ relay หนึ่งช่อง (active low: Low = ทำงาน) ใส่หลายขาได้ถ้าต่อขนานกัน
+type picoRelay struct {
+    pins []machine.Pin
+}
 
-    // ตั้งค่า Serial
-    serial.Configure(machine.UARTConfig{BaudRate: 115200})
+func (r *picoRelay) Set(on bool) {
+    for _, p := range r.pins {
+        p.Set(!on)
+    }
+}
 
-    // ตั้งค่า Pump (Relay)
-    relay1.Configure(machine.PinConfig{Mode: machine.PinOutput})
-    relay2.Configure(machine.PinConfig{Mode: machine.PinOutput})
-    relay1.High()
-    relay2.High()
-    pumpOn = false
+var (
+    // Serial
+    serial = machine.Serial
 
-    // ตั้งค่า PWM
-    period := uint64(1e9 / freqHz)
-    if err := pwmA.Configure(machine.PWMConfig{Period: period}); err != nil {
-        fmt.Printf("❌ PWM6 (GPIO13) error: %v\n", err)
+    // relay แยกกันทีละช่อง Water = ใช้รดน้ำ (มี pump guard และ fallback ตามความชื้นดิน)
+    // ถ้าปั๊มต่อกับ relay ทั้งสองตัว ให้ใส่ GP3 และ GP4 ใน pins ของ pump แล้วลบ relay2 ออก
+    relays = []struct {
+        name, label string
+        relay       *picoRelay
+        water       bool
+    }{
+        {"pump", "Water Pump", &picoRelay{pins: []machine.Pin{machine.GP3}}, true},
+        {"relay2", "Relay 2", &picoRelay{pins: []machine.Pin{machine.GP4}}, false},
     }
-    aCh, errA := pwmA.Channel(pinA)
-    if errA != nil {
-        fmt.Printf("❌ channel A (GPIO13) error: %v\n", errA)
-    }
-    pinA.Configure(machine.PinConfig{Mode: machine.PinPWM})
-    chA = aCh
-    pwmA.Set(chA, 0)
-    lightDuty13 = 0
 
-    if err := pwmB.Configure(machine.PWMConfig{Period: period}); err != nil {
-        fmt.Printf("❌ PWM7 error: %v\n", err)
+    // PWM สำหรับไฟ: สมมติ Outer1=GPIO13, Outer2=GPIO14, Inner=GPIO15
+    light13 = &picoPWM{pwm: machine.PWM6, pin: machine.GPIO13}
+    light14 = &picoPWM{pwm: machine.PWM7, pin: machine.GPIO14}
+    light15 = &picoPWM{pwm: machine.PWM7, pin: machine.GPIO15}
+
+    // เซ็นเซอร์แต่ละตัวกับขาที่ต่อ id คือ air_id/soil_id ใน telemetry
+    // เพิ่มแปลงได้ด้วยการเพิ่มบรรทัด (soil ใช้ได้เฉพาะขา ADC: GP26/27/28)
+    airPins = []struct {
+        id  int
+        pin machine.Pin
+    }{
+        {1, machine.GP16},
     }
-    bCh, errB := pwmB.Channel(pinB)
-    if errB != nil {
-        fmt.Printf("❌ channel B (GPIO14) error: %v\n", errB)
+    soilPins = []struct {
+        id  int
+        pin machine.Pin
+    }{
+        {1, machine.GP27},
     }
-    pinB.Configure(machine.PinConfig{Mode: machine.PinPWM})
-    chB = bCh
-    pwmB.Set(chB, 0)
-    lightDuty14 = 0
+)
 
-    cCh, errC := pwmB.Channel(pinC)
-    if errC != nil {
-        fmt.Printf("❌ channel C (GPIO15) error: %v\n", errC)
-    }
-    pinC.Configure(machine.PinConfig{Mode: machine.PinPWM})
-    chC = cCh
-    pwmB.Set(chC, 0)
-    lightDuty15 = 0
+// =============== MAIN ===============
+func main() {
+    // ตั้งค่า Serial
+    serial.Configure(machine.UARTConfig{BaudRate: 115200})
 
-    fmt.Println("✅ PWM on GPIO13,14,15 = 0% initially")
+    // ตั้งค่า Relay
+    var relayChannels []firmware.RelayChannel
+    for _, r := range relays {
+        for _, p := range r.relay.pins {
+            p.Configure(machine.PinConfig{Mode: machine.PinOutput})
+        }
+        r.relay.Set(false) // active-low: ขา Low = relay ติด ต้องปิดไว้ก่อน Boot
+        relayChannels = append(relayChannels, firmware.RelayChannel{Name: r.name, Label: r.label, Relay: r.relay, Water: r.water})
+    }
 
     // ตั้งค่าเซ็นเซอร์: DHT22 => Air, ADC => Soil
-    dhtSensor := dht.New(machine.GP16, dht.DHT22) // สมมติ GP16
+    var air []firmware.AirSensor
+    for _, a := range airPins {
+        air = append(air, firmware.AirSensor{ID: a.id, Sensor: picoDHT{dht.New(a.pin, dht.DHT22)}})
+    }
     machine.InitADC()
-    adc := machine.ADC{Pin: machine.GP27}
-    adc.Configure(machine.ADCConfig{})
-
-    var lastTemp, lastHum, lastSoil float64
-    firstReading := true
-
-    for {
-        // อ่าน DHT
-        tRaw, hRaw, dhtErr := dhtSensor.Measurements()
-        if dhtErr != nil {
-            // ถ้า error ก็ข้าม
-        }
-        newTemp := float64(tRaw) / 10.0
-        newHum  := float64(hRaw) / 10.0
-
-        // อ่าน Soil
-        soilRaw := adc.Get()
-        newSoil := float64(100 - ((float32(soilRaw) / 65535) * 100))
-
-        if firstReading {
-            // ครั้งแรก ส่ง 2 JSON เลย
-            fmt.Println(toJSONAir(1, newTemp, newHum, pumpOn))
-            fmt.Println(toJSONSoil(1, newSoil, pumpOn))
-            lastTemp = newTemp
-            lastHum  = newHum
-            lastSoil = newSoil
-            firstReading = false
-        } else {
-            // threshold แยก
-            airChanged  := changedBeyondThreshold(lastTemp, newTemp, tempThreshold) ||
-                          changedBeyondThreshold(lastHum,  newHum,  humThreshold)
-            soilChanged := changedBeyondThreshold(lastSoil, newSoil, soilThreshold)
-
-            if airChanged {
-                fmt.Println(toJSONAir(1, newTemp, newHum, pumpOn))
-                lastTemp = newTemp
-                lastHum  = newHum
-            }
-            if soilChanged {
-                fmt.Println(toJSONSoil(1, newSoil, pumpOn))
-                lastSoil = newSoil
-            }
-        }
-
-        // ถ้ามีคำสั่งจาก Serial
-        if serial.Buffered() > 0 {
-            cmd := readLine()
-            cmd = strings.TrimSpace(cmd)
-            fmt.Printf("[DEBUG] Received cmd = %q\n", cmd)
-
-            switch {
-            case cmd == "on":
-                fmt.Println("[DEBUG] relay1.Low() / relay2.Low() => Pump ON")
-                relay1.Low()
-                relay2.Low()
-                pumpOn = true
-                serial.Write([]byte("ACK: Pump ON\n"))
-
-            case cmd == "off":
-                fmt.Println("[DEBUG] relay1.High() / relay2.High() => Pump OFF")
-                relay1.High()
-                relay2.High()
-                pumpOn = false
-                serial.Write([]byte("ACK: Pump OFF\n"))
-
-            case strings.HasPrefix(cmd, "light13:"):
-                valStr := strings.TrimPrefix(cmd, "light13:")
-                val, e := strconv.Atoi(strings.TrimSpace(valStr))
-                if e == nil {
-                    lightDuty13 = clampValue(val)
-                    dutyA := pwmA.Top() * lightDuty13 / 100
-                    pwmA.Set(chA, dutyA)
-                    ack := fmt.Sprintf("ACK: light13=%d\n", val)
-                    serial.Write([]byte(ack))
-                }
-
-            case strings.HasPrefix(cmd, "light14:"):
-                valStr := strings.TrimPrefix(cmd, "light14:")
-                val, e := strconv.Atoi(strings.TrimSpace(valStr))
-                if e == nil {
-                    lightDuty14 = clampValue(val)
-                    dutyB := pwmB.Top() * lightDuty14 / 100
-                    pwmB.Set(chB, dutyB)
-                    ack := fmt.Sprintf("ACK: light14=%d\n", val)
-                    serial.Write([]byte(ack))
-                }
-
-            case strings.HasPrefix(cmd, "light15:"):
-                valStr := strings.TrimPrefix(cmd, "light15:")
-                val, e := strconv.Atoi(strings.TrimSpace(valStr))
-                if e == nil {
-                    lightDuty15 = clampValue(val)
-                    dutyC := pwmB.Top() * lightDuty15 / 100
-                    pwmB.Set(chC, dutyC)
-                    ack := fmt.Sprintf("ACK: light15=%d\n", val)
-                    serial.Write([]byte(ack))
-                }
-
-            default:
-                serial.Write([]byte("ERR: Unknown\n"))
-            }
-        }
-
-        time.Sleep(500 * time.Millisecond)
+    var soil []firmware.SoilProbe
+    for _, s := range soilPins {
+        adc := machine.ADC{Pin: s.pin}
+        adc.Configure(machine.ADCConfig{})
+        soil = append(soil, firmware.SoilProbe{ID: s.id, ADC: adc})
     }
-}
-
-// =============== ฟังก์ชัน JSON แยก ===============
-func toJSONAir(airID int, temp, hum float64, pumpStatus bool) string {
-    // type=air , air_id=??
-    return fmt.Sprintf(`{"type":"air","air_id":%d,"temp":%.1f,"air_humidity":%.1f,"pump_status":%t}`,
-        airID, temp, hum, pumpStatus)
-}
-
-func toJSONSoil(soilID int, soil float64, pumpStatus bool) string {
-    // type=soil , soil_id=??
-    return fmt.Sprintf(`{"type":"soil","soil_id":%d,"soil_humidity":%.1f,"pump_status":%t}`,
-        soilID, soil, pumpStatus)
-}
-
-// ตรวจ threshold
-func changedBeyondThreshold(oldVal, newVal, threshold float64) bool {
-    return math.Abs(newVal-oldVal) > threshold
-}
 
-// อ่านทีละไบต์จนเจอ '\\n'
-func readLine() string {
-    buf := make([]byte, 32)
-    i := 0
-    for {
-        if serial.Buffered() == 0 {
-            time.Sleep(10 * time.Millisecond)
-            if serial.Buffered() == 0 {
-                break
-            }
-        }
-        b, err := serial.ReadByte()
+    fw := firmware.New(firmware.Board{
+        Serial:   serial,
+        Relays:   relayChannels,
+        Light13:  light13,
+        Light14:  light14,
+        Light15:  light15,
+        Air:      air,
+        Soil:     soil,
+        Clock:    firmware.SystemClock{},
+        Storage:  machine.Flash, // calibration ของ soil
+        Version:  firmwareVersion,
+        Commit:   firmwareCommit,
+        Built:    firmwareBuilt,
+        DeviceID: fmt.Sprintf("pico-%x", machine.DeviceID()),
+    })
+    fw.Logf(protocol.LevelInfo, "🚀 Pico multi-sensor: Air & Soil, separate JSON")
+
+    // ตั้งค่า PWM (GPIO14/15 ใช้ slice PWM7 ร่วมกัน configure ครั้งเดียว)
+    period := uint64(1e9 / freqHz)
+    if err := machine.PWM6.Configure(machine.PWMConfig{Period: period}); err != nil {
+        fw.Logf(protocol.LevelError, "❌ PWM6 (GPIO13) error: %v", err)
+    }
+    if err := machine.PWM7.Configure(machine.PWMConfig{Period: period}); err != nil {
+        fw.Logf(protocol.LevelError, "❌ PWM7 error: %v", err)
+    }
+    for _, l := range []*picoPWM{light13, light14, light15} {
+        ch, err := l.pwm.Channel(l.pin)
         if err != nil {
-            break
-        }
-        if b == '\n' || i >= len(buf)-1 {
-            break
+            fw.Logf(protocol.LevelError, "❌ channel GPIO%d error: %v", l.pin, err)
         }
-        buf[i] = b
-        i++
+        l.pin.Configure(machine.PinConfig{Mode: machine.PinPWM})
+        l.ch = ch
     }
-    return string(buf[:i])
-}
 
-func clampValue(v int) uint32 {
-    if v < 0 {
-        return 0
-    } else if v > 100 {
-        return 100
-    }
-    return uint32(v)
-}
\ No newline at end of file
+    fw.Boot()
+    fw.Run()
+}
@@ -0,0 +1,52 @@
+//go:build !tinygo
+
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+)
+
+// USB VID:PID ของ Pico ที่รองรับ (VID 2e8a = Raspberry Pi)
+var picoUSBIDs = map[string]bool{
+    "2e8a:000a": true, // Pico SDK / TinyGo USB CDC
+    "2e8a:0005": true, // MicroPython
+}
+
+// findSerialPorts หา tty ที่เป็น Pico จาก sysfs โดยดู idVendor ของ USB device
+func findSerialPorts() []string {
+    entries, err := os.ReadDir("/sys/class/tty")
+    if err != nil {
+        return nil
+    }
+    var ports []string
+    for _, e := range entries {
+        dev, err := filepath.EvalSymlinks(filepath.Join("/sys/class/tty", e.Name(), "device"))
+        if err != nil {
+            continue // tty เสมือน ไม่มี device
+        }
+        vid, pid := usbIDs(dev)
+        if !picoUSBIDs[vid+":"+pid] {
+            continue
+        }
+        ports = append(ports, "/dev/"+e.Name())
+    }
+    sort.Strings(ports)
+    return ports
+}
+
+// device ของ tty คือ USB interface (เช่น 1-1:1.0) ส่วน idVendor/idProduct
+// อยู่ที่ USB device ซึ่งเป็น parent ขึ้นไปไม่กี่ชั้น
+func usbIDs(dev string) (vid, pid string) {
+    for i := 0; i < 4 && dev != "/" && dev != "."; i++ {
+        v, err := os.ReadFile(filepath.Join(dev, "idVendor"))
+        if err == nil {
+            p, _ := os.ReadFile(filepath.Join(dev, "idProduct"))
+            return strings.TrimSpace(string(v)), strings.TrimSpace(string(p))
+        }
+        dev = filepath.Dir(dev)
+    }
+    return "", ""
+}
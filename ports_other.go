@@ -0,0 +1,15 @@
+//go:build !linux && !tinygo
+
+package main
+
+import (
+    "path/filepath"
+    "sort"
+)
+
+// findSerialPorts บน macOS ไม่มี sysfs => ใช้ชื่อ device ที่ Pico ได้เสมอ
+func findSerialPorts() []string {
+    ports, _ := filepath.Glob("/dev/tty.usbmodem*")
+    sort.Strings(ports)
+    return ports
+}
@@ -0,0 +1,146 @@
+// Package protocol คือรูปแบบ frame ที่ Pico กับ server ใช้คุยกันผ่าน Serial
+// (ใช้ร่วมกันทั้ง firmware ที่ build ด้วย TinyGo และ server)
+//
+// หนึ่ง frame = หนึ่งบรรทัด:
+//
+//      $<id>,<type>,<payload>*<crc>
+//      $<id>:<seq>:<uptime_ms>,<type>,<payload>*<crc>   (frame จาก Pico ตั้งแต่ protocol 4)
+//
+//    - id      เลขข้อความ 0..65535 (ACK/ERR จะใช้ id เดียวกับคำสั่งที่ตอบ)
+//    - seq     ลำดับของทุก frame ที่ Pico ส่ง เริ่มที่ 1 ทุกครั้งที่ boot (server ใช้หา frame ที่หาย/reset)
+//    - uptime_ms เวลาบนนาฬิกาของ Pico ตอนส่ง (server ใช้คำนวณเวลาจริงของค่าที่วัด)
+//    - type    ชนิด frame เช่น cmd, ack, err, data
+//    - payload ข้อความอิสระ (telemetry เป็น JSON)
+//    - crc     CRC-16/CCITT-FALSE ของทุกไบต์ระหว่าง '$' กับ '*' เป็น hex 4 หลัก
+//
+// บรรทัดที่ไม่ขึ้นต้นด้วย '$' คือรูปแบบเดิม (JSON เปล่าๆ / "ACK: ...")
+package protocol
+
+import (
+    "errors"
+    "strconv"
+    "strings"
+)
+
+// ชนิดของ frame
+const (
+    TypeCommand = "cmd"    // server -> Pico
+    TypeAck     = "ack"    // Pico -> server ทำคำสั่งสำเร็จ
+    TypeErr     = "err"    // Pico -> server คำสั่งผิด/ทำไม่ได้
+    TypeData    = "data"   // Pico -> server telemetry (JSON)
+    TypeHello   = "hello"  // Pico -> server รุ่น firmware + sensor/actuator ที่มี (JSON)
+    TypeStatus  = "status" // Pico -> server ค่าปัจจุบันของ actuator ทุกตัว (JSON)
+    TypeLog     = "log"    // Pico -> server ข้อความ debug/สถานะ "<level>,<message>" (ดู log.go)
+    TypeHealth  = "health" // Pico -> server sensor อ่านไม่ได้/กลับมาอ่านได้ (JSON)
+    TypeEvent   = "event"  // Pico -> server เหตุการณ์ที่ firmware ทำเอง เช่น pump_timeout (JSON)
+    TypeBoot    = "boot"   // Pico -> server หลัง boot: ค่า actuator ที่คืนจาก flash (JSON)
+)
+
+const (
+    frameStart = '$'
+    crcMark    = '*'
+)
+
+var (
+    ErrMalformed = errors.New("malformed frame")
+    ErrChecksum  = errors.New("frame checksum mismatch")
+)
+
+type Frame struct {
+    ID      uint16
+    Type    string
+    Payload string
+
+    // Seq = 0 => frame ไม่มี seq/uptime_ms (คำสั่งจาก server, firmware ก่อน protocol 4)
+    Seq      uint32
+    UptimeMs uint64
+}
+
+// IsFrame บอกว่าบรรทัดนี้เป็น frame แบบใหม่หรือไม่
+func IsFrame(line string) bool {
+    return len(line) > 0 && line[0] == frameStart
+}
+
+// Encode คืนค่า frame เป็นข้อความหนึ่งบรรทัด (ไม่รวม '\n')
+func (f Frame) Encode() string {
+    head := strconv.Itoa(int(f.ID))
+    if f.Seq != 0 {
+        head += ":" + strconv.FormatUint(uint64(f.Seq), 10) + ":" + strconv.FormatUint(f.UptimeMs, 10)
+    }
+    body := head + "," + f.Type + "," + f.Payload
+    return string(frameStart) + body + string(crcMark) + hex4(CRC16(body))
+}
+
+// Decode แยก frame จากบรรทัด
+// ถ้า CRC ไม่ตรงจะคืน ErrChecksum พร้อม frame ที่แยกได้ (เอา id ไปตอบ err ได้)
+func Decode(line string) (Frame, error) {
+    var f Frame
+    if !IsFrame(line) {
+        return f, ErrMalformed
+    }
+    star := strings.LastIndexByte(line, crcMark)
+    if star < 0 {
+        return f, ErrMalformed
+    }
+    body := line[1:star]
+    sum, err := strconv.ParseUint(line[star+1:], 16, 16)
+    if err != nil {
+        return f, ErrMalformed
+    }
+
+    parts := strings.SplitN(body, ",", 3)
+    if len(parts) != 3 || parts[1] == "" {
+        return f, ErrMalformed
+    }
+    head := strings.Split(parts[0], ":")
+    if len(head) != 1 && len(head) != 3 {
+        return f, ErrMalformed
+    }
+    id, err := strconv.ParseUint(head[0], 10, 16)
+    if err != nil {
+        return f, ErrMalformed
+    }
+    f.ID = uint16(id)
+    if len(head) == 3 {
+        seq, e1 := strconv.ParseUint(head[1], 10, 32)
+        up, e2 := strconv.ParseUint(head[2], 10, 64)
+        if e1 != nil || e2 != nil || seq == 0 {
+            return f, ErrMalformed
+        }
+        f.Seq, f.UptimeMs = uint32(seq), up
+    }
+    f.Type = parts[1]
+    f.Payload = parts[2]
+
+    if uint16(sum) != CRC16(body) {
+        return f, ErrChecksum
+    }
+    return f, nil
+}
+
+// CRC16 = CRC-16/CCITT-FALSE (poly 0x1021, init 0xFFFF)
+// คำนวณทีละบิตเพื่อไม่ต้องเก็บตารางใน RAM ของ Pico
+func CRC16(s string) uint16 {
+    crc := uint16(0xFFFF)
+    for i := 0; i < len(s); i++ {
+        crc ^= uint16(s[i]) << 8
+        for b := 0; b < 8; b++ {
+            if crc&0x8000 != 0 {
+                crc = crc<<1 ^ 0x1021
+            } else {
+                crc <<= 1
+            }
+        }
+    }
+    return crc
+}
+
+func hex4(v uint16) string {
+    const digits = "0123456789ABCDEF"
+    return string([]byte{
+        digits[v>>12&0xF],
+        digits[v>>8&0xF],
+        digits[v>>4&0xF],
+        digits[v&0xF],
+    })
+}
@@ -0,0 +1,80 @@
+package protocol
+
+import (
+    "strings"
+    "testing"
+)
+
+// ค่า check มาตรฐานของ CRC-16/CCITT-FALSE คือ CRC ของ "123456789"
+func TestCRC16CheckValue(t *testing.T) {
+    if got := CRC16("123456789"); got != 0x29B1 {
+        t.Fatalf("CRC16(123456789) = %04X, want 29B1", got)
+    }
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+    tests := []struct {
+        name  string
+        frame Frame
+        line  string // "" = ไม่ตรวจข้อความ
+    }{
+        {"command", Frame{ID: 7, Type: TypeCommand, Payload: "light13:50"}, "$7,cmd,light13:50*"},
+        {"payload with commas", Frame{ID: 65535, Type: TypeData, Payload: `{"a":1,"b":2}`}, ""},
+        {"empty payload", Frame{ID: 0, Type: TypeAck, Payload: ""}, "$0,ack,*"},
+        {"stamped", Frame{ID: 3, Type: TypeData, Payload: "{}", Seq: 12, UptimeMs: 34567}, "$3:12:34567,data,{}*"},
+        {"stamped long uptime", Frame{ID: 1, Type: TypeLog, Payload: "info,x", Seq: 1, UptimeMs: 1 << 40}, ""},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            line := tt.frame.Encode()
+            if tt.line != "" && !strings.HasPrefix(line, tt.line) {
+                t.Fatalf("Encode = %q, want prefix %q", line, tt.line)
+            }
+            got, err := Decode(line)
+            if err != nil {
+                t.Fatalf("Decode(%q): %v", line, err)
+            }
+            if got != tt.frame {
+                t.Fatalf("Decode(%q) = %+v, want %+v", line, got, tt.frame)
+            }
+        })
+    }
+}
+
+func TestDecodeChecksumKeepsID(t *testing.T) {
+    line := Frame{ID: 42, Type: TypeCommand, Payload: "on"}.Encode()
+    // เปลี่ยน payload แต่คง CRC เดิม
+    bad := strings.Replace(line, ",on*", ",of*", 1)
+    f, err := Decode(bad)
+    if err != ErrChecksum {
+        t.Fatalf("Decode(%q) err = %v, want ErrChecksum", bad, err)
+    }
+    if f.ID != 42 {
+        t.Fatalf("Decode(%q) ID = %d, want 42", bad, f.ID)
+    }
+}
+
+func TestDecodeMalformed(t *testing.T) {
+    tests := []struct {
+        name string
+        line string
+    }{
+        {"missing $", "7,cmd,on*1234"},
+        {"missing *", "$7,cmd,on"},
+        {"bad hex", "$7,cmd,on*XYZ1"},
+        {"missing type", "$7,,on*0000"},
+        {"too few fields", "$7,cmd*0000"},
+        {"bad id", "$x,cmd,on*0000"},
+        {"id out of range", "$70000,cmd,on*0000"},
+        {"two stamp fields", "$7:1,cmd,on*0000"},
+        {"zero seq", "$7:0:5,cmd,on*0000"},
+        {"empty", ""},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if _, err := Decode(tt.line); err != ErrMalformed {
+                t.Fatalf("Decode(%q) err = %v, want ErrMalformed", tt.line, err)
+            }
+        })
+    }
+}
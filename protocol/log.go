@@ -0,0 +1,47 @@
+package protocol
+
+import "strings"
+
+// ระดับของ frame log เรียงจากน้อยไปมาก
+const (
+    LevelDebug = "debug"
+    LevelInfo  = "info"
+    LevelWarn  = "warn"
+    LevelError = "error"
+)
+
+// LogPayload สร้าง payload ของ frame log: "<level>,<message>"
+// ข้อความเป็นบรรทัดเดียวเสมอ (ขึ้นบรรทัดใหม่จะทำให้ frame ขาด)
+func LogPayload(level, msg string) string {
+    msg = strings.TrimRight(msg, "\r\n")
+    msg = strings.ReplaceAll(msg, "\n", " ")
+    return level + "," + msg
+}
+
+// ParseLog แยก payload ของ frame log ระดับที่ไม่รู้จักถือเป็น info
+func ParseLog(payload string) (level, msg string) {
+    i := strings.IndexByte(payload, ',')
+    if i < 0 {
+        return LevelInfo, payload
+    }
+    level, msg = payload[:i], payload[i+1:]
+    if LevelRank(level) < 0 {
+        return LevelInfo, msg
+    }
+    return level, msg
+}
+
+// LevelRank คืนลำดับของระดับ (debug=0 .. error=3) หรือ -1 ถ้าไม่รู้จัก
+func LevelRank(level string) int {
+    switch level {
+    case LevelDebug:
+        return 0
+    case LevelInfo:
+        return 1
+    case LevelWarn:
+        return 2
+    case LevelError:
+        return 3
+    }
+    return -1
+}
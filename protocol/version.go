@@ -0,0 +1,12 @@
+package protocol
+
+// Version คือรุ่นของ protocol ระหว่าง Pico กับ server (frame, คำสั่ง และ JSON ใน hello/data/status/event)
+// เพิ่มทุกครั้งที่เปลี่ยนแบบที่อีกฝั่งรุ่นเก่าเข้าใจผิดได้ firmware ส่งค่านี้ใน hello เป็น "proto"
+//
+//    1 = frame + hello (firmware ที่ hello ยังไม่มี "proto")
+//    2 = relay แยกช่อง, ramp ของไฟ, filter ของ soil, "proto"/"commit" ใน hello, คำสั่ง version
+//    3 = frame และคำสั่ง boot (ค่า actuator ที่คืนจาก flash หลัง reboot)
+//    4 = seq และ uptime_ms ในหัวของทุก frame จาก Pico
+//
+// server ยังคุยกับทุกรุ่นก่อนหน้า (รวม firmware legacy ที่ไม่มี frame) จึงไม่มีรุ่นต่ำสุด
+const Version = 4
@@ -0,0 +1,367 @@
+//go:build !tinygo
+
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "sync"
+    "time"
+
+    "smart_farm/protocol"
+)
+
+// ชนิดของ actuator
+const (
+    actuatorRelay = "relay" // ค่า 0/1 (off/on)
+    actuatorPWM   = "pwm"   // ค่า min..max (%)
+)
+
+// capabilities คือสิ่งที่ Pico ประกาศใน frame hello
+type capabilities struct {
+    Firmware  string         `json:"fw"`
+    Commit    string         `json:"commit,omitempty"` // git commit ที่ build firmware ("" = ไม่รู้)
+    Built     string         `json:"built,omitempty"`
+    Proto     int            `json:"proto,omitempty"` // protocol.Version ของ firmware (0 = รุ่นก่อนมี proto นับเป็น 1)
+    DeviceID  string         `json:"device"`
+    Keepalive int            `json:"keepalive_s"` // ส่งค่าซ้ำอย่างน้อยทุกกี่วินาที (0 = เฉพาะตอนเปลี่ยน)
+    Sensors   []sensorInfo   `json:"sensors"`
+    Actuators []actuatorInfo `json:"actuators"`
+
+    // true = firmware รุ่นเก่าที่ไม่รู้จักคำสั่ง hello (ใช้ legacyCapabilities)
+    Legacy bool `json:"legacy"`
+}
+
+type sensorInfo struct {
+    Kind   string                `json:"kind"` // air | soil
+    ID     int                   `json:"id"`   // ตรงกับ air_id / soil_id ใน telemetry
+    Ranges map[string][2]float64 `json:"ranges"`
+
+    // ค่า ADC ดิบที่ 0% (dry) และ 100% (wet) ของ soil ที่ firmware ใช้อยู่
+    Cal *soilCalibration `json:"cal,omitempty"`
+}
+
+type soilCalibration struct {
+    Dry int `json:"dry"`
+    Wet int `json:"wet"`
+}
+
+type actuatorInfo struct {
+    Name  string `json:"name"` // ใช้เป็นคำสั่ง "<name>:<value>" และ route /control-<name>
+    Kind  string `json:"kind"`
+    Label string `json:"label"`
+    Min   int    `json:"min"`
+    Max   int    `json:"max"`
+    Ramp  bool   `json:"ramp,omitempty"` // pwm ที่ Pico ค่อยๆ เปลี่ยนค่าเองได้ (ดู rampCommand)
+}
+
+// legacyCapabilities คือบอร์ดตาม firmware รุ่นแรก (DHT air_id 1, soil_id 1, pump, light13/14/15)
+func legacyCapabilities() capabilities {
+    return capabilities{
+        Firmware: "legacy",
+        Sensors: []sensorInfo{
+            {Kind: "air", ID: 1, Ranges: map[string][2]float64{"temp": {-40, 80}, "air_humidity": {0, 100}}},
+            {Kind: "soil", ID: 1, Ranges: map[string][2]float64{"soil_humidity": {0, 100}}},
+        },
+        Actuators: []actuatorInfo{
+            {Name: "pump", Kind: actuatorRelay, Label: "Water Pump", Min: 0, Max: 1},
+            {Name: "light13", Kind: actuatorPWM, Label: "Brightness Outer 1", Min: 0, Max: 100},
+            {Name: "light14", Kind: actuatorPWM, Label: "Brightness Outer 2", Min: 0, Max: 100},
+            {Name: "light15", Kind: actuatorPWM, Label: "Brightness Inner", Min: 0, Max: 100},
+        },
+        Legacy: true,
+    }
+}
+
+// deviceRegistry เก็บ sensor/actuator ของ Pico ที่ต่ออยู่ และค่าของ actuator
+//   - state:   ค่าจริงบน Pico (จาก ACK, status, pump_status ใน telemetry)
+//   - desired: ค่าที่ผู้ใช้ต้องการ ถ้าไม่ตรงกับ state จะถูกส่งซ้ำตอน resync
+type deviceRegistry struct {
+    mu         sync.Mutex
+    caps       capabilities
+    state      map[string]int
+    desired    map[string]int
+    lastUptime int64
+    health     map[string]sensorHealth // key = sensorKey(kind, id)
+    lastSeen   map[string]time.Time    // ได้ค่าจาก sensor ครั้งล่าสุด key = sensorKey(kind, id)
+    helloAt    time.Time               // ได้ hello ล่าสุดเมื่อไร (sensor ที่ยังไม่เคยส่งนับเงียบจากตรงนี้)
+    bootAt     time.Time               // Pico boot เมื่อไร (จาก frame boot) ใช้แยก boot ใหม่จาก frame ที่ขอซ้ำ
+    onChange   []func(capabilities)
+}
+
+// เริ่มจาก legacyCapabilities จนกว่าจะได้ hello จริง
+func newDeviceRegistry() *deviceRegistry {
+    return &deviceRegistry{
+        caps:     legacyCapabilities(),
+        state:    make(map[string]int),
+        desired:  make(map[string]int),
+        health:   make(map[string]sensorHealth),
+        lastSeen: make(map[string]time.Time),
+        helloAt:  time.Now(),
+    }
+}
+
+func (r *deviceRegistry) setCapabilities(c capabilities) {
+    r.mu.Lock()
+    r.caps = c
+    r.helloAt = time.Now()
+    // ลบค่าของ actuator ที่ไม่มีแล้ว
+    for name := range r.state {
+        if _, ok := findActuator(c, name); !ok {
+            delete(r.state, name)
+            delete(r.desired, name)
+        }
+    }
+    listeners := append([]func(capabilities){}, r.onChange...)
+    r.mu.Unlock()
+
+    fmt.Printf("Device %q firmware %s (commit %s, protocol %d): %d sensors, %d actuators\n",
+        c.DeviceID, c.Firmware, orUnknown(c.Commit), c.protocolVersion(), len(c.Sensors), len(c.Actuators))
+    for _, fn := range listeners {
+        fn(c)
+    }
+}
+
+// setCalibration เปลี่ยน cal ของ sensor หลัง Pico ตอบคำสั่ง calibration (ไม่แจ้ง onChange)
+func (r *deviceRegistry) setCalibration(kind string, id int, cal soilCalibration) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    // copy slice เพราะ capabilities ที่คืนไปก่อนหน้าใช้ slice เดียวกัน
+    sensors := append([]sensorInfo(nil), r.caps.Sensors...)
+    for i := range sensors {
+        if sensors[i].Kind == kind && sensors[i].ID == id {
+            sensors[i].Cal = &cal
+        }
+    }
+    r.caps.Sensors = sensors
+}
+
+func (r *deviceRegistry) capabilities() capabilities {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return r.caps
+}
+
+// subscribe เรียก fn ทุกครั้งที่ได้ hello ใหม่ (GUI ใช้สร้างปุ่มใหม่)
+func (r *deviceRegistry) subscribe(fn func(capabilities)) {
+    r.mu.Lock()
+    r.onChange = append(r.onChange, fn)
+    r.mu.Unlock()
+}
+
+func (r *deviceRegistry) actuator(name string) (actuatorInfo, bool) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return findActuator(r.caps, name)
+}
+
+func (r *deviceRegistry) setState(name string, value int) {
+    r.mu.Lock()
+    r.state[name] = value
+    r.mu.Unlock()
+}
+
+func (r *deviceRegistry) setDesired(name string, value int) {
+    r.mu.Lock()
+    r.desired[name] = value
+    r.mu.Unlock()
+}
+
+// dropDesired ถอยค่าที่ต้องการกลับเป็นค่าจริง ถ้ายังเป็น value อยู่ (ผู้ใช้ยังไม่ได้สั่งค่าใหม่)
+func (r *deviceRegistry) dropDesired(name string, value int) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if want, ok := r.desired[name]; ok && want == value {
+        r.desired[name] = r.state[name]
+    }
+}
+
+func (r *deviceRegistry) desiredSnapshot() map[string]int {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    out := make(map[string]int, len(r.desired))
+    for k, v := range r.desired {
+        out[k] = v
+    }
+    return out
+}
+
+// restoreDesired คืนค่าที่ต้องการที่เคยจำไว้ (เฉพาะ actuator ที่ยังมีอยู่)
+func (r *deviceRegistry) restoreDesired(desired map[string]int) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    for name, v := range desired {
+        if _, ok := findActuator(r.caps, name); ok {
+            r.desired[name] = v
+        }
+    }
+}
+
+// applyStatus เก็บค่าจริงจาก frame status คืน true ถ้า uptime ลดลง (Pico reboot)
+// actuator ที่ server ยังไม่เคยสั่ง จะถือค่าบน Pico เป็นค่าที่ต้องการ
+func (r *deviceRegistry) applyStatus(st statusReport) bool {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    rebooted := r.lastUptime > 0 && st.UptimeMs < r.lastUptime
+    r.lastUptime = st.UptimeMs
+    for name, v := range st.Actuators {
+        r.state[name] = v
+        if _, ok := r.desired[name]; !ok {
+            r.desired[name] = v
+        }
+    }
+    return rebooted
+}
+
+// markBoot จำเวลาที่ Pico boot คืน false ถ้าเป็น boot เดิมที่เคยได้แล้ว (เช่นขอซ้ำตอนเปิดพอร์ตใหม่)
+func (r *deviceRegistry) markBoot(at time.Time) bool {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if !r.bootAt.IsZero() && at.Sub(r.bootAt).Abs() < 5*time.Second {
+        return false
+    }
+    r.bootAt = at
+    return true
+}
+
+// drifted คืน actuator ที่ค่าบน Pico ไม่ตรงกับค่าที่ต้องการ => ค่าที่ต้องการ
+func (r *deviceRegistry) drifted() map[string]int {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    out := make(map[string]int)
+    for name, want := range r.desired {
+        if r.state[name] != want {
+            out[name] = want
+        }
+    }
+    return out
+}
+
+func (r *deviceRegistry) stateOf(name string) int {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return r.state[name]
+}
+
+func (r *deviceRegistry) stateSnapshot() map[string]int {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    out := make(map[string]int, len(r.state))
+    for k, v := range r.state {
+        out[k] = v
+    }
+    return out
+}
+
+// command สร้างคำสั่ง Serial สำหรับตั้งค่า actuator
+func (r *deviceRegistry) command(a actuatorInfo, value int) string {
+    legacy := r.capabilities().Legacy
+    if a.Kind == actuatorRelay {
+        v := "off"
+        if value != 0 {
+            v = "on"
+        }
+        // firmware รุ่นแรกรู้จักแค่ "on"/"off" สำหรับปั๊ม
+        if legacy && a.Name == "pump" {
+            return v
+        }
+        return a.Name + ":" + v
+    }
+    return fmt.Sprintf("%s:%d", a.Name, value)
+}
+
+// rampCommand สร้างคำสั่งให้ Pico ค่อยๆ เปลี่ยน pwm ไปที่ value ภายใน ms ("linear" หรือ "gamma")
+func rampCommand(a actuatorInfo, value, ms int, curve string) string {
+    return fmt.Sprintf("%s:%d,%d,%s", a.Name, value, ms, curve)
+}
+
+func findActuator(c capabilities, name string) (actuatorInfo, bool) {
+    for _, a := range c.Actuators {
+        if a.Name == name {
+            return a, true
+        }
+    }
+    return actuatorInfo{}, false
+}
+
+// sensorsOfKind คืน sensor ชนิดนั้นตามลำดับที่ Pico ประกาศ
+func (c capabilities) sensorsOfKind(kind string) []sensorInfo {
+    var out []sensorInfo
+    for _, s := range c.Sensors {
+        if s.Kind == kind {
+            out = append(out, s)
+        }
+    }
+    return out
+}
+
+func (c capabilities) actuatorsOfKind(kind string) []actuatorInfo {
+    var out []actuatorInfo
+    for _, a := range c.Actuators {
+        if a.Kind == kind {
+            out = append(out, a)
+        }
+    }
+    return out
+}
+
+// handleHello แปลง payload ของ frame hello แล้วอัปเดต registry ของ Pico ตัวนั้น
+func handleHello(link *serialLink, payload string) {
+    var c capabilities
+    if err := json.Unmarshal([]byte(payload), &c); err != nil {
+        fmt.Println("JSON parse hello error:", err, "payload:", payload)
+        return
+    }
+    link.registry.setCapabilities(c)
+    if msg := c.compatibility(); msg != "" {
+        fmt.Printf("Device %s: %s\n", link.id(), msg)
+        link.logs.add(protocol.LevelWarn, msg)
+    }
+}
+
+// protocolVersion คือรุ่น protocol ที่ firmware ประกาศ (hello ที่ไม่มี proto = รุ่น 1)
+func (c capabilities) protocolVersion() int {
+    if c.Proto == 0 {
+        return 1
+    }
+    return c.Proto
+}
+
+// compatibility เทียบรุ่น protocol ของ firmware กับ server คืนคำเตือน ("" = ตรงกัน)
+// รุ่นเก่ากว่า server (รวม legacy ที่ไม่มี hello) ใช้ได้เสมอ
+// รุ่นใหม่กว่า protocol.Version ใช้ต่อได้แต่เตือน บางอย่างที่ firmware ส่งมา server อาจไม่รู้จัก
+func (c capabilities) compatibility() string {
+    if c.Legacy {
+        return ""
+    }
+    if p := c.protocolVersion(); p > protocol.Version {
+        return fmt.Sprintf("firmware %s speaks protocol %d, newer than the server (%d): some features may not work",
+            c.Firmware, p, protocol.Version)
+    }
+    return ""
+}
+
+func orUnknown(s string) string {
+    if s == "" {
+        return "unknown"
+    }
+    return s
+}
+
+// handshake ขอ hello จาก Pico ทุกครั้งที่เปิดพอร์ต
+// firmware รุ่นเก่าจะตอบ ERR/ไม่ตอบ => ใช้ legacyCapabilities
+func handshake(sess *serialSession) {
+    _, err := sess.sendCommand("hello")
+    if err != nil && !errors.Is(err, errDeviceOffline) {
+        fmt.Println("No hello from device, assuming legacy firmware:", err)
+        sess.link.registry.setCapabilities(legacyCapabilities())
+        return
+    }
+    // frame boot ตอน Pico เปิดเครื่องมักหายเพราะยังไม่มีใครเปิดพอร์ต => ขอซ้ำ (protocol 3 ขึ้นไป)
+    if err == nil && sess.link.registry.capabilities().protocolVersion() >= 3 {
+        if _, err := sess.sendCommand("boot"); err != nil && !errors.Is(err, errDeviceOffline) {
+            fmt.Println("Boot report failed:", err)
+        }
+    }
+}
@@ -101,9 +101,44 @@ function updateDateTime() {
     console.log(`อัปเดตกราฟ: แสดงข้อมูล ${selectedValue} นาทีล่าสุด`);
   }
   
-  // ฟังก์ชันหลัก: ดึงค่าจาก /sensor-data
+  function showSensorFault(ids, fault) {
+    ids.forEach(id => {
+      const el = document.getElementById(id);
+      if (fault) {
+        el.innerText = `⚠ ${fault}`;
+        el.classList.add("faulted");
+      } else {
+        el.classList.remove("faulted");
+      }
+    });
+  }
+  
+  // อัปเดตรายชื่อ Pico ใน dropdown จาก /devices (คงตัวที่เลือกไว้ถ้ายังอยู่)
+  function updateDeviceList() {
+    fetch("/devices")
+      .then(res => res.json())
+      .then(devices => {
+        const select = document.getElementById("device-select");
+        const selected = select.value;
+        const ids = devices.map(d => d.status.id);
+        if (ids.join("\n") === Array.from(select.options).map(o => o.value).join("\n")) {
+          return;
+        }
+        select.innerHTML = "";
+        ids.forEach(id => select.add(new Option(id, id)));
+        if (ids.includes(selected)) {
+          select.value = selected;
+        }
+      })
+      .catch(err => {
+        console.error("Error fetching devices:", err);
+      });
+  }
+  
+  // ฟังก์ชันหลัก: ดึงค่าจาก /sensor-data ของ Pico ที่เลือก
   function updateSensorData() {
-    fetch("/sensor-data")
+    const device = document.getElementById("device-select").value;
+    fetch(device ? `/devices/${encodeURIComponent(device)}/sensor-data` : "/sensor-data")
       .then(res => {
         if (!res.ok) {
           throw new Error(`HTTP error! status: ${res.status}`);
@@ -131,6 +166,24 @@ function updateDateTime() {
         if (data.soil_humidity !== undefined) {
           document.getElementById("moisture-value").innerText = data.soil_humidity.toFixed(1) + "%";
         }
+        // ค่า ADC ดิบ ใช้ดูตอน calibrate probe (firmware รุ่นเก่าไม่มี)
+        // ±σ ของค่าดิบในรอบนั้น บอกว่าสัญญาณมีสัญญาณรบกวนมากแค่ไหน
+        let raw = typeof data.soil_raw === 'number' ? `raw ${data.soil_raw}` : "";
+        if (raw && typeof data.soil_raw_var === 'number') {
+          raw += ` ±${Math.sqrt(data.soil_raw_var).toFixed(0)} (${data.soil_filter})`;
+        }
+        document.getElementById("moisture-raw").innerText = raw;
+  
+        // sensor ที่อ่านไม่ได้/เงียบนานเกินไป => แสดงชนิดปัญหาแทนค่าล่าสุด
+        showSensorFault(["temp1-value", "humidity1-value"], data.air1_fault || (data.air1_stale ? "stale" : ""));
+        showSensorFault(["temp2-value", "humidity2-value"], data.air2_fault || (data.air2_stale ? "stale" : ""));
+        showSensorFault(["moisture-value"], data.soil_fault || (data.soil_stale ? "stale" : ""));
+
+        // probe ตัวอื่นของบอร์ดเดียวกัน (แปลงที่ 2, 3) แสดงเป็นบรรทัดเล็กใต้ค่าหลัก
+        document.getElementById("moisture-more").innerText = (data.soils || []).slice(1).map(s => {
+          const fault = s.fault || (s.stale ? "stale" : "");
+          return `#${s.soil_id} ` + (fault ? `⚠ ${fault}` : s.soil_humidity.toFixed(1) + "%");
+        }).join("  ");
   
         // ปั๊มน้ำ
         if (typeof data.pump_status === 'boolean') {
@@ -145,6 +198,29 @@ function updateDateTime() {
           }
         }
   
+        // สถานะการเชื่อมต่อ Pico
+        if (data.device) {
+          const deviceStatus = document.getElementById("device-status");
+          if (data.device.online) {
+            deviceStatus.className = "device-status online";
+            deviceStatus.innerText = `Device online (${data.device.port})`;
+          } else {
+            deviceStatus.className = "device-status offline";
+            deviceStatus.innerText = "Device offline";
+          }
+          // รุ่น firmware และคำเตือนเรื่อง protocol
+          if (data.device.firmware) {
+            deviceStatus.innerText += ` | fw ${data.device.firmware}`;
+            if (data.device.commit) {
+              deviceStatus.innerText += ` (${data.device.commit})`;
+            }
+          }
+          if (data.device.warning) {
+            deviceStatus.innerText += ` | ${data.device.warning}`;
+            deviceStatus.title = data.device.warning;
+          }
+        }
+  
         // LED
         if (data.led1 !== undefined) {
           updateLEDChart(ledChart1, "led1-percent", data.led1);
@@ -172,6 +248,8 @@ function updateDateTime() {
     setInterval(updateDateTime, 1000);
   
     // เรียกทุก 2 วิ
+    setInterval(updateDeviceList, 2000);
     setInterval(updateSensorData, 2000);
+    updateDeviceList();
     updateSensorData();
   });
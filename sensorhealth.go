@@ -0,0 +1,135 @@
+//go:build !tinygo
+
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "sort"
+    "time"
+
+    "smart_farm/protocol"
+)
+
+// สถานะของ sensor หนึ่งตัว จาก frame health ของ Pico
+type sensorHealth struct {
+    Kind     string    `json:"kind"` // air | soil
+    ID       int       `json:"id"`
+    OK       bool      `json:"ok"`
+    Error    string    `json:"error,omitempty"` // ชนิดปัญหา เช่น no_signal, checksum
+    Failures int       `json:"failures"`        // อ่านไม่ได้ติดกันกี่ครั้ง
+    Since    time.Time `json:"since"`           // เวลาที่เข้าสู่สถานะนี้
+
+    // จาก telemetry ไม่ใช่ frame health: ได้ค่าล่าสุดเมื่อไร และเงียบนานเกินที่ keepalive บอกไว้หรือไม่
+    LastSeen *time.Time `json:"last_seen,omitempty"`
+    Stale    bool       `json:"stale"`
+}
+
+// sensor ที่ไม่ส่งค่ามานานเกิน keepalive*staleFactor + staleMargin ถือว่าเงียบผิดปกติ
+const (
+    staleFactor = 2
+    staleMargin = 10 * time.Second
+)
+
+func sensorKey(kind string, id int) string {
+    return fmt.Sprintf("%s:%d", kind, id)
+}
+
+// setHealth เก็บสถานะ คืน true ถ้าเปลี่ยนระหว่างปกติ/พัง
+func (r *deviceRegistry) setHealth(h sensorHealth) bool {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    key := sensorKey(h.Kind, h.ID)
+    old, known := r.health[key]
+    changed := !known || old.OK != h.OK
+    if changed {
+        h.Since = time.Now()
+    } else {
+        h.Since = old.Since
+    }
+    r.health[key] = h
+    return changed && (known || !h.OK)
+}
+
+// seen จดเวลาที่ได้ค่าจาก sensor
+func (r *deviceRegistry) seen(kind string, id int) {
+    r.mu.Lock()
+    r.lastSeen[sensorKey(kind, id)] = time.Now()
+    r.mu.Unlock()
+}
+
+// staleAfter คือเวลาเงียบที่ถือว่า sensor หาย (0 = ไม่รู้ keepalive ของ firmware จึงตัดสินไม่ได้)
+func (c capabilities) staleAfter() time.Duration {
+    if c.Keepalive <= 0 {
+        return 0
+    }
+    return time.Duration(c.Keepalive)*time.Second*staleFactor + staleMargin
+}
+
+// healthOf คืนสถานะของ sensor ถ้าไม่เคยได้ frame health ถือว่าปกติ
+func (r *deviceRegistry) healthOf(kind string, id int) sensorHealth {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    key := sensorKey(kind, id)
+    h, ok := r.health[key]
+    if !ok {
+        h = sensorHealth{Kind: kind, ID: id, OK: true}
+    }
+
+    // ยังไม่เคยส่งค่าเลย => นับเงียบตั้งแต่ได้ hello
+    last := r.helloAt
+    if t, ok := r.lastSeen[key]; ok {
+        t := t
+        h.LastSeen = &t
+        last = t
+    }
+    if after := r.caps.staleAfter(); after > 0 {
+        h.Stale = time.Since(last) > after
+    }
+    return h
+}
+
+// healthSnapshot คืนสถานะของ sensor ทุกตัวที่ประกาศใน hello เรียงตาม kind, id
+func (r *deviceRegistry) healthSnapshot() []sensorHealth {
+    caps := r.capabilities()
+    out := make([]sensorHealth, 0, len(caps.Sensors))
+    for _, s := range caps.Sensors {
+        out = append(out, r.healthOf(s.Kind, s.ID))
+    }
+    sort.Slice(out, func(i, j int) bool {
+        if out[i].Kind != out[j].Kind {
+            return out[i].Kind < out[j].Kind
+        }
+        return out[i].ID < out[j].ID
+    })
+    return out
+}
+
+// handleHealth แปลง payload ของ frame health แล้วบันทึกลง registry + log ของ device
+func handleHealth(link *serialLink, payload string) {
+    var h sensorHealth
+    if err := json.Unmarshal([]byte(payload), &h); err != nil {
+        fmt.Println("JSON parse health error:", err, "payload:", payload)
+        return
+    }
+    recordHealth(link, h)
+}
+
+// markSensorOK = ได้ค่าจริงจาก sensor แล้ว: จดเวลา และถือว่าปกติ (เผื่อ frame health ตอนกลับมาปกติหล่นหาย)
+func markSensorOK(link *serialLink, kind string, id int) {
+    link.registry.seen(kind, id)
+    recordHealth(link, sensorHealth{Kind: kind, ID: id, OK: true})
+}
+
+func recordHealth(link *serialLink, h sensorHealth) {
+    if !link.registry.setHealth(h) {
+        return
+    }
+    if h.OK {
+        fmt.Printf("Sensor %s %d on %s recovered\n", h.Kind, h.ID, link.id())
+        link.logs.add(protocol.LevelInfo, fmt.Sprintf("sensor %s %d recovered", h.Kind, h.ID))
+        return
+    }
+    fmt.Printf("Sensor %s %d on %s faulted: %s (%d failures)\n", h.Kind, h.ID, link.id(), h.Error, h.Failures)
+    link.logs.add(protocol.LevelWarn, fmt.Sprintf("sensor %s %d faulted: %s", h.Kind, h.ID, h.Error))
+}
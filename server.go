@@ -1,53 +1,56 @@
+//go:build !tinygo
+
 package main
 
 import (
-    "bufio"
     "bytes"
     "database/sql"
     "encoding/json"
+    "errors"
+    "flag"
     "fmt"
     "image/color"
     "io"
     "log"
-    "math"
-    "math/rand"
     "net/http"
+    "net/url"
+    "sort"
+    "strconv"
     "strings"
     "time"
 
     mqtt "github.com/eclipse/paho.mqtt.golang"
     "github.com/gorilla/mux"
     _ "github.com/lib/pq"
-    "github.com/tarm/serial"
 
     "fyne.io/fyne/v2"
     "fyne.io/fyne/v2/app"
     "fyne.io/fyne/v2/canvas"
     "fyne.io/fyne/v2/container"
+    "fyne.io/fyne/v2/dialog"
     "fyne.io/fyne/v2/layout"
     "fyne.io/fyne/v2/widget"
+
+    "smart_farm/emulator"
+    "smart_farm/protocol"
 )
 
 const dbConn = "user=postgres password=4847 dbname=farm_db sslmode=disable"
 
 var (
-    db         *sql.DB
-    serialPort *serial.Port
-    mqttClient mqtt.Client
+    db          *sql.DB
+    picoGateway *gateway
+    mqttClient  mqtt.Client
 
     myApp    fyne.App
     myWindow fyne.Window
 
-    slider1, slider2, slider3                 *widget.Slider
-    progressBar1, progressBar2, progressBar3  *widget.ProgressBar
-    pumpOnButton, pumpOffButton               *widget.Button
-    pumpStatus                                *canvas.Text
+    controlsBox  *fyne.Container
+    deviceStatus *canvas.Text
+    deviceSelect *widget.Select
 
-    // เก็บสถานะ pump และ LED brightness (13,14,15)
-    currentPumpStatus bool
-    led13Brightness   int
-    led14Brightness   int
-    led15Brightness   int
+    // device + capabilities ที่ใช้สร้างปุ่มใน controlsBox อยู่ตอนนี้
+    shownControls string
 )
 
 type AirData struct {
@@ -61,8 +64,27 @@ type AirData struct {
 type SoilData struct {
     Type         string  `json:"type"`
     SoilID       int     `json:"soil_id"`
+    SoilRaw      *int    `json:"soil_raw"` // ค่า ADC ดิบ (firmware ก่อนมี calibration ไม่ส่ง)
     SoilHumidity float64 `json:"soil_humidity"`
     PumpStatus   bool    `json:"pump_status"`
+
+    // การกรอง ADC บน Pico และ variance ของค่าดิบในรอบนั้น (firmware ก่อนมี filter ไม่ส่ง)
+    Filter    string   `json:"filter"`
+    Samples   int      `json:"samples"`
+    EMAWindow int      `json:"ema_window"`
+    RawVar    *float64 `json:"raw_var"`
+}
+
+// filterLabel คือการกรองแบบสั้นสำหรับเก็บลง DB เช่น "median x9", "ema x9 window=4" ("" = ไม่รู้)
+func (sd SoilData) filterLabel() string {
+    if sd.Filter == "" {
+        return ""
+    }
+    label := fmt.Sprintf("%s x%d", sd.Filter, sd.Samples)
+    if sd.Filter == "ema" {
+        label += fmt.Sprintf(" window=%d", sd.EMAWindow)
+    }
+    return label
 }
 
 func mqttMessageHandler(client mqtt.Client, msg mqtt.Message) {
@@ -71,12 +93,13 @@ func mqttMessageHandler(client mqtt.Client, msg mqtt.Message) {
 }
 
 // ส่งค่า temp/humidity
-func publishToMQTTAir(temp, hum float64) {
+func publishToMQTTAir(deviceID string, temp, hum float64) {
     if mqttClient == nil {
         fmt.Println("MQTT Client not initialized")
         return
     }
-    payload := map[string]float64{
+    payload := map[string]interface{}{
+        "device":       deviceID,
         "temperature":  temp,
         "air_humidity": hum,
     }
@@ -94,14 +117,64 @@ func publishToMQTTAir(temp, hum float64) {
     }
 }
 
+// ส่ง event จาก Pico เช่น pump_timeout
+func publishToMQTTEvent(deviceID string, ev deviceEvent) {
+    if mqttClient == nil {
+        fmt.Println("MQTT Client not initialized")
+        return
+    }
+    payload := map[string]interface{}{
+        "device": deviceID,
+        "event":  ev.Event,
+    }
+    switch ev.Event {
+    case "pump_timeout":
+        payload["actuator"] = ev.Actuator
+        payload["ran_ms"] = ev.RanMs
+    case "fallback_action":
+        payload["uptime_ms"] = ev.UptimeMs
+        payload["actuator"] = ev.Actuator
+        payload["value"] = ev.Value
+        payload["reason"] = ev.Reason
+    case "fallback_end":
+        payload["duration_ms"] = ev.DurationMs
+        payload["actions"] = ev.Actions
+        payload["dropped"] = ev.Dropped
+    case "boot":
+        payload["uptime_ms"] = ev.UptimeMs
+        payload["restored"] = ev.Restored
+        payload["reset"] = ev.Reset
+    }
+    b, err := json.Marshal(payload)
+    if err != nil {
+        fmt.Println("MQTT JSON marshal error:", err)
+        return
+    }
+    token := mqttClient.Publish("smartfarm/events", 0, false, b)
+    token.Wait()
+    if token.Error() != nil {
+        fmt.Println("Error publishing MQTT:", token.Error())
+    } else {
+        fmt.Println("Published to MQTT:", string(b))
+    }
+}
+
 // ส่งค่า soil
-func publishToMQTTSoil(soil float64) {
+func publishToMQTTSoil(deviceID string, sd SoilData) {
     if mqttClient == nil {
         fmt.Println("MQTT Client not initialized")
         return
     }
-    payload := map[string]float64{
-        "soil_humidity": soil,
+    payload := map[string]interface{}{
+        "device":        deviceID,
+        "soil_humidity": sd.SoilHumidity,
+    }
+    if sd.SoilRaw != nil {
+        payload["soil_raw"] = *sd.SoilRaw
+    }
+    if sd.RawVar != nil {
+        payload["soil_raw_var"] = *sd.RawVar
+        payload["soil_filter"] = sd.filterLabel()
     }
     b, err := json.Marshal(payload)
     if err != nil {
@@ -117,78 +190,106 @@ func publishToMQTTSoil(soil float64) {
     }
 }
 
-// อ่านค่า Serial
-func readSerial() {
-    reader := bufio.NewReader(serialPort)
-    for {
-        line, err := reader.ReadString('\n')
-        if err != nil {
-            time.Sleep(time.Second)
-            continue
+// แยก JSON telemetry จาก Pico แล้วบันทึกลง DB + MQTT โดยติด id ของ device ที่ส่งมา
+// (serialSession.readLoop เป็นคนเรียก) at = เวลาที่วัดจริง (ดู frameTime) บันทึกเป็น reading_time
+func ingestLine(link *serialLink, line string, at time.Time) {
+    deviceID := link.id()
+    if strings.Contains(line, "\"type\":\"air\"") {
+        var ad AirData
+        e := json.Unmarshal([]byte(line), &ad)
+        if e != nil {
+            fmt.Println("JSON parse AirData error:", e, "line:", line)
+            return
         }
-        line = strings.TrimSpace(line)
-
-        // ตรวจว่าใน JSON มี \"type\":\"air\" หรือ \"type\":\"soil\" หรือเปล่า
-        if !strings.Contains(line, "\"type\":\"") {
-            fmt.Println("Unknown line:", line)
-            continue
-        }
-
-        if strings.Contains(line, "\"type\":\"air\"") {
-            var ad AirData
-            e := json.Unmarshal([]byte(line), &ad)
-            if e != nil {
-                fmt.Println("JSON parse AirData error:", e, "line:", line)
-                continue
-            }
-            // pump status จาก JSON => เก็บใน currentPumpStatus
-            currentPumpStatus = ad.PumpStatus
-
-            errA := insertAirValue(ad.AirID, ad.Temp, ad.AirHumidity)
-            if errA != nil {
-                fmt.Println("Insert airvalue error:", errA)
+        // pump status จาก JSON => เก็บใน registry (เฉพาะ firmware รุ่นแรก รุ่นใหม่มี relay หลายช่อง
+        // pump_status บอกแค่ว่ามีช่องรดน้ำเปิดอยู่ ค่าของแต่ละช่องมาจาก ACK/status แทน)
+        markSensorOK(link, "air", ad.AirID)
+        if link.registry.capabilities().Legacy {
+            if ad.PumpStatus {
+                link.registry.setState("pump", 1)
             } else {
-                fmt.Printf("AirValue => air_id=%d, temp=%.1f, hum=%.1f\n", ad.AirID, ad.Temp, ad.AirHumidity)
-                publishToMQTTAir(ad.Temp, ad.AirHumidity)
+                link.registry.setState("pump", 0)
             }
+        }
 
-        } else if strings.Contains(line, "\"type\":\"soil\"") {
-            var sd SoilData
-            e := json.Unmarshal([]byte(line), &sd)
-            if e != nil {
-                fmt.Println("JSON parse SoilData error:", e, "line:", line)
-                continue
-            }
-            // ถ้าฝั่ง soil ส่ง pump_status มา ก็อาจเอามาใช้ได้เช่นกัน
-            // currentPumpStatus = sd.PumpStatus
+        errA := insertAirValue(deviceID, ad.AirID, ad.Temp, ad.AirHumidity, at)
+        if errA != nil {
+            fmt.Println("Insert airvalue error:", errA)
+        } else {
+            fmt.Printf("AirValue => device=%s, air_id=%d, temp=%.1f, hum=%.1f\n", deviceID, ad.AirID, ad.Temp, ad.AirHumidity)
+            publishToMQTTAir(deviceID, ad.Temp, ad.AirHumidity)
+        }
 
-            errS := insertSoilValue(sd.SoilID, sd.SoilHumidity)
-            if errS != nil {
-                fmt.Println("Insert soilvalue error:", errS)
-            } else {
-                fmt.Printf("SoilValue => soil_id=%d, moisture=%.1f\n", sd.SoilID, sd.SoilHumidity)
-                publishToMQTTSoil(sd.SoilHumidity)
-            }
+    } else if strings.Contains(line, "\"type\":\"soil\"") {
+        var sd SoilData
+        e := json.Unmarshal([]byte(line), &sd)
+        if e != nil {
+            fmt.Println("JSON parse SoilData error:", e, "line:", line)
+            return
+        }
+        // ถ้าฝั่ง soil ส่ง pump_status มา ก็อาจเอามาใช้ได้เช่นกัน
+        // link.registry.setState("pump", ...)
+        markSensorOK(link, "soil", sd.SoilID)
+
+        errS := insertSoilValue(deviceID, sd, at)
+        if errS != nil {
+            fmt.Println("Insert soilvalue error:", errS)
         } else {
-            fmt.Println("Unknown type line:", line)
+            fmt.Printf("SoilValue => device=%s, soil_id=%d, moisture=%.1f\n", deviceID, sd.SoilID, sd.SoilHumidity)
+            publishToMQTTSoil(deviceID, sd)
         }
+    } else {
+        fmt.Println("Unknown type line:", line)
     }
 }
 
+// เพิ่มคอลัมน์ device_id ให้ตารางเดิม (แถวเก่าจะเป็น '' = ก่อนรองรับหลาย device)
+// air_id/soil_id ซ้ำกันได้ระหว่าง device เพราะแต่ละตัวนับของตัวเอง
+func migrateDB() error {
+    for _, table := range []string{"airvalue", "soilvalue"} {
+        _, err := db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN IF NOT EXISTS device_id TEXT NOT NULL DEFAULT ''`)
+        if err != nil {
+            return fmt.Errorf("migrate %s: %w", table, err)
+        }
+    }
+    // ค่า ADC ดิบของ soil (NULL = แถวเก่า/firmware ที่ยังไม่ส่ง soil_raw)
+    if _, err := db.Exec(`ALTER TABLE soilvalue ADD COLUMN IF NOT EXISTS soil_raw INTEGER`); err != nil {
+        return fmt.Errorf("migrate soilvalue: %w", err)
+    }
+    // คุณภาพสัญญาณ: variance ของค่าดิบ และการกรองที่ใช้ตอนนั้น (NULL = firmware ที่ยังไม่กรอง)
+    if _, err := db.Exec(`ALTER TABLE soilvalue ADD COLUMN IF NOT EXISTS soil_raw_var REAL, ADD COLUMN IF NOT EXISTS soil_filter TEXT`); err != nil {
+        return fmt.Errorf("migrate soilvalue: %w", err)
+    }
+    return nil
+}
+
+// ไม่มี DB (เช่นใน test) => ไม่บันทึก แต่ telemetry ยังอัปเดต registry ตามปกติ
+var errNoDatabase = errors.New("database not connected")
+
 // insert air
-func insertAirValue(airID int, temp, hum float64) error {
+func insertAirValue(deviceID string, airID int, temp, hum float64, at time.Time) error {
+    if db == nil {
+        return errNoDatabase
+    }
     _, err := db.Exec(
-        `INSERT INTO airvalue (air_id, temp, air_humidity) VALUES ($1, $2, $3)`,
-        airID, temp, hum,
+        `INSERT INTO airvalue (device_id, air_id, temp, air_humidity, reading_time) VALUES ($1, $2, $3, $4, $5)`,
+        deviceID, airID, temp, hum, at,
     )
     return err
 }
 
 // insert soil
-func insertSoilValue(soilID int, soil float64) error {
+func insertSoilValue(deviceID string, sd SoilData, at time.Time) error {
+    if db == nil {
+        return errNoDatabase
+    }
+    var filter *string
+    if label := sd.filterLabel(); label != "" {
+        filter = &label
+    }
     _, err := db.Exec(
-        `INSERT INTO soilvalue (soil_id, soil_humidity) VALUES ($1, $2)`,
-        soilID, soil,
+        `INSERT INTO soilvalue (device_id, soil_id, soil_raw, soil_humidity, soil_raw_var, soil_filter, reading_time) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+        deviceID, sd.SoilID, sd.SoilRaw, sd.SoilHumidity, sd.RawVar, filter, at,
     )
     return err
 }
@@ -198,223 +299,474 @@ func serveHTML(w http.ResponseWriter, r *http.Request) {
     http.ServeFile(w, r, "index.html")
 }
 
+// หา device ของ request: /devices/{id}/... หรือ ?device=<id> ไม่ระบุ = ตัวแรก
+// ไม่เจอ => ตอบ 404/503 แล้วคืน nil
+func requestDevice(w http.ResponseWriter, r *http.Request) *serialLink {
+    id := mux.Vars(r)["id"]
+    if id == "" {
+        id = r.URL.Query().Get("device")
+    }
+    if id == "" {
+        link, ok := picoGateway.defaultDevice()
+        if !ok {
+            http.Error(w, errDeviceOffline.Error(), http.StatusServiceUnavailable)
+            return nil
+        }
+        return link
+    }
+    link, ok := picoGateway.device(id)
+    if !ok {
+        http.Error(w, "Unknown device: "+id, http.StatusNotFound)
+        return nil
+    }
+    return link
+}
+
 // โครงสร้าง JSON ที่จะส่งไปให้ Dashboard
+// air1/air2, soil และ led1..3 คือ sensor/actuator ตามลำดับที่ Pico ประกาศใน hello
+// soilReading คือค่าล่าสุดของ soil probe หนึ่งตัว
+type soilReading struct {
+    ID       int      `json:"soil_id"`
+    Humidity float64  `json:"soil_humidity"`
+    Raw      *int     `json:"soil_raw"`
+    RawVar   *float64 `json:"soil_raw_var"`
+    Filter   *string  `json:"soil_filter"`
+    Fault    string   `json:"fault"`
+    Stale    bool     `json:"stale"`
+}
+
 func fetchSensorData(w http.ResponseWriter, r *http.Request) {
     type Response struct {
-        Air1Temp     float64 `json:"air1_temp"`
-        Air1Humidity float64 `json:"air1_humidity"`
-        Air2Temp     float64 `json:"air2_temp"`
-        Air2Humidity float64 `json:"air2_humidity"`
-        SoilHumidity float64 `json:"soil_humidity"`
-        PumpStatus   bool    `json:"pump_status"`
-        LED1         int     `json:"led1"`
-        LED2         int     `json:"led2"`
-        LED3         int     `json:"led3"`
+        Air1Temp     float64        `json:"air1_temp"`
+        Air1Humidity float64        `json:"air1_humidity"`
+        Air2Temp     float64        `json:"air2_temp"`
+        Air2Humidity float64        `json:"air2_humidity"`
+        SoilHumidity float64        `json:"soil_humidity"`
+        SoilRaw      *int           `json:"soil_raw"`
+        SoilRawVar   *float64       `json:"soil_raw_var"`
+        SoilFilter   *string        `json:"soil_filter"`
+        PumpStatus   bool           `json:"pump_status"`
+        LED1         int            `json:"led1"`
+        LED2         int            `json:"led2"`
+        LED3         int            `json:"led3"`
+        Actuators    map[string]int `json:"actuators"`
+        Device       linkStatus     `json:"device"`
+
+        // ชนิดปัญหาของ sensor ที่อ่านไม่ได้ ("" = ปกติ) ค่าด้านบนเป็นค่าล่าสุดก่อนพัง
+        Air1Fault string         `json:"air1_fault"`
+        Air2Fault string         `json:"air2_fault"`
+        SoilFault string         `json:"soil_fault"`
+        Health    []sensorHealth `json:"health"`
+
+        // true = sensor ไม่ส่งค่ามานานเกินที่ keepalive ของ firmware บอกไว้
+        Air1Stale bool `json:"air1_stale"`
+        Air2Stale bool `json:"air2_stale"`
+        SoilStale bool `json:"soil_stale"`
+
+        // soil probe ทุกตัวของบอร์ด (หนึ่งตัวต่อแปลง) ตัวแรกคือค่าเดียวกับ soil_* ด้านบน
+        Soils []soilReading `json:"soils"`
     }
 
-    var res Response
-    res.LED1 = led13Brightness
-    res.LED2 = led14Brightness
-    res.LED3 = led15Brightness
+    link := requestDevice(w, r)
+    if link == nil {
+        return
+    }
+    deviceID := link.id()
+    caps := link.registry.capabilities()
+    state := link.registry.stateSnapshot()
 
-    // Query ล่าสุด air_id=1
-    err := db.QueryRow(`SELECT temp, air_humidity FROM airvalue WHERE air_id=1 ORDER BY reading_time DESC LIMIT 1`).Scan(&res.Air1Temp, &res.Air1Humidity)
-    if err != nil {
-        fmt.Println("Error reading air_id=1:", err)
+    var res Response
+    leds := []*int{&res.LED1, &res.LED2, &res.LED3}
+    for i, a := range caps.actuatorsOfKind(actuatorPWM) {
+        if i < len(leds) {
+            *leds[i] = state[a.Name]
+        }
     }
-    // Query ล่าสุด air_id=2
-    err = db.QueryRow(`SELECT temp, air_humidity FROM airvalue WHERE air_id=2 ORDER BY reading_time DESC LIMIT 1`).Scan(&res.Air2Temp, &res.Air2Humidity)
-    if err != nil {
-        fmt.Println("Error reading air_id=2:", err)
+
+    // Query ล่าสุดของ air sensor 2 ตัวแรก (ไม่มี database => ตอบแค่สถานะกับ health)
+    airs := [][2]*float64{{&res.Air1Temp, &res.Air1Humidity}, {&res.Air2Temp, &res.Air2Humidity}}
+    airFaults := []*string{&res.Air1Fault, &res.Air2Fault}
+    airStale := []*bool{&res.Air1Stale, &res.Air2Stale}
+    for i, s := range caps.sensorsOfKind("air") {
+        if i >= len(airs) {
+            break
+        }
+        h := link.registry.healthOf("air", s.ID)
+        *airFaults[i], *airStale[i] = h.Error, h.Stale
+        if db == nil {
+            continue
+        }
+        err := db.QueryRow(`SELECT temp, air_humidity FROM airvalue WHERE device_id=$1 AND air_id=$2 ORDER BY reading_time DESC LIMIT 1`, deviceID, s.ID).Scan(airs[i][0], airs[i][1])
+        if err != nil {
+            fmt.Printf("Error reading %s air_id=%d: %v\n", deviceID, s.ID, err)
+        }
     }
 
-    // Query ล่าสุด soil_id=1
-    err = db.QueryRow(`SELECT soil_humidity FROM soilvalue WHERE soil_id=1 ORDER BY reading_time DESC LIMIT 1`).Scan(&res.SoilHumidity)
-    if err != nil {
-        fmt.Println("Error reading soil_id=1:", err)
+    // Query ล่าสุดของ soil sensor ทุกตัว
+    res.Soils = []soilReading{}
+    for _, s := range caps.sensorsOfKind("soil") {
+        h := link.registry.healthOf("soil", s.ID)
+        soil := soilReading{ID: s.ID, Fault: h.Error, Stale: h.Stale}
+        if db != nil {
+            err := db.QueryRow(`SELECT soil_humidity, soil_raw, soil_raw_var, soil_filter FROM soilvalue WHERE device_id=$1 AND soil_id=$2 ORDER BY reading_time DESC LIMIT 1`, deviceID, s.ID).Scan(&soil.Humidity, &soil.Raw, &soil.RawVar, &soil.Filter)
+            if err != nil {
+                fmt.Printf("Error reading %s soil_id=%d: %v\n", deviceID, s.ID, err)
+            }
+        }
+        res.Soils = append(res.Soils, soil)
+    }
+    if len(res.Soils) > 0 {
+        first := res.Soils[0]
+        res.SoilHumidity, res.SoilRaw, res.SoilFault, res.SoilStale = first.Humidity, first.Raw, first.Fault, first.Stale
+        res.SoilRawVar, res.SoilFilter = first.RawVar, first.Filter
     }
 
     // ปั๊มน้ำ
-    res.PumpStatus = currentPumpStatus
+    res.PumpStatus = state["pump"] != 0
+    res.Actuators = state
+    res.Device = link.status()
+    res.Health = link.registry.healthSnapshot()
 
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(res)
 }
 
-// ควบคุม pump
-func controlPump(w http.ResponseWriter, r *http.Request) {
-    var req struct{ Command string `json:"command"` }
-    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        http.Error(w, "Invalid JSON", http.StatusBadRequest)
-        return
-    }
-    if req.Command != "on" && req.Command != "off" {
-        http.Error(w, "Use 'on' or 'off'", http.StatusBadRequest)
-        return
-    }
-    _, err := serialPort.Write([]byte(req.Command + "\n"))
-    if err != nil {
-        http.Error(w, "Failed to write serial", http.StatusInternalServerError)
-        return
-    }
-    serialPort.Flush()
-    ackR := bufio.NewReader(serialPort)
-    ackLine, err := ackR.ReadString('\n')
+// ตอบ HTTP ตามผลของคำสั่งที่ส่งให้ Pico
+// - Pico ไม่ได้ต่ออยู่     => 503
+// - ไม่มี ACK ภายในเวลา => 504
+// - Pico ตอบ ERR        => 502
+func writeCommandResult(w http.ResponseWriter, ackLine string, err error) {
     if err != nil {
-        http.Error(w, "No ACK or read error", http.StatusGatewayTimeout)
+        status := http.StatusInternalServerError
+        if errors.Is(err, errDeviceOffline) {
+            status = http.StatusServiceUnavailable
+        } else if errors.Is(err, errCommandTimeout) {
+            status = http.StatusGatewayTimeout
+        } else if errors.Is(err, errDeviceRejected) {
+            status = http.StatusBadGateway
+        }
+        http.Error(w, err.Error(), status)
         return
     }
-
-    resp := map[string]string{"ack": strings.TrimSpace(ackLine)}
+    resp := map[string]string{"ack": ackLine}
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(resp)
 }
 
-// ควบคุมไฟ LED GPIO13
-func controlLight13(w http.ResponseWriter, r *http.Request) {
-    var req struct{ Brightness int `json:"brightness"` }
-    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        http.Error(w, "Invalid JSON", http.StatusBadRequest)
+// ตอบ HTTP ตามผลของคำสั่งในคิว
+// - ACK => 200, ERR/ส่งซ้ำครบแล้วไม่สำเร็จ => เหมือน writeCommandResult
+// - ยังไม่จบภายใน commandWaitTimeout หรือถูกคำสั่งใหม่แทน => 202 (ดูผลได้ที่ /devices/{id}/commands)
+func writeQueuedResult(w http.ResponseWriter, c queuedCommand) {
+    if c.err != nil && (c.Status == commandRejected || c.Status == commandFailed) {
+        writeCommandResult(w, c.Ack, c.err)
         return
     }
-    if req.Brightness < 0 || req.Brightness > 100 {
-        http.Error(w, "Brightness must be 0..100", http.StatusBadRequest)
-        return
+    resp := struct {
+        Ack     string        `json:"ack"`
+        Command queuedCommand `json:"command"`
+    }{c.Ack, c}
+    w.Header().Set("Content-Type", "application/json")
+    if c.Status != commandAcked {
+        w.WriteHeader(http.StatusAccepted)
     }
-    led13Brightness = req.Brightness
+    json.NewEncoder(w).Encode(resp)
+}
 
-    cmd := fmt.Sprintf("light13:%d\n", req.Brightness)
-    _, err := serialPort.Write([]byte(cmd))
-    if err != nil {
-        http.Error(w, "Failed to write serial", http.StatusInternalServerError)
+// ควบคุม actuator ตามชื่อที่ Pico ประกาศใน hello เช่น /devices/{id}/control-pump
+// (/control-pump เดิม = device ตัวแรก)
+// relay: {"command":"on"|"off"}   pwm: {"brightness":0..100}
+// pwm ที่มี ramp: {"brightness":80,"ramp_ms":600000,"curve":"gamma"} = ค่อยๆ เปลี่ยนบน Pico (curve ไม่ใส่ = linear)
+// ramp ยาวสุดที่ firmware รับ (24 ชั่วโมง)
+const maxRampMs = 24 * 60 * 60 * 1000
+
+func controlActuator(w http.ResponseWriter, r *http.Request) {
+    link := requestDevice(w, r)
+    if link == nil {
         return
     }
-    serialPort.Flush()
-    ackR := bufio.NewReader(serialPort)
-    ackLine, err := ackR.ReadString('\n')
-    if err != nil {
-        http.Error(w, "No Ack or read error", http.StatusGatewayTimeout)
+    registry := link.registry
+    name := mux.Vars(r)["name"]
+    a, ok := registry.actuator(name)
+    if !ok {
+        http.Error(w, "Unknown actuator: "+name, http.StatusNotFound)
         return
     }
 
-    resp := map[string]string{"ack": strings.TrimSpace(ackLine)}
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(resp)
-}
-
-// ควบคุมไฟ LED GPIO14
-func controlLight14(w http.ResponseWriter, r *http.Request) {
-    var req struct{ Brightness int `json:"brightness"` }
+    var req struct {
+        Command    string `json:"command"`
+        Brightness *int   `json:"brightness"`
+        Value      *int   `json:"value"`
+        RampMs     int    `json:"ramp_ms"`
+        Curve      string `json:"curve"`
+    }
     if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
         http.Error(w, "Invalid JSON", http.StatusBadRequest)
         return
     }
-    if req.Brightness < 0 || req.Brightness > 100 {
-        http.Error(w, "Brightness must be 0..100", http.StatusBadRequest)
-        return
-    }
-    led14Brightness = req.Brightness
 
-    cmd := fmt.Sprintf("light14:%d\n", req.Brightness)
-    _, err := serialPort.Write([]byte(cmd))
-    if err != nil {
-        http.Error(w, "Failed to write serial", http.StatusInternalServerError)
+    var value int
+    switch {
+    case a.Kind == actuatorRelay && req.Command == "on":
+        value = 1
+    case a.Kind == actuatorRelay && req.Command == "off":
+        value = 0
+    case a.Kind == actuatorRelay:
+        http.Error(w, "Use 'on' or 'off'", http.StatusBadRequest)
+        return
+    case req.Brightness != nil:
+        value = *req.Brightness
+    case req.Value != nil:
+        value = *req.Value
+    default:
+        http.Error(w, "Missing brightness", http.StatusBadRequest)
         return
     }
-    serialPort.Flush()
-    ackR := bufio.NewReader(serialPort)
-    ackLine, err := ackR.ReadString('\n')
-    if err != nil {
-        http.Error(w, "No Ack or read error", http.StatusGatewayTimeout)
+    if value < a.Min || value > a.Max {
+        http.Error(w, fmt.Sprintf("Value must be %d..%d", a.Min, a.Max), http.StatusBadRequest)
         return
     }
+    command := registry.command(a, value)
+    if req.RampMs != 0 || req.Curve != "" {
+        switch {
+        case !a.Ramp:
+            http.Error(w, "Device cannot ramp "+a.Name, http.StatusBadRequest)
+            return
+        case req.RampMs < 0 || req.RampMs > maxRampMs:
+            http.Error(w, fmt.Sprintf("ramp_ms must be 0..%d", maxRampMs), http.StatusBadRequest)
+            return
+        case req.Curve == "":
+            req.Curve = "linear"
+        case req.Curve != "linear" && req.Curve != "gamma":
+            http.Error(w, "Use curve 'linear' or 'gamma'", http.StatusBadRequest)
+            return
+        }
+        command = rampCommand(a, value, req.RampMs, req.Curve)
+    }
 
-    resp := map[string]string{"ack": strings.TrimSpace(ackLine)}
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(resp)
+    // จำค่าที่ต้องการไว้ก่อน ถ้าส่งไม่สำเร็จหรือ Pico reset จะถูกส่งซ้ำตอน resync (ค่าปลายทาง ไม่ ramp ซ้ำ)
+    registry.setDesired(a.Name, value)
+    cmd := link.queue.enqueue(a.Name, value, command)
+    writeQueuedResult(w, link.queue.wait(cmd, commandWaitTimeout))
 }
 
-// ควบคุมไฟ LED GPIO15
-func controlLight15(w http.ResponseWriter, r *http.Request) {
-    var req struct{ Brightness int `json:"brightness"` }
-    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+// POST /devices/{id}/soil-calibration (/soil-calibration เดิม = device ตัวแรก)
+// {"point":"dry"|"wet"} = ใช้ค่า ADC ตอนนี้เป็นจุดแห้ง/ชุ่ม, {"dry":N,"wet":N} = ตั้งค่าดิบเอง,
+// {"point":"reset"} = กลับเป็นค่า default; Pico เก็บค่าไว้ใน flash
+func calibrateSoil(w http.ResponseWriter, r *http.Request) {
+    link := requestDevice(w, r)
+    if link == nil {
+        return
+    }
+    var req struct {
+        ID    int    `json:"id"` // soil_id (0 = probe ตัวแรก)
+        Point string `json:"point"`
+        Dry   *int   `json:"dry"`
+        Wet   *int   `json:"wet"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID < 0 {
         http.Error(w, "Invalid JSON", http.StatusBadRequest)
         return
     }
-    if req.Brightness < 0 || req.Brightness > 100 {
-        http.Error(w, "Brightness must be 0..100", http.StatusBadRequest)
+
+    cmd := "soilcal"
+    if req.ID > 0 {
+        cmd += strconv.Itoa(req.ID)
+    }
+    switch {
+    case req.Point == "dry" || req.Point == "wet" || req.Point == "reset":
+        cmd += ":" + req.Point
+    case req.Point != "":
+        http.Error(w, "Use point 'dry', 'wet' or 'reset'", http.StatusBadRequest)
+        return
+    case req.Dry != nil && req.Wet != nil:
+        if *req.Dry < 0 || *req.Dry > 65535 || *req.Wet < 0 || *req.Wet > 65535 || *req.Dry == *req.Wet {
+            http.Error(w, "dry and wet must be different values in 0..65535", http.StatusBadRequest)
+            return
+        }
+        cmd += fmt.Sprintf(":%d,%d", *req.Dry, *req.Wet)
+    default:
+        http.Error(w, "Missing point or dry/wet", http.StatusBadRequest)
         return
     }
-    led15Brightness = req.Brightness
 
-    cmd := fmt.Sprintf("light15:%d\n", req.Brightness)
-    _, err := serialPort.Write([]byte(cmd))
-    if err != nil {
-        http.Error(w, "Failed to write serial", http.StatusInternalServerError)
+    ack, err := link.sendCommand(cmd)
+    if err == nil {
+        // ACK = "soil<id> dry=<dry> wet=<wet>" => อัปเดต cal ใน capabilities โดยไม่ต้องขอ hello ใหม่
+        var id int
+        var cal soilCalibration
+        if _, e := fmt.Sscanf(ack, "ACK: soil%d dry=%d wet=%d", &id, &cal.Dry, &cal.Wet); e == nil {
+            link.registry.setCalibration("soil", id, cal)
+        }
+    }
+    writeCommandResult(w, ack, err)
+}
+
+// GET /devices/{id}/logs?level=warn&limit=50: log ล่าสุดจาก Pico (ค่าเริ่มต้น = ทุกระดับที่เก็บไว้)
+func fetchLogs(w http.ResponseWriter, r *http.Request) {
+    link := requestDevice(w, r)
+    if link == nil {
         return
     }
-    serialPort.Flush()
-    ackR := bufio.NewReader(serialPort)
-    ackLine, err := ackR.ReadString('\n')
-    if err != nil {
-        http.Error(w, "No Ack or read error", http.StatusGatewayTimeout)
+    level := r.URL.Query().Get("level")
+    if level == "" {
+        level = protocol.LevelDebug
+    } else if protocol.LevelRank(level) < 0 {
+        http.Error(w, "Unknown level: "+level, http.StatusBadRequest)
         return
     }
+    limit := 0
+    if v := r.URL.Query().Get("limit"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 0 {
+            http.Error(w, "Invalid limit", http.StatusBadRequest)
+            return
+        }
+        limit = n
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(link.logs.snapshot(level, limit))
+}
 
-    resp := map[string]string{"ack": strings.TrimSpace(ackLine)}
+// GET /devices/{id}/commands: คำสั่งที่รอส่งอยู่ และผลของคำสั่งล่าสุด
+func fetchCommands(w http.ResponseWriter, r *http.Request) {
+    link := requestDevice(w, r)
+    if link == nil {
+        return
+    }
+    queued, recent := link.queue.snapshot()
+    resp := struct {
+        Queued []queuedCommand `json:"queued"`
+        Recent []queuedCommand `json:"recent"`
+    }{queued, recent}
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(resp)
 }
 
-func sendLight13Brightness(value int) {
-    led13Brightness = value
-    data := fmt.Sprintf(`{"brightness":%d}`, value)
-    resp, err := http.Post("http://localhost:8080/control-light13", "application/json", bytes.NewBuffer([]byte(data)))
-    if err != nil {
-        fmt.Println("Error sending brightness 13:", err)
+// ข้อมูลของ Pico หนึ่งตัว: firmware, sensor, actuator และค่าจริง/ค่าที่ต้องการของ actuator
+type deviceInfo struct {
+    Status       linkStatus     `json:"status"`
+    Capabilities capabilities   `json:"capabilities"`
+    State        map[string]int `json:"state"`
+    Desired      map[string]int `json:"desired"`
+    Health       []sensorHealth `json:"health"`
+}
+
+func describeDevice(link *serialLink) deviceInfo {
+    r := link.registry
+    return deviceInfo{link.status(), r.capabilities(), r.stateSnapshot(), r.desiredSnapshot(), r.healthSnapshot()}
+}
+
+// GET /devices/{id} (/device เดิม = device ตัวแรก)
+func fetchDevice(w http.ResponseWriter, r *http.Request) {
+    link := requestDevice(w, r)
+    if link == nil {
         return
     }
-    defer resp.Body.Close()
-    body, _ := io.ReadAll(resp.Body)
-    fmt.Printf("Light13 Ack => %s\n", string(body))
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(describeDevice(link))
 }
 
-func sendLight14Brightness(value int) {
-    led14Brightness = value
-    data := fmt.Sprintf(`{"brightness":%d}`, value)
-    resp, err := http.Post("http://localhost:8080/control-light14", "application/json", bytes.NewBuffer([]byte(data)))
-    if err != nil {
-        fmt.Println("Error sending brightness 14:", err)
-        return
+// GET /devices: Pico ทุกตัวที่ gateway รู้จัก เรียงตาม id
+func fetchDevices(w http.ResponseWriter, r *http.Request) {
+    resp := []deviceInfo{}
+    for _, link := range picoGateway.devices() {
+        resp = append(resp, describeDevice(link))
     }
-    defer resp.Body.Close()
-    body, _ := io.ReadAll(resp.Body)
-    fmt.Printf("Light14 Ack => %s\n", string(body))
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(resp)
+}
+
+// GUI สั่ง actuator ผ่านคิวคำสั่งของ device โดยไม่รอ ACK (ไม่บล็อก UI)
+// เลื่อน slider เร็วๆ ค่าที่ยังไม่ได้ส่งถูกแทนด้วยค่าล่าสุดในคิว
+func sendActuatorValue(link *serialLink, a actuatorInfo, value int) {
+    link.registry.setDesired(a.Name, value)
+    cmd := link.queue.enqueue(a.Name, value, link.registry.command(a, value))
+    go func() {
+        c := link.queue.wait(cmd, commandWaitTimeout)
+        switch {
+        case c.Status == commandReplaced:
+        case c.err != nil:
+            fmt.Printf("Error sending %s: %v\n", a.Name, c.err)
+        default:
+            fmt.Printf("%s Ack => %s (%s)\n", a.Name, c.Ack, c.Status)
+        }
+    }()
 }
 
-func sendLight15Brightness(value int) {
-    led15Brightness = value
-    data := fmt.Sprintf(`{"brightness":%d}`, value)
-    resp, err := http.Post("http://localhost:8080/control-light15", "application/json", bytes.NewBuffer([]byte(data)))
+// showConfigDialog อ่าน config ของ Pico ผ่าน API แล้วเปิดฟอร์มให้แก้ ส่งเฉพาะค่าที่เปลี่ยน
+func showConfigDialog(deviceID string) {
+    target := "http://localhost:8080/devices/" + url.PathEscape(deviceID) + "/config"
+    cfg, err := configRequest(http.MethodGet, target, nil)
     if err != nil {
-        fmt.Println("Error sending brightness 15:", err)
+        dialog.ShowError(err, myWindow)
         return
     }
-    defer resp.Body.Close()
-    body, _ := io.ReadAll(resp.Body)
-    fmt.Printf("Light15 Ack => %s\n", string(body))
+
+    keys := make([]string, 0, len(cfg))
+    for k := range cfg {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    entries := make(map[string]*widget.Entry, len(keys))
+    items := make([]*widget.FormItem, 0, len(keys))
+    for _, k := range keys {
+        e := widget.NewEntry()
+        e.SetText(fmt.Sprint(cfg[k]))
+        entries[k] = e
+        items = append(items, widget.NewFormItem(k, e))
+    }
+
+    dialog.ShowForm("Config "+deviceID, "Save", "Cancel", items, func(save bool) {
+        if !save {
+            return
+        }
+        changed := make(map[string]interface{})
+        for _, k := range keys {
+            text := strings.TrimSpace(entries[k].Text)
+            if text == fmt.Sprint(cfg[k]) {
+                continue
+            }
+            // ตัวเลขส่งเป็น number ที่เหลือ (เช่น "06:30") ส่งเป็น string
+            if v, err := strconv.ParseFloat(text, 64); err == nil {
+                changed[k] = v
+            } else {
+                changed[k] = text
+            }
+        }
+        if len(changed) == 0 {
+            return
+        }
+        go func() {
+            body, _ := json.Marshal(changed)
+            if _, err := configRequest(http.MethodPut, target, body); err != nil {
+                dialog.ShowError(err, myWindow)
+                return
+            }
+            fmt.Printf("Config %s => %s\n", deviceID, string(body))
+        }()
+    }, myWindow)
 }
 
-func sendPumpCommand(cmd string) {
-    data := fmt.Sprintf(`{"command":"%s"}`, cmd)
-    resp, err := http.Post("http://localhost:8080/control-pump", "application/json", bytes.NewBuffer([]byte(data)))
+func configRequest(method, target string, body []byte) (map[string]interface{}, error) {
+    req, err := http.NewRequest(method, target, bytes.NewReader(body))
     if err != nil {
-        fmt.Println("Error pump command:", err)
-        return
+        return nil, err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        return nil, err
     }
     defer resp.Body.Close()
-    body, _ := io.ReadAll(resp.Body)
-    fmt.Printf("Pump Ack => %s\n", string(body))
+    data, _ := io.ReadAll(resp.Body)
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+    }
+    var cfg map[string]interface{}
+    if err := json.Unmarshal(data, &cfg); err != nil {
+        return nil, err
+    }
+    return cfg, nil
 }
 
 func createGUI() {
@@ -428,107 +780,263 @@ func createGUI() {
     title.TextStyle = fyne.TextStyle{Bold: true}
     titlebox := container.NewMax(messageBackground, container.NewCenter(title))
 
-    brightness1Label := canvas.NewText("Brightness Outer 1", color.White)
-    brightness1Label.TextSize = 16
-    brightness1Label.TextStyle = fyne.TextStyle{Bold: true}
-    slider1 = widget.NewSlider(0, 100)
-    progressBar1 = widget.NewProgressBar()
-    slider1.OnChanged = func(v float64) {
-        fmt.Printf("Brightness Outer1 => %d%%\n", int(v))
-        progressBar1.SetValue(v / 100)
-        sendLight13Brightness(int(v))
-    }
-
-    brightness2Label := canvas.NewText("Brightness Outer 2", color.White)
-    brightness2Label.TextSize = 16
-    brightness2Label.TextStyle = fyne.TextStyle{Bold: true}
-    slider2 = widget.NewSlider(0, 100)
-    progressBar2 = widget.NewProgressBar()
-    slider2.OnChanged = func(v float64) {
-        fmt.Printf("Brightness Outer2 => %d%%\n", int(v))
-        progressBar2.SetValue(v / 100)
-        sendLight14Brightness(int(v))
-    }
-
-    brightness3Label := canvas.NewText("Brightness Inner", color.White)
-    brightness3Label.TextSize = 16
-    brightness3Label.TextStyle = fyne.TextStyle{Bold: true}
-    slider3 = widget.NewSlider(0, 100)
-    progressBar3 = widget.NewProgressBar()
-    slider3.OnChanged = func(v float64) {
-        fmt.Printf("Brightness Inner => %d%%\n", int(v))
-        progressBar3.SetValue(v / 100)
-        sendLight15Brightness(int(v))
-    }
-
-    waterPumpLabel := canvas.NewText("Water Pump", color.White)
-    waterPumpLabel.TextSize = 16
-    waterPumpLabel.TextStyle = fyne.TextStyle{Bold: true}
-    pumpStatus = canvas.NewText("Stop watering the plants...", color.White)
-    pumpStatus.TextSize = 14
-    pumpStatus.TextStyle = fyne.TextStyle{Bold: true}
-
-    pumpOnButton = widget.NewButton("Turn On", func() {
-        fmt.Println("Pump ON (GUI)")
-        pumpStatus.Text = "Watering the plants..."
-        pumpOnButton.Disable()
-        pumpOffButton.Enable()
-        pumpOffButton.SetText("Turn Off")
-        myWindow.Canvas().Refresh(pumpStatus)
-        sendPumpCommand("on")
-    })
-    pumpOffButton = widget.NewButton("Turn Off", func() {
-        fmt.Println("Pump OFF (GUI)")
-        pumpStatus.Text = "Stop watering the plants..."
-        pumpOffButton.Disable()
-        pumpOnButton.Enable()
-        pumpOnButton.SetText("Turn On")
-        myWindow.Canvas().Refresh(pumpStatus)
-        sendPumpCommand("off")
+    deviceStatus = canvas.NewText("Device offline", color.NRGBA{R: 255, G: 90, B: 90, A: 255})
+    deviceStatus.TextSize = 14
+
+    // เลือก Pico ที่จะควบคุม ปุ่ม/slider สร้างจาก actuator ที่ตัวนั้นประกาศใน hello
+    deviceSelect = widget.NewSelect(nil, func(string) { refreshDeviceView() })
+    deviceSelect.PlaceHolder = "(no device)"
+    controlsBox = container.NewVBox()
+    go updateDeviceStatus()
+
+    // threshold / loop / keepalive / pump / fallback ของ Pico ที่เลือก
+    configButton := widget.NewButton("Config", func() {
+        if link, ok := picoGateway.device(deviceSelect.Selected); ok {
+            go showConfigDialog(link.id())
+        }
     })
-    pumpOffButton.Disable()
 
     content := container.NewVBox(
         container.NewCenter(titlebox),
+        container.NewCenter(container.NewHBox(deviceSelect, configButton, deviceStatus)),
+        controlsBox,
+    )
+
+    myWindow.SetContent(container.NewMax(bgRect, content))
+    myWindow.Resize(fyne.NewSize(600, 550))
+}
+
+// relay => ปุ่ม Turn On/Turn Off, pwm => slider + progress bar
+func buildControls(link *serialLink) []fyne.CanvasObject {
+    var objs []fyne.CanvasObject
+    for _, a := range link.registry.capabilities().Actuators {
+        switch a.Kind {
+        case actuatorPWM:
+            objs = append(objs, pwmControl(link, a)...)
+        case actuatorRelay:
+            objs = append(objs, relayControl(link, a)...)
+        }
+    }
+    return objs
+}
 
-        container.NewCenter(brightness1Label),
-        slider1, progressBar1,
+func controlLabel(a actuatorInfo) *canvas.Text {
+    text := a.Label
+    if text == "" {
+        text = a.Name
+    }
+    label := canvas.NewText(text, color.White)
+    label.TextSize = 16
+    label.TextStyle = fyne.TextStyle{Bold: true}
+    return label
+}
 
-        container.NewCenter(brightness2Label),
-        slider2, progressBar2,
+func pwmControl(link *serialLink, a actuatorInfo) []fyne.CanvasObject {
+    span := float64(a.Max - a.Min)
+    if span <= 0 {
+        span = 1
+    }
+    slider := widget.NewSlider(float64(a.Min), float64(a.Max))
+    progressBar := widget.NewProgressBar()
+
+    // ตั้งค่าเริ่มต้นก่อนผูก OnChanged จะได้ไม่ส่งคำสั่งซ้ำตอนสร้าง
+    slider.Value = float64(link.registry.stateOf(a.Name))
+    progressBar.SetValue((slider.Value - float64(a.Min)) / span)
+    slider.OnChanged = func(v float64) {
+        fmt.Printf("%s => %d%%\n", a.Label, int(v))
+        progressBar.SetValue((v - float64(a.Min)) / span)
+        sendActuatorValue(link, a, int(v))
+    }
+    return []fyne.CanvasObject{container.NewCenter(controlLabel(a)), slider, progressBar}
+}
 
-        container.NewCenter(brightness3Label),
-        slider3, progressBar3,
+func relayControl(link *serialLink, a actuatorInfo) []fyne.CanvasObject {
+    status := canvas.NewText("", color.White)
+    status.TextSize = 14
+    status.TextStyle = fyne.TextStyle{Bold: true}
+
+    var onButton, offButton *widget.Button
+    setStatus := func(on bool) {
+        status.Text = relayStatusText(a, on)
+        if on {
+            onButton.Disable()
+            offButton.Enable()
+        } else {
+            offButton.Disable()
+            onButton.Enable()
+        }
+        status.Refresh()
+    }
+    onButton = widget.NewButton("Turn On", func() {
+        fmt.Printf("%s ON (GUI)\n", a.Label)
+        setStatus(true)
+        sendActuatorValue(link, a, 1)
+    })
+    offButton = widget.NewButton("Turn Off", func() {
+        fmt.Printf("%s OFF (GUI)\n", a.Label)
+        setStatus(false)
+        sendActuatorValue(link, a, 0)
+    })
+    setStatus(link.registry.stateOf(a.Name) != 0)
 
-        container.NewCenter(waterPumpLabel),
-        container.NewCenter(pumpStatus),
+    return []fyne.CanvasObject{
+        container.NewCenter(controlLabel(a)),
+        container.NewCenter(status),
         container.NewHBox(
             layout.NewSpacer(),
-            pumpOnButton,
+            onButton,
             layout.NewSpacer(),
-            pumpOffButton,
+            offButton,
             layout.NewSpacer(),
         ),
-    )
+    }
+}
 
-    myWindow.SetContent(container.NewMax(bgRect, content))
-    myWindow.Resize(fyne.NewSize(600, 520))
+func relayStatusText(a actuatorInfo, on bool) string {
+    if a.Name == "pump" {
+        if on {
+            return "Watering the plants..."
+        }
+        return "Stop watering the plants..."
+    }
+    if on {
+        return "ON"
+    }
+    return "OFF"
+}
+
+// อัปเดตรายชื่อ Pico และสถานะของตัวที่เลือกบน GUI ทุก 1 วิ
+func updateDeviceStatus() {
+    for {
+        var ids []string
+        for _, link := range picoGateway.devices() {
+            ids = append(ids, link.id())
+        }
+        if strings.Join(ids, "\n") != strings.Join(deviceSelect.Options, "\n") {
+            deviceSelect.Options = ids
+            deviceSelect.Refresh()
+        }
+        if _, ok := picoGateway.device(deviceSelect.Selected); !ok && len(ids) > 0 {
+            deviceSelect.SetSelected(ids[0]) // เรียก refreshDeviceView ให้เอง
+        } else {
+            refreshDeviceView()
+        }
+        time.Sleep(time.Second)
+    }
+}
+
+// แสดงสถานะและปุ่มของ Pico ที่เลือก สร้างปุ่มใหม่เมื่อเปลี่ยนตัวหรือได้ hello ใหม่
+func refreshDeviceView() {
+    link, ok := picoGateway.device(deviceSelect.Selected)
+    if !ok {
+        deviceStatus.Text = "No device"
+        deviceStatus.Color = color.NRGBA{R: 255, G: 90, B: 90, A: 255}
+        deviceStatus.Refresh()
+        if shownControls != "" {
+            shownControls = ""
+            controlsBox.Objects = nil
+            controlsBox.Refresh()
+        }
+        return
+    }
+
+    st := link.status()
+    if st.Online {
+        deviceStatus.Text = "Device online (" + st.Port + ")"
+        deviceStatus.Color = color.NRGBA{R: 120, G: 220, B: 120, A: 255}
+    } else {
+        deviceStatus.Text = "Device offline"
+        deviceStatus.Color = color.NRGBA{R: 255, G: 90, B: 90, A: 255}
+    }
+    if st.Firmware != "" {
+        deviceStatus.Text += " | fw " + st.Firmware
+        if st.Commit != "" {
+            deviceStatus.Text += " (" + st.Commit + ")"
+        }
+    }
+    if st.DroppedFrames > 0 {
+        deviceStatus.Text += fmt.Sprintf(" | %d frames lost", st.DroppedFrames)
+    }
+    if st.Warning != "" {
+        deviceStatus.Text += " | " + st.Warning
+        deviceStatus.Color = color.NRGBA{R: 255, G: 190, B: 60, A: 255}
+    }
+    for _, h := range link.registry.healthSnapshot() {
+        if !h.OK {
+            deviceStatus.Text += fmt.Sprintf(" | %s %d fault: %s", h.Kind, h.ID, h.Error)
+            deviceStatus.Color = color.NRGBA{R: 255, G: 190, B: 60, A: 255}
+        } else if h.Stale {
+            deviceStatus.Text += fmt.Sprintf(" | %s %d stale", h.Kind, h.ID)
+            deviceStatus.Color = color.NRGBA{R: 255, G: 190, B: 60, A: 255}
+        }
+    }
+    deviceStatus.Refresh()
+
+    // ปุ่มขึ้นกับ actuator เท่านั้น (cal ของ sensor เป็น pointer พิมพ์ด้วย %+v แล้วได้ address)
+    caps := link.registry.capabilities()
+    if key := fmt.Sprintf("%s %t %+v", link.portName, caps.Legacy, caps.Actuators); key != shownControls {
+        shownControls = key
+        controlsBox.Objects = buildControls(link)
+        controlsBox.Refresh()
+    }
 }
 
 func main() {
+    serialNames := flag.String("serial", "", "comma-separated serial ports of the Picos (empty = auto-detect every Pico)")
+    emulate := flag.Bool("emulate", false, "use built-in emulated Picos instead of serial ports")
+    emulateDevices := flag.Int("emulate-devices", 1, "number of emulated Picos with -emulate")
+    emulateAir := flag.Int("emulate-air", 1, "DHT22 sensors per emulated Pico")
+    emulateSoil := flag.Int("emulate-soil", 1, "soil probes per emulated Pico (max 3)")
+    recordFile := flag.String("record", "", "append every serial line (rx/tx) with timestamps to this capture file")
+    replayFile := flag.String("replay", "", "replay a capture file through ingestion instead of reading the Pico")
+    replaySpeed := flag.Float64("replay-speed", 1, "replay speed multiplier (0 = as fast as possible)")
+    logLevel := flag.String("device-log-level", protocol.LevelInfo, "lowest Pico log level to keep: debug, info, warn or error")
+    flag.Parse()
+    if protocol.LevelRank(*logLevel) < 0 {
+        log.Fatal("Unknown -device-log-level: ", *logLevel)
+    }
+    deviceLogLevel = *logLevel
+
     var err error
     db, err = sql.Open("postgres", dbConn)
     if err != nil {
         log.Fatal("DB Error:", err)
     }
     defer db.Close()
+    if err := migrateDB(); err != nil {
+        log.Fatal("DB migrate error:", err)
+    }
 
-    cfg := &serial.Config{Name: "/dev/tty.usbmodem1201", Baud: 115200, ReadTimeout: 2 * time.Second}
-    serialPort, err = serial.OpenPort(cfg)
-    if err != nil {
-        log.Fatal("Error opening serial:", err)
+    // Pico ไม่ต้องเสียบไว้ก่อนเปิดโปรแกรม: gateway จะหาและต่อใหม่เองเมื่อเสียบ
+    var ports []string
+    for _, name := range strings.Split(*serialNames, ",") {
+        if name = strings.TrimSpace(name); name != "" {
+            ports = append(ports, name)
+        }
+    }
+    picoGateway = newGateway(ports)
+    if *recordFile != "" {
+        capture, err := openCaptureFile(*recordFile)
+        if err != nil {
+            log.Fatal("Capture file error:", err)
+        }
+        defer capture.close()
+        picoGateway.capture = capture
+        fmt.Println("Recording serial traffic to", *recordFile)
+    }
+    if *emulate {
+        fmt.Printf("Using %d emulated Pico(s)\n", *emulateDevices)
+        seed := time.Now().UnixNano()
+        for i := 1; i <= *emulateDevices; i++ {
+            id := fmt.Sprintf("emulator-%d", i)
+            picoGateway.add(newEmulatedLink(id, emulator.Config{
+                Seed:       seed + int64(i),
+                DeviceID:   id,
+                AirSensors: *emulateAir,
+                SoilProbes: *emulateSoil,
+            }))
+        }
     }
-    fmt.Println("Serial opened")
 
     opts := mqtt.NewClientOptions()
     opts.AddBroker("tcp://localhost:1883")
@@ -545,15 +1053,40 @@ func main() {
         log.Fatal("MQTT connect error:", token.Error())
     }
 
-    go readSerial()
+    if *replayFile != "" {
+        // โหมด replay: ไม่ต่อ Pico แต่ป้อนข้อมูลจากไฟล์แทน (แต่ละพอร์ตในไฟล์ขึ้นเป็น device หนึ่งตัว)
+        go func() {
+            if err := replayCapture(picoGateway, *replayFile, *replaySpeed); err != nil {
+                fmt.Println("Replay error:", err)
+                return
+            }
+            fmt.Println("Replay finished:", *replayFile)
+        }()
+    } else {
+        go picoGateway.run()
+    }
 
     router := mux.NewRouter()
     router.HandleFunc("/", serveHTML)
+    router.HandleFunc("/devices", fetchDevices).Methods("GET")
+    router.HandleFunc("/devices/{id}", fetchDevice).Methods("GET")
+    router.HandleFunc("/devices/{id}/sensor-data", fetchSensorData).Methods("GET")
+    router.HandleFunc("/devices/{id}/control-{name}", controlActuator).Methods("POST")
+    router.HandleFunc("/devices/{id}/commands", fetchCommands).Methods("GET")
+    router.HandleFunc("/devices/{id}/logs", fetchLogs).Methods("GET")
+    router.HandleFunc("/devices/{id}/soil-calibration", calibrateSoil).Methods("POST")
+    router.HandleFunc("/devices/{id}/config", fetchDeviceConfig).Methods("GET")
+    router.HandleFunc("/devices/{id}/config", updateDeviceConfig).Methods("PUT")
+
+    // route เดิม (device ตัวแรก หรือ ?device=<id>)
     router.HandleFunc("/sensor-data", fetchSensorData).Methods("GET")
-    router.HandleFunc("/control-pump", controlPump).Methods("POST")
-    router.HandleFunc("/control-light13", controlLight13).Methods("POST")
-    router.HandleFunc("/control-light14", controlLight14).Methods("POST")
-    router.HandleFunc("/control-light15", controlLight15).Methods("POST")
+    router.HandleFunc("/device", fetchDevice).Methods("GET")
+    router.HandleFunc("/control-{name}", controlActuator).Methods("POST")
+    router.HandleFunc("/commands", fetchCommands).Methods("GET")
+    router.HandleFunc("/logs", fetchLogs).Methods("GET")
+    router.HandleFunc("/soil-calibration", calibrateSoil).Methods("POST")
+    router.HandleFunc("/config", fetchDeviceConfig).Methods("GET")
+    router.HandleFunc("/config", updateDeviceConfig).Methods("PUT")
 
     // เสิร์ฟไฟล์ static (index.html, styles.css, script.js) ให้โหลดได้
     router.PathPrefix("/").Handler(http.StripPrefix("/", http.FileServer(http.Dir("."))))
@@ -563,26 +1096,10 @@ func main() {
         log.Fatal(http.ListenAndServe(":8080", router))
     }()
 
-    // ตัวอย่าง: จำลองการ insert air_id=2 แบบสุ่ม temp/humidity ทุก 5 วิ
-    go func() {
-        for {
-            temp := math.Round(24.0+((rand.Float64()*4.0*10)/10)) 
-            hum := math.Round(40.0+((rand.Float64()*10.0*10)/10))
-            err := insertAirValue(2, temp, hum)
-            if err != nil {
-                fmt.Println("❌ Simulated insertAirValue (air_id=2) error:", err)
-            } else {
-                fmt.Printf("✅ Simulated AirValue => air_id=2, temp=%.1f, hum=%.1f\n", temp, hum)
-                publishToMQTTAir(temp, hum)
-            }
-            time.Sleep(5 * time.Second)
-        }
-    }()
-
     createGUI()
     myWindow.ShowAndRun()
 
-    serialPort.Close()
+    picoGateway.stop()
     mqttClient.Disconnect(250)
     fmt.Println("Program ended.")
-}
\ No newline at end of file
+}
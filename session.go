@@ -0,0 +1,289 @@
+//go:build !tinygo
+
+package main
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "io"
+    "strings"
+    "sync"
+    "time"
+
+    "smart_farm/protocol"
+)
+
+// เวลาที่รอ ACK/ERR จาก Pico ต่อหนึ่งคำสั่ง
+const commandTimeout = 3 * time.Second
+
+var (
+    errCommandTimeout = errors.New("no ACK from device")
+    errDeviceRejected = errors.New("device rejected command")
+    errPortGone       = errors.New("port returns EOF without waiting (unplugged?)")
+)
+
+// พอร์ตที่ถูกถอดคืน io.EOF ทันทีทุกครั้งโดยไม่รอ ReadTimeout
+// ได้ EOF แบบนี้ติดกัน deadPortEOFs ครั้ง (พักนานขึ้นทีละ eofBackoff) => ถือว่าพอร์ตหาย
+const (
+    deadPortEOFs = 5
+    eofBackoff   = 100 * time.Millisecond
+)
+
+// serialSession เป็นเจ้าของพอร์ต Serial แต่เพียงผู้เดียว
+// มี goroutine อ่านพอร์ตแค่ตัวเดียว (readLoop) แล้วแยกบรรทัด:
+//   - frame ack/err หรือ "ACK: ..." / "ERR: ..." => ส่งให้คำสั่งที่กำลังรอคำตอบอยู่
+//   - frame data หรือ JSON telemetry           => ส่งต่อให้ ingestLine
+//   - frame log หรือข้อความอื่นๆ                  => เก็บใน log ของ device (ไม่พิมพ์ลง console)
+//
+// ถ้ายังไม่เคยเห็น frame จาก Pico เลย (firmware รุ่นเก่า) จะส่งคำสั่งแบบบรรทัดเดิม
+type serialSession struct {
+    port io.ReadWriteCloser
+
+    // Pico ตัวที่ session นี้คุยด้วย (registry, id)
+    link *serialLink
+
+    // firmware รุ่นเก่าตอบ ACK โดยไม่มีเลขอ้างอิง => ส่งได้ทีละคำสั่ง
+    legacyMu sync.Mutex
+
+    mu        sync.Mutex
+    framed    bool
+    nextID    uint16
+    pending   map[uint16]chan reply
+    badFrames int
+    closed    bool
+
+    // ถูกปิดเมื่อ session ปิด ให้ goroutine ที่ผูกกับ session นี้หยุด
+    done chan struct{}
+}
+
+// คำตอบของคำสั่งหนึ่งคำสั่ง
+type reply struct {
+    ok      bool
+    text    string
+    offline bool
+}
+
+// lineTimer คือพอร์ตที่รู้เวลารับบรรทัดล่าสุดเอง (replayPort ใช้เวลาในไฟล์ capture)
+type lineTimer interface {
+    lineTime() time.Time
+}
+
+// recvTime คือเวลาที่ได้รับบรรทัดที่กำลัง dispatch
+func (s *serialSession) recvTime() time.Time {
+    if lt, ok := s.port.(lineTimer); ok {
+        return lt.lineTime()
+    }
+    return time.Now()
+}
+
+// id 0 ใช้รอคำตอบแบบบรรทัดเดิม คำสั่งแบบ frame ใช้ 1..65535
+const legacyReplyID = 0
+
+func newSerialSession(port io.ReadWriteCloser, link *serialLink) *serialSession {
+    return &serialSession{port: port, link: link, pending: make(map[uint16]chan reply), done: make(chan struct{})}
+}
+
+// readLoop อ่านทีละบรรทัดจนกว่าพอร์ตจะถูกปิดหรืออ่านไม่ได้ (ถอดสาย)
+// คำสั่งที่ยังรอคำตอบอยู่จะได้ errDeviceOffline
+func (s *serialSession) readLoop() error {
+    defer s.failPending()
+    reader := bufio.NewReader(s.port)
+    var partial string
+    quickEOFs := 0
+    for {
+        start := time.Now()
+        chunk, err := reader.ReadString('\n')
+        partial += chunk
+        if err != nil {
+            if err != io.EOF || s.isClosed() {
+                return err
+            }
+            // ReadTimeout ของพอร์ตจะคืน io.EOF => อ่านต่อ เก็บส่วนที่ค้างไว้
+            if chunk != "" || time.Since(start) >= serialReadTimeout/2 {
+                quickEOFs = 0
+                continue
+            }
+            quickEOFs++
+            if quickEOFs >= deadPortEOFs {
+                return errPortGone
+            }
+            time.Sleep(time.Duration(quickEOFs) * eofBackoff)
+            continue
+        }
+        quickEOFs = 0
+        line := strings.TrimSpace(partial)
+        partial = ""
+        if line == "" {
+            continue
+        }
+        s.dispatch(line)
+    }
+}
+
+func (s *serialSession) dispatch(line string) {
+    if protocol.IsFrame(line) {
+        s.dispatchFrame(line)
+        return
+    }
+    switch {
+    case strings.HasPrefix(line, "ACK:"):
+        s.deliver(legacyReplyID, reply{ok: true, text: line})
+    case strings.HasPrefix(line, "ERR:"):
+        s.deliver(legacyReplyID, reply{ok: false, text: line})
+    case strings.Contains(line, "\"type\":\""):
+        ingestLine(s.link, line, s.recvTime())
+    default:
+        s.link.logs.addLegacyLine(line)
+    }
+}
+
+func (s *serialSession) dispatchFrame(line string) {
+    f, err := protocol.Decode(line)
+    if err != nil {
+        s.mu.Lock()
+        s.badFrames++
+        s.mu.Unlock()
+        fmt.Println("Bad frame:", err, "line:", line)
+        return
+    }
+
+    s.mu.Lock()
+    s.framed = true
+    s.mu.Unlock()
+    at := frameTime(s.link, f, s.recvTime())
+
+    switch f.Type {
+    case protocol.TypeAck:
+        s.deliver(f.ID, reply{ok: true, text: "ACK: " + f.Payload})
+    case protocol.TypeErr:
+        s.deliver(f.ID, reply{ok: false, text: "ERR: " + f.Payload})
+    case protocol.TypeData:
+        ingestLine(s.link, f.Payload, at)
+    case protocol.TypeHello:
+        handleHello(s.link, f.Payload)
+    case protocol.TypeStatus:
+        handleStatus(s.link, f.Payload)
+    case protocol.TypeHealth:
+        handleHealth(s.link, f.Payload)
+    case protocol.TypeEvent:
+        handleEvent(s.link, f.Payload)
+    case protocol.TypeBoot:
+        handleBoot(s.link, f.Payload)
+    case protocol.TypeLog:
+        s.link.logs.add(protocol.ParseLog(f.Payload))
+    default:
+        fmt.Println("Unknown frame type:", f.Type, "line:", line)
+    }
+}
+
+// ส่งคำตอบให้คำสั่งที่รอ id นี้อยู่
+func (s *serialSession) deliver(id uint16, r reply) {
+    s.mu.Lock()
+    ch := s.pending[id]
+    delete(s.pending, id)
+    s.mu.Unlock()
+    if ch == nil {
+        fmt.Println("Reply without pending command:", r.text)
+        return
+    }
+    ch <- r
+}
+
+// sendCommand เขียนคำสั่งลงพอร์ตแล้วรอ ACK/ERR ที่ตอบกลับมา
+func (s *serialSession) sendCommand(cmd string) (string, error) {
+    s.mu.Lock()
+    framed := s.framed
+    s.mu.Unlock()
+
+    var (
+        id   uint16
+        line string
+    )
+    if framed {
+        id = s.allocID()
+        line = protocol.Frame{ID: id, Type: protocol.TypeCommand, Payload: cmd}.Encode()
+    } else {
+        s.legacyMu.Lock()
+        defer s.legacyMu.Unlock()
+        id = legacyReplyID
+        line = cmd
+    }
+
+    ch := make(chan reply, 1)
+    s.mu.Lock()
+    s.pending[id] = ch
+    s.mu.Unlock()
+
+    if _, err := s.port.Write([]byte(line + "\n")); err != nil {
+        s.clearPending(id, ch)
+        return "", fmt.Errorf("write serial: %w", err)
+    }
+
+    select {
+    case r := <-ch:
+        if r.offline {
+            return "", errDeviceOffline
+        }
+        if !r.ok {
+            return r.text, fmt.Errorf("%w: %s", errDeviceRejected, r.text)
+        }
+        return r.text, nil
+    case <-time.After(commandTimeout):
+        s.clearPending(id, ch)
+        return "", fmt.Errorf("%w: %q after %v", errCommandTimeout, cmd, commandTimeout)
+    }
+}
+
+// id ถัดไปที่ไม่ซ้ำกับคำสั่งที่ยังรอคำตอบอยู่ (ข้าม 0)
+func (s *serialSession) allocID() uint16 {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for {
+        s.nextID++
+        if s.nextID == legacyReplyID {
+            continue
+        }
+        if _, busy := s.pending[s.nextID]; !busy {
+            return s.nextID
+        }
+    }
+}
+
+func (s *serialSession) clearPending(id uint16, ch chan reply) {
+    s.mu.Lock()
+    if s.pending[id] == ch {
+        delete(s.pending, id)
+    }
+    s.mu.Unlock()
+}
+
+// ปลด HTTP handler ที่รอคำตอบอยู่เมื่อพอร์ตหลุด
+func (s *serialSession) failPending() {
+    s.mu.Lock()
+    pending := s.pending
+    s.pending = make(map[uint16]chan reply)
+    s.mu.Unlock()
+    for _, ch := range pending {
+        ch <- reply{ok: false, text: errDeviceOffline.Error(), offline: true}
+    }
+}
+
+func (s *serialSession) isClosed() bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.closed
+}
+
+// close ปิดพอร์ตได้หลายครั้ง (link กับ watchPortPath อาจเรียกซ้ำกัน)
+func (s *serialSession) close() error {
+    s.mu.Lock()
+    if s.closed {
+        s.mu.Unlock()
+        return nil
+    }
+    s.closed = true
+    s.mu.Unlock()
+    close(s.done)
+    return s.port.Close()
+}
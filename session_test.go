@@ -0,0 +1,119 @@
+//go:build !tinygo
+
+package main
+
+import (
+    "strings"
+    "testing"
+    "time"
+
+    "smart_farm/emulator"
+    "smart_farm/protocol"
+)
+
+// startEmulatedSession ต่อ serialSession เข้ากับ Pico จำลองผ่าน emulator.Pipe (ไม่ผ่าน link.run)
+func startEmulatedSession(t *testing.T, cfg emulator.Config) (*serialLink, *serialSession) {
+    t.Helper()
+    link := newSerialLink("emu-test")
+    sess := newSerialSession(emulator.Pipe(cfg), link)
+    link.setOnline("emu-test", sess)
+    done := make(chan error, 1)
+    go func() { done <- sess.readLoop() }()
+    t.Cleanup(func() {
+        link.queue.stop()
+        sess.close()
+        select {
+        case <-done:
+        case <-time.After(5 * time.Second):
+            t.Error("readLoop did not return after close")
+        }
+    })
+    return link, sess
+}
+
+// waitFor รอจน cond เป็นจริง (telemetry มาตามเวลาของ emulator)
+func waitFor(t *testing.T, what string, cond func() bool) {
+    t.Helper()
+    deadline := time.Now().Add(10 * time.Second)
+    for !cond() {
+        if time.Now().After(deadline) {
+            t.Fatalf("timed out waiting for %s", what)
+        }
+        time.Sleep(20 * time.Millisecond)
+    }
+}
+
+func TestSessionHello(t *testing.T) {
+    link, sess := startEmulatedSession(t, emulator.Config{DeviceID: "gh-1"})
+    handshake(sess)
+
+    caps := link.registry.capabilities()
+    if caps.Legacy {
+        t.Fatal("emulator treated as legacy firmware")
+    }
+    if caps.DeviceID != "gh-1" || link.id() != "gh-1" {
+        t.Errorf("device id = %q (link %q), want gh-1", caps.DeviceID, link.id())
+    }
+    if caps.protocolVersion() != protocol.Version {
+        t.Errorf("protocol = %d, want %d", caps.protocolVersion(), protocol.Version)
+    }
+    if msg := caps.compatibility(); msg != "" {
+        t.Errorf("compatibility warning %q", msg)
+    }
+    for _, name := range []string{"pump", "fan", "light13", "light14", "light15"} {
+        if _, ok := link.registry.actuator(name); !ok {
+            t.Errorf("hello has no actuator %s", name)
+        }
+    }
+    if len(caps.Sensors) < 2 {
+        t.Errorf("hello sensors = %+v, want air and soil", caps.Sensors)
+    }
+}
+
+func TestSessionQueueGetsAck(t *testing.T) {
+    link, sess := startEmulatedSession(t, emulator.Config{})
+    handshake(sess)
+
+    a, ok := link.registry.actuator("light13")
+    if !ok {
+        t.Fatal("no light13 after hello")
+    }
+    c := link.queue.wait(link.queue.enqueue(a.Name, 40, link.registry.command(a, 40)), 5*time.Second)
+    if c.Status != commandAcked {
+        t.Fatalf("command status %s (err %q), want acked", c.Status, c.Error)
+    }
+    if !strings.Contains(c.Ack, "light13=40") {
+        t.Errorf("ack = %q, want light13=40", c.Ack)
+    }
+    if got := link.registry.stateOf("light13"); got != 40 {
+        t.Errorf("registry light13 = %d, want 40", got)
+    }
+
+    // ERR จาก Pico ต้องไปถึงคำสั่งที่รออยู่เป็น rejected ไม่ใช่หมดเวลา
+    c = link.queue.wait(link.queue.enqueue(a.Name, 0, "light13:x"), 5*time.Second)
+    if c.Status != commandRejected {
+        t.Errorf("bad command status %s, want rejected", c.Status)
+    }
+}
+
+func TestSessionIngestsTelemetry(t *testing.T) {
+    link, sess := startEmulatedSession(t, emulator.Config{AirSensors: 1, SoilProbes: 1})
+    handshake(sess)
+
+    seen := func(kind string) func() bool {
+        return func() bool {
+            for _, h := range link.registry.healthSnapshot() {
+                if h.Kind == kind && h.LastSeen != nil {
+                    return true
+                }
+            }
+            return false
+        }
+    }
+    // air/soil ครั้งแรกถูกส่งตั้งแต่รอบแรกของ firmware
+    waitFor(t, "soil telemetry", seen("soil"))
+    waitFor(t, "air telemetry", seen("air"))
+    if st := link.clock.stats(); st.BootedAt == nil {
+        t.Error("no boot time from frame stamps")
+    }
+}
@@ -0,0 +1,216 @@
+//go:build !tinygo
+
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "sort"
+    "strings"
+    "time"
+
+    "smart_farm/protocol"
+)
+
+// ถามสถานะ Pico ทุกๆ ช่วงนี้ (และทุกครั้งที่เปิดพอร์ต)
+const statusInterval = 30 * time.Second
+
+// ส่ง ping ทุกๆ ช่วงนี้ ให้ Pico รู้ว่า server ยังอยู่ (ต้องถี่กว่า fallback after ของ firmware)
+const heartbeatInterval = 10 * time.Second
+
+// payload ของ frame status
+type statusReport struct {
+    Actuators map[string]int `json:"actuators"`
+    UptimeMs  int64          `json:"uptime_ms"`
+}
+
+func handleStatus(link *serialLink, payload string) {
+    var st statusReport
+    if err := json.Unmarshal([]byte(payload), &st); err != nil {
+        fmt.Println("JSON parse status error:", err, "payload:", payload)
+        return
+    }
+    // firmware ที่มี seq ในหัว frame ถูกจับ reset ที่ frameTime แล้ว
+    if link.registry.applyStatus(st) && !link.clock.stamped() {
+        fmt.Printf("Device %s rebooted (uptime %d ms)\n", link.id(), st.UptimeMs)
+    }
+}
+
+// payload ของ frame event (field ที่มีขึ้นกับชนิด event)
+type deviceEvent struct {
+    Event  string `json:"event"`
+    RanMs  int64  `json:"ran_ms,omitempty"`  // pump_timeout
+    RestMs int64  `json:"rest_ms,omitempty"` // pump_timeout
+
+    // fallback_action: สิ่งที่ Pico ทำเองตอนไม่มี server (actuator มีใน pump_timeout ด้วย)
+    UptimeMs int64  `json:"uptime_ms,omitempty"`
+    Actuator string `json:"actuator,omitempty"`
+    Value    int    `json:"value"`
+    Reason   string `json:"reason,omitempty"`
+
+    // fallback_end
+    DurationMs int64 `json:"duration_ms,omitempty"`
+    Actions    int   `json:"actions,omitempty"`
+    Dropped    int   `json:"dropped,omitempty"`
+
+    // boot: มาจาก frame boot ไม่ใช่ frame event (ดู handleBoot)
+    Restored map[string]int `json:"restored,omitempty"`
+    Reset    []string       `json:"reset,omitempty"`
+}
+
+// handleBoot รับ frame boot: ค่าที่ Pico คืนจาก flash หลัง reboot (restored) และช่องที่เริ่มจากปิด/0% (reset)
+// ตั้งสถานะใน registry เหมือน status (ถ้า server ยังไม่มีค่าที่ต้องการ จะยึดค่าที่คืนมา)
+// ที่เหลือให้ resync ตามปกติ แจ้ง log/MQTT เฉพาะ boot ใหม่ ไม่ใช่ frame เดิมที่ขอซ้ำตอน handshake
+func handleBoot(link *serialLink, payload string) {
+    ev := deviceEvent{Event: "boot"}
+    if err := json.Unmarshal([]byte(payload), &ev); err != nil {
+        fmt.Println("JSON parse boot error:", err, "payload:", payload)
+        return
+    }
+    st := statusReport{Actuators: make(map[string]int), UptimeMs: ev.UptimeMs}
+    restored := make([]string, 0, len(ev.Restored))
+    for name, v := range ev.Restored {
+        st.Actuators[name] = v
+        restored = append(restored, fmt.Sprintf("%s=%d", name, v))
+    }
+    for _, name := range ev.Reset {
+        st.Actuators[name] = 0
+    }
+    link.registry.applyStatus(st)
+
+    if !link.registry.markBoot(time.Now().Add(-time.Duration(ev.UptimeMs) * time.Millisecond)) {
+        return
+    }
+    sort.Strings(restored)
+    msg := fmt.Sprintf("booted %d s ago, restored: %s", ev.UptimeMs/1000, orNone(strings.Join(restored, " ")))
+    if len(ev.Reset) > 0 {
+        msg += ", reset to off: " + strings.Join(ev.Reset, " ")
+    }
+    fmt.Printf("Device %s %s\n", link.id(), msg)
+    link.logs.add(protocol.LevelInfo, msg)
+    publishToMQTTEvent(link.id(), ev)
+}
+
+func orNone(s string) string {
+    if s == "" {
+        return "none"
+    }
+    return s
+}
+
+// handleEvent จัดการสิ่งที่ firmware ทำเอง
+// pump_timeout: watchdog ปิดช่องรดน้ำแล้ว => ค่าที่ต้องการเป็น off ด้วย ไม่งั้น resync จะเปิดกลับหลังพักครบ
+func handleEvent(link *serialLink, payload string) {
+    var ev deviceEvent
+    if err := json.Unmarshal([]byte(payload), &ev); err != nil {
+        fmt.Println("JSON parse event error:", err, "payload:", payload)
+        return
+    }
+    switch ev.Event {
+    case "pump_timeout":
+        // firmware ก่อนมี relay หลายช่องไม่ส่ง actuator มา = pump
+        if ev.Actuator == "" {
+            ev.Actuator = "pump"
+        }
+        link.registry.setState(ev.Actuator, 0)
+        link.registry.setDesired(ev.Actuator, 0)
+        fmt.Printf("Device %s: %s turned off by watchdog after %d s\n", link.id(), ev.Actuator, ev.RanMs/1000)
+        link.logs.add(protocol.LevelWarn, fmt.Sprintf("pump_timeout: %s ran %d s, rest %d s", ev.Actuator, ev.RanMs/1000, ev.RestMs/1000))
+        publishToMQTTEvent(link.id(), ev)
+    case "fallback_start":
+        // Pico ส่งตอนไม่มี server จึงมักไม่มีใครได้รับ ถ้าได้แปลว่า ping หายไปแต่ link ยังอยู่
+        fmt.Printf("Device %s entered fallback mode\n", link.id())
+        link.logs.add(protocol.LevelWarn, "fallback mode started")
+    case "fallback_action":
+        link.registry.setState(ev.Actuator, ev.Value)
+        fmt.Printf("Device %s fallback at %d ms: %s=%d (%s)\n", link.id(), ev.UptimeMs, ev.Actuator, ev.Value, ev.Reason)
+        link.logs.add(protocol.LevelInfo, fmt.Sprintf("fallback at %d ms: %s=%d (%s)", ev.UptimeMs, ev.Actuator, ev.Value, ev.Reason))
+        publishToMQTTEvent(link.id(), ev)
+    case "fallback_end":
+        msg := fmt.Sprintf("fallback mode ended after %d s: %d actions", ev.DurationMs/1000, ev.Actions)
+        if ev.Dropped > 0 {
+            msg += fmt.Sprintf(" (%d more not recorded)", ev.Dropped)
+        }
+        fmt.Printf("Device %s %s\n", link.id(), msg)
+        link.logs.add(protocol.LevelWarn, msg)
+        publishToMQTTEvent(link.id(), ev)
+        // server กลับมาคุมเอง: ส่งค่าที่ผู้ใช้ต้องการกลับไปทันที ไม่ต้องรอรอบ status
+        // (handleEvent อยู่ใน readLoop จึงต้องส่งคำสั่งจาก goroutine อื่น)
+        if sess, err := link.session(); err == nil {
+            go syncDeviceState(sess)
+        }
+    default:
+        fmt.Printf("Device %s event %s\n", link.id(), ev.Event)
+        link.logs.add(protocol.LevelInfo, "event "+ev.Event)
+    }
+}
+
+// heartbeatLoop ส่ง "ping:<วินาทีนับจากเที่ยงคืน>" จนกว่า session จะปิด
+// Pico ใช้เป็นสัญญาณว่า server ยังอยู่ และใช้เวลาของวันสำหรับตารางไฟในโหมด fallback
+// firmware รุ่นเก่าไม่รู้จักคำสั่ง ping => หยุดทันที
+func heartbeatLoop(sess *serialSession) {
+    for {
+        now := time.Now()
+        sec := now.Hour()*3600 + now.Minute()*60 + now.Second()
+        if _, err := sess.sendCommand(fmt.Sprintf("ping:%d", sec)); err != nil {
+            if errors.Is(err, errDeviceRejected) {
+                fmt.Println("Device has no ping command, heartbeat disabled")
+                return
+            }
+            if errors.Is(err, errDeviceOffline) {
+                return
+            }
+            fmt.Println("Heartbeat failed:", err)
+        }
+        select {
+        case <-sess.done:
+            return
+        case <-time.After(heartbeatInterval):
+        }
+    }
+}
+
+// stateSyncLoop ถามสถานะแล้วส่งค่าที่ต้องการกลับไปจนกว่า session จะปิด
+// firmware รุ่นเก่าไม่รู้จักคำสั่ง status => หยุดทันที
+func stateSyncLoop(sess *serialSession) {
+    for {
+        if !syncDeviceState(sess) {
+            return
+        }
+        select {
+        case <-sess.done:
+            return
+        case <-time.After(statusInterval):
+        }
+    }
+}
+
+// syncDeviceState ขอ status แล้วส่งคำสั่ง (ผ่านคิว) ให้ actuator ที่ค่าไม่ตรงกับที่ต้องการ
+// (เช่น Pico reset แล้วไฟกลับเป็น 0%) คืน false ถ้าไม่ควรถามอีก
+func syncDeviceState(sess *serialSession) bool {
+    // frame status จะถูก handleStatus จัดการก่อนที่ ACK จะกลับมา
+    if _, err := sess.sendCommand("status"); err != nil {
+        if errors.Is(err, errDeviceRejected) {
+            fmt.Println("Device has no status command, state resync disabled")
+            return false
+        }
+        if errors.Is(err, errDeviceOffline) {
+            return false
+        }
+        fmt.Println("Status query failed:", err)
+        return true
+    }
+
+    registry, queue := sess.link.registry, sess.link.queue
+    for name, want := range registry.drifted() {
+        a, ok := registry.actuator(name)
+        // คำสั่งที่ยังอยู่ในคิวจะตั้งค่าให้เอง
+        if !ok || queue.pending(name) {
+            continue
+        }
+        fmt.Printf("Resync %s: device=%d want=%d\n", name, registry.stateOf(name), want)
+        queue.enqueue(name, want, registry.command(a, want))
+    }
+    return true
+}